@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/robertlestak/monotf/pkg/monotf"
 	log "github.com/sirupsen/logrus"
@@ -32,6 +35,15 @@ func usage() {
 	fmt.Println("  terraform")
 	fmt.Println("  terraform-speculative-plan")
 	fmt.Println("  terraform-plan-apply")
+	fmt.Println("  terraform-apply-plan")
+	fmt.Println("  terraform-drift")
+	fmt.Println("  terraform-set")
+	fmt.Println("  unlock")
+	fmt.Println("  approve")
+	fmt.Println("  reject")
+	fmt.Println("  logs")
+	fmt.Println("  freeze list|create|delete [flags]")
+	fmt.Println("  token list|create|revoke [flags]")
 	os.Exit(1)
 }
 
@@ -40,6 +52,255 @@ func printVersion() {
 	os.Exit(0)
 }
 
+// freezeWindow describes the window of the freeze for freeze list
+func freezeWindow(f monotf.Freeze) string {
+	if f.Schedule != "" {
+		tz := f.Timezone
+		if tz == "" {
+			tz = "UTC"
+		}
+		return fmt.Sprintf("%s %s for %s", f.Schedule, tz, f.Duration)
+	}
+	w := "from " + f.StartsAt.Format(time.RFC3339)
+	if f.EndsAt != nil {
+		w += " to " + f.EndsAt.Format(time.RFC3339)
+	}
+	return w
+}
+
+// freeze lists, creates, or deletes freezes. The flags of create follow
+// the subcommand, e.g. monotf freeze create -org prod -reason holidays
+func freeze(args []string) error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "freeze",
+	})
+	if len(args) == 0 {
+		return fmt.Errorf("a freeze command is required: list, create, or delete")
+	}
+	fs := flag.NewFlagSet("freeze "+args[0], flag.ExitOnError)
+	active := fs.Bool("active", false, "for list, only show freezes in effect")
+	org := fs.String("org", monotf.M.Org, "org to freeze, or * for all orgs")
+	workspaces := fs.String("workspaces", "", "comma separated globs of workspace paths to freeze, e.g. prod/*. all workspaces of the org if empty")
+	reason := fs.String("reason", "", "reason for the freeze, required")
+	start := fs.String("start", "", "start of a one-off freeze in RFC3339 format, defaults to now")
+	end := fs.String("end", "", "end of a one-off freeze in RFC3339 format. if empty, the freeze lasts until it is deleted")
+	schedule := fs.String("schedule", "", "cron expression of the start of a recurring freeze, e.g. \"0 18 * * 5\"")
+	duration := fs.String("duration", "", "duration of each recurring freeze, e.g. 64h")
+	timezone := fs.String("timezone", "", "timezone of the schedule, defaults to UTC")
+	breakGlassRole := fs.String("break-glass-role", "", "role allowed to break the freeze with -break-glass")
+	fs.Parse(args[1:])
+	switch args[0] {
+	case "list":
+		freezes, err := monotf.ListFreezesRemote(*active)
+		if err != nil {
+			return err
+		}
+		for _, f := range freezes {
+			state := "inactive"
+			if f.Active {
+				state = "active"
+			}
+			scope := f.Org
+			if scope == "" {
+				scope = "*"
+			}
+			if len(f.Workspaces) > 0 {
+				scope += ":" + strings.Join(f.Workspaces, ",")
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\n", f.ID, state, scope, freezeWindow(f), f.Reason)
+		}
+	case "create":
+		f := &monotf.Freeze{
+			Org:            *org,
+			Reason:         *reason,
+			Schedule:       *schedule,
+			Duration:       *duration,
+			Timezone:       *timezone,
+			BreakGlassRole: *breakGlassRole,
+		}
+		if f.Org == "*" {
+			f.Org = ""
+		}
+		if *workspaces != "" {
+			f.Workspaces = strings.Split(*workspaces, ",")
+		}
+		for _, t := range []struct {
+			v   string
+			dst **time.Time
+		}{{*start, &f.StartsAt}, {*end, &f.EndsAt}} {
+			if t.v == "" {
+				continue
+			}
+			pt, err := time.Parse(time.RFC3339, t.v)
+			if err != nil {
+				return fmt.Errorf("invalid time %s: %w", t.v, err)
+			}
+			*t.dst = &pt
+		}
+		if err := f.Validate(); err != nil {
+			return err
+		}
+		if err := monotf.CreateFreezeRemote(f); err != nil {
+			return err
+		}
+		l.Infof("created %s, active: %t", f, f.Active)
+	case "delete":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("the id of the freeze to delete is required")
+		}
+		id, err := strconv.ParseUint(fs.Arg(0), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid freeze id %s", fs.Arg(0))
+		}
+		if err := monotf.DeleteFreezeRemote(uint(id)); err != nil {
+			return err
+		}
+		l.Infof("deleted freeze %d", id)
+	default:
+		return fmt.Errorf("unknown freeze command %s", args[0])
+	}
+	return nil
+}
+
+// token lists, creates, or revokes API tokens. The flags of create follow
+// the subcommand, e.g. monotf token create -name ci -roles plan
+func token(args []string) error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "token",
+	})
+	if len(args) == 0 {
+		return fmt.Errorf("a token command is required: list, create, or revoke")
+	}
+	fs := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	name := fs.String("name", "", "name of the token, required")
+	roles := fs.String("roles", "", "comma separated roles of the token: read, plan, apply, or admin, required")
+	orgs := fs.String("orgs", "", "comma separated orgs the token may access. all orgs if empty")
+	workspaces := fs.String("workspaces", "", "comma separated globs of workspace names the token may access, e.g. prod-*. all workspaces of its orgs if empty")
+	expires := fs.String("expires", "", "how long the token is valid for, e.g. 720h. the token does not expire if empty")
+	fs.Parse(args[1:])
+	split := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, ",")
+	}
+	switch args[0] {
+	case "list":
+		tokens, err := monotf.ListTokensRemote()
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			state := "active"
+			switch {
+			case t.RevokedAt != nil:
+				state = "revoked"
+			case t.ExpiresAt != nil && t.ExpiresAt.Before(time.Now()):
+				state = "expired"
+			}
+			scope := "*"
+			if len(t.Orgs) > 0 {
+				scope = strings.Join(t.Orgs, ",")
+			}
+			if len(t.Workspaces) > 0 {
+				scope += ":" + strings.Join(t.Workspaces, ",")
+			}
+			lastUsed := "never"
+			if t.LastUsedAt != nil {
+				lastUsed = t.LastUsedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\tlast used %s\n",
+				t.ID, t.Name, t.Prefix, state, strings.Join(t.Roles, ","), scope, lastUsed)
+		}
+	case "create":
+		t := &monotf.APIToken{
+			Name:       *name,
+			Roles:      split(*roles),
+			Orgs:       split(*orgs),
+			Workspaces: split(*workspaces),
+		}
+		if *expires != "" {
+			d, err := time.ParseDuration(*expires)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid expiry %s", *expires)
+			}
+			exp := time.Now().Add(d)
+			t.ExpiresAt = &exp
+		}
+		if err := t.Validate(); err != nil {
+			return err
+		}
+		if err := monotf.CreateTokenRemote(t); err != nil {
+			return err
+		}
+		l.Infof("created token %s, it is shown only once", t.Name)
+		fmt.Println(t.Secret)
+	case "revoke":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("the id or name of the token to revoke is required")
+		}
+		t, err := monotf.RevokeTokenRemote(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		l.Infof("revoked token %d %s", t.ID, t.Name)
+	default:
+		return fmt.Errorf("unknown token command %s", args[0])
+	}
+	return nil
+}
+
+// loadWorkspace switches to the named workspace and loads its environment
+func loadWorkspace(name string, init bool) (*monotf.Workspace, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "loadWorkspace",
+		"ws":  name,
+	})
+	ws, err := monotf.M.GetWorkspaceLocal(name)
+	if err != nil {
+		l.Errorf("error switching workspace: %v", err)
+		return nil, err
+	}
+	pv, err := monotf.M.ParsePathVars(ws.Path)
+	if err != nil {
+		l.Errorf("error parsing path vars: %v", err)
+		return nil, err
+	}
+	ws.PathVars = pv
+	l.Debugf("switched to workspace %s", ws.Name)
+	if init {
+		ws.Init = true
+	}
+	if monotf.M.VaultEnv != nil && monotf.M.VaultEnv.Path != "" {
+		envVars, err := monotf.M.VaultEnv.Get()
+		if err != nil {
+			l.Errorf("error getting vault env: %v", err)
+			return nil, err
+		}
+		ws.EnvVars = append(ws.EnvVars, envVars...)
+	}
+	if monotf.M.VarScript != "" {
+		if !filepath.IsAbs(monotf.M.VarScript) {
+			cwd, err := os.Getwd()
+			if err != nil {
+				l.Errorf("error getting current dir: %v", err)
+				return nil, err
+			}
+			monotf.M.VarScript = filepath.Join(cwd, monotf.M.VarScript)
+		}
+		envVars, err := ws.VarsFromScript()
+		if err != nil {
+			l.Errorf("error getting vars from script: %v", err)
+			return nil, err
+		}
+		ws.EnvVars = append(ws.EnvVars, envVars...)
+	}
+	return ws, nil
+}
+
 func main() {
 	l := log.WithFields(log.Fields{
 		"app": "monotf",
@@ -48,12 +309,19 @@ func main() {
 	monotfflags.Usage = usage
 	configFile := monotfflags.String("config", "monotf.yaml", "path to config file")
 	logLevel := monotfflags.String("log-level", log.GetLevel().String(), "log level")
-	workspace := monotfflags.String("w", "", "workspace to use")
+	workspace := monotfflags.String("w", "", "workspace to use. for terraform-set, a comma separated list of workspaces")
 	repoDir := monotfflags.String("dir", "", "path to repo directory")
 	init := monotfflags.Bool("init", true, "initialize repo")
 	serverPort := monotfflags.Int("port", 8080, "port to run server on")
 	serverAddr := monotfflags.String("addr", "", "monotf server to use")
 	waitTimeout := monotfflags.String("wait", "0s", "timeout for waiting for workspace to be ready. 0 means no timeout")
+	lockTTL := monotfflags.String("lock-ttl", "", "lease duration of the workspace lock. the lease is renewed while running")
+	priority := monotfflags.String("priority", "", "priority of the workspace lock request: low, normal, or high")
+	reason := monotfflags.String("reason", "", "reason for a force-unlock, required by unlock. for approve and reject, a comment recorded with the decision")
+	override := monotfflags.String("override", "", "reason for overriding the protection of a protected workspace, recorded on the server")
+	breakGlass := monotfflags.String("break-glass", "", "reason for taking a lock during a freeze, allowed if MONOTF_ADMIN_TOKEN, or MONOTF_TOKEN if it is not set, has the break-glass role of the freeze")
+	follow := monotfflags.Bool("f", false, "for logs, follow the output of a run in progress until it finishes")
+	runId := monotfflags.Uint("run", 0, "for logs, the run to show, defaults to the most recent run. for terraform-apply-plan, the plan run to apply. for approve and reject, the plan run to decide, defaults to the latest run")
 	vaultEnvAddr := monotfflags.String("vault-addr", "", "vault address")
 	vaultEnvNamespace := monotfflags.String("vault-namespace", "", "vault namespace")
 	vaultEnvPath := monotfflags.String("vault-path", "", "vault path")
@@ -64,6 +332,7 @@ func main() {
 	}
 	log.SetLevel(ll)
 	var ws *monotf.Workspace
+	var wsSet monotf.WorkspaceSet
 	if len(monotfflags.Args()) == 0 {
 		usage()
 		os.Exit(1)
@@ -73,6 +342,11 @@ func main() {
 		l.Errorf("no command provided")
 		os.Exit(1)
 	}
+	if cmd == "logs" {
+		// logs takes no args, so allow flags after the command,
+		// e.g. monotf logs -f -w <ws>
+		monotfflags.Parse(monotfflags.Args()[1:])
+	}
 	if cmd != "server" && cmd != "version" {
 		if err := monotf.LoadConfig(*configFile); err != nil {
 			l.Errorf("error loading config file %s: %v", *configFile, err)
@@ -97,6 +371,18 @@ func main() {
 		if serverAddr != nil && *serverAddr != "" {
 			monotf.M.ServerAddr = *serverAddr
 		}
+		if lockTTL != nil && *lockTTL != "" {
+			monotf.M.LockTTL = *lockTTL
+		}
+		if priority != nil && *priority != "" {
+			monotf.M.Priority = *priority
+		}
+		monotf.M.Override = *override
+		monotf.M.BreakGlass = *breakGlass
+		if _, err := monotf.ParseLockPriority(monotf.M.Priority); err != nil {
+			l.Errorf("error parsing priority: %v", err)
+			os.Exit(1)
+		}
 		if vaultEnvAddr != nil && *vaultEnvAddr != "" {
 			if monotf.M.VaultEnv == nil {
 				monotf.M.VaultEnv = &monotf.VaultEnv{}
@@ -115,50 +401,31 @@ func main() {
 			}
 			monotf.M.VaultEnv.Path = *vaultEnvPath
 		}
-		if *workspace != "" {
-			var err error
-			ws, err = monotf.M.GetWorkspaceLocal(*workspace)
-			if err != nil {
-				l.Errorf("error switching workspace: %v", err)
-				os.Exit(1)
-			}
-			pv, err := monotf.M.ParsePathVars(ws.Path)
-			if err != nil {
-				l.Errorf("error parsing path vars: %v", err)
-				os.Exit(1)
-			}
-			ws.PathVars = pv
-			l.Debugf("switched to workspace %s", ws.Name)
-			if *init {
-				ws.Init = true
-			}
-		} else {
+		// freezes and tokens are not managed through a workspace
+		if *workspace == "" && cmd != "freeze" && cmd != "token" {
 			l.Errorf("no workspace provided")
 			os.Exit(1)
 		}
-		if monotf.M.VaultEnv != nil && monotf.M.VaultEnv.Path != "" {
-			envVars, err := monotf.M.VaultEnv.Get()
-			if err != nil {
-				l.Errorf("error getting vault env: %v", err)
-				os.Exit(1)
-			}
-			ws.EnvVars = append(ws.EnvVars, envVars...)
-		}
-		if monotf.M.VarScript != "" {
-			if !filepath.IsAbs(monotf.M.VarScript) {
-				cwd, err := os.Getwd()
+		if cmd == "terraform-set" {
+			// the set is given as a comma separated list of workspaces
+			for _, name := range strings.Split(*workspace, ",") {
+				w, err := loadWorkspace(strings.TrimSpace(name), *init)
 				if err != nil {
-					l.Errorf("error getting current dir: %v", err)
+					l.Errorf("error loading workspace %s: %v", name, err)
 					os.Exit(1)
 				}
-				monotf.M.VarScript = filepath.Join(cwd, monotf.M.VarScript)
+				wsSet = append(wsSet, w)
 			}
-			envVars, err := ws.VarsFromScript()
+		} else if cmd == "logs" || cmd == "approve" || cmd == "reject" || cmd == "unlock" {
+			// these only talk to the server, so the workspace's
+			// environment is not loaded from vault or the var script
+			ws = monotf.M.RemoteWorkspace(*workspace)
+		} else if cmd != "freeze" && cmd != "token" {
+			ws, err = loadWorkspace(*workspace, *init)
 			if err != nil {
-				l.Errorf("error getting vars from script: %v", err)
+				l.Errorf("error loading workspace %s: %v", *workspace, err)
 				os.Exit(1)
 			}
-			ws.EnvVars = append(ws.EnvVars, envVars...)
 		}
 	}
 	switch cmd {
@@ -180,17 +447,97 @@ func main() {
 			os.Exit(1)
 		}
 	case "terraform-speculative-plan":
-		_, _, err := ws.LockedTerraformSpeculativePlan(waitTimeout, []string{"plan"})
+		_, _, err := ws.LockedTerraformSpeculativePlan(waitTimeout)
+		if err != nil {
+			l.Errorf("error running terraform: %v", err)
+			os.Exit(1)
+		}
+	case "terraform-apply-plan":
+		_, _, err := ws.LockedTerraformApplyPlan(waitTimeout, *runId)
+		if err != nil {
+			l.Errorf("error running terraform: %v", err)
+			os.Exit(1)
+		}
+	case "terraform-drift":
+		rr, _, _, err := ws.LockedTerraformDrift(waitTimeout)
 		if err != nil {
 			l.Errorf("error running terraform: %v", err)
 			os.Exit(1)
 		}
+		if rr.Status == monotf.WorkspaceStatusDrifted {
+			l.Warnf("workspace has drifted")
+			os.Exit(2)
+		}
+	case "terraform-set":
+		args := monotfflags.Args()[1:]
+		if err := wsSet.LockedTerraform(waitTimeout, args); err != nil {
+			l.Errorf("error running terraform: %v", err)
+			os.Exit(1)
+		}
 	case "terraform-plan-apply":
 		_, _, err := ws.LockedTerraformPlanApply(waitTimeout)
 		if err != nil {
 			l.Errorf("error running terraform: %v", err)
 			os.Exit(1)
 		}
+	case "unlock":
+		if *reason == "" {
+			l.Errorf("a reason is required to force-unlock, set -reason")
+			os.Exit(1)
+		}
+		rw, err := ws.ForceUnlockRemote(*reason)
+		if err != nil {
+			l.Errorf("error unlocking workspace: %v", err)
+			os.Exit(1)
+		}
+		if rw.EvictedLockId != nil {
+			l.Infof("force-unlocked workspace %s, evicted lock %s", ws.Name, *rw.EvictedLockId)
+		} else {
+			l.Infof("force-unlocked workspace %s", ws.Name)
+		}
+	case "approve", "reject":
+		id := *runId
+		if id == 0 {
+			stat, err := ws.GetStatus()
+			if err != nil {
+				l.Errorf("error getting workspace status: %v", err)
+				os.Exit(1)
+			}
+			if stat.LatestRunId == nil {
+				l.Errorf("workspace %s has no runs", ws.Name)
+				os.Exit(1)
+			}
+			id = *stat.LatestRunId
+		}
+		status := monotf.ApprovalApproved
+		if cmd == "reject" {
+			status = monotf.ApprovalRejected
+		}
+		run, err := ws.DecideRunRemote(id, status, *reason)
+		if err != nil {
+			l.Errorf("error deciding approval: %v", err)
+			os.Exit(1)
+		}
+		l.Infof("plan run %d of workspace %s was %s", run.ID, ws.Name, run.Approval)
+	case "logs":
+		run, err := ws.RunLogs(*runId, *follow, os.Stdout)
+		if err != nil {
+			l.Errorf("error getting logs: %v", err)
+			os.Exit(1)
+		}
+		if run.FinishedAt != nil {
+			l.Infof("run %d finished with status %s", run.ID, run.Status)
+		}
+	case "freeze":
+		if err := freeze(monotfflags.Args()[1:]); err != nil {
+			l.Errorf("error managing freezes: %v", err)
+			os.Exit(1)
+		}
+	case "token":
+		if err := token(monotfflags.Args()[1:]); err != nil {
+			l.Errorf("error managing tokens: %v", err)
+			os.Exit(1)
+		}
 	case "version":
 		printVersion()
 		os.Exit(0)
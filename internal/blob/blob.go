@@ -0,0 +1,56 @@
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNotFound = errors.New("blob not found")
+	// Default is the store configured with Init
+	Default Store
+)
+
+// Store stores blobs, such as run output, by key. Keys are slash
+// separated paths.
+type Store interface {
+	Put(key string, data []byte) error
+	// Get returns ErrNotFound if there is no blob with the key
+	Get(key string) ([]byte, error)
+	// Delete does not return an error if there is no blob with the key
+	Delete(key string) error
+}
+
+// Init configures the default store from the BLOB_DRIVER environment
+// variable, either local (the default) or s3
+func Init() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "blob",
+		"fn":  "Init",
+	})
+	l.Debug("start")
+	driverName := os.Getenv("BLOB_DRIVER")
+	switch driverName {
+	case "", "local":
+		dir := os.Getenv("BLOB_PATH")
+		if dir == "" {
+			dir = "blobs"
+		}
+		Default = &LocalStore{Dir: dir}
+	case "s3":
+		s, err := S3StoreFromEnv()
+		if err != nil {
+			l.WithError(err).Error("failed to configure s3 blob store")
+			return err
+		}
+		Default = s
+	default:
+		l.WithField("driver", driverName).Error("unsupported blob driver")
+		return fmt.Errorf("unsupported blob driver: %s", driverName)
+	}
+	l.Debug("end")
+	return nil
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"fmt"
 	"os"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"gorm.io/driver/postgres"
@@ -11,7 +12,13 @@ import (
 	"gorm.io/gorm/logger"
 )
 
-var DB *gorm.DB
+var (
+	DB     *gorm.DB
+	Driver string
+	// sqliteMu serializes write transactions on sqlite, which has no
+	// row-level locking
+	sqliteMu sync.Mutex
+)
 
 func initPostgres() error {
 	l := log.WithFields(log.Fields{
@@ -63,6 +70,7 @@ func Init() error {
 	})
 	l.Debug("start")
 	driverName := os.Getenv("DB_DRIVER")
+	Driver = driverName
 	switch driverName {
 	case "postgres":
 		return initPostgres()
@@ -73,3 +81,14 @@ func Init() error {
 		return fmt.Errorf("unsupported database driver: %s", driverName)
 	}
 }
+
+// Transaction runs fn in a database transaction. On sqlite, transactions
+// are serialized within the process so that read-then-write sequences
+// behave as a compare-and-set.
+func Transaction(fn func(tx *gorm.DB) error) error {
+	if Driver == "sqlite" {
+		sqliteMu.Lock()
+		defer sqliteMu.Unlock()
+	}
+	return DB.Transaction(fn)
+}
@@ -9,10 +9,18 @@ var (
 		Name: "monotf_org_status_summary",
 		Help: "Count of workspace statuses by organization",
 	}, []string{"org", "status"})
+	OrgPendingChanges = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "monotf_org_pending_changes",
+		Help: "Count of resource changes pending in the workspaces of the organization by action",
+	}, []string{"org", "action"})
 	WorkspaceStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "monotf_workspace_status",
 		Help: "Workspace status by organization, workspace, and version",
 	}, []string{"org", "workspace", "version", "status"})
+	WorkspaceStatusChangedAt = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "monotf_workspace_status_changed_at",
+		Help: "Time of the latest status transition of workspace",
+	}, []string{"org", "workspace"})
 	WorkspaceLastRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "monotf_workspace_last_run",
 		Help: "Last run time of workspace",
@@ -21,11 +29,33 @@ var (
 		Name: "monotf_workspace_running",
 		Help: "Workspace is running",
 	}, []string{"org", "workspace"})
+	WorkspaceReaders = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "monotf_workspace_readers",
+		Help: "Count of shared lock holders of the workspace",
+	}, []string{"org", "workspace"})
+	WorkspaceLockExpiresAt = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "monotf_workspace_lock_expires_at",
+		Help: "Expiry time of the workspace lock lease, 0 if not locked",
+	}, []string{"org", "workspace"})
+	WorkspaceLockExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "monotf_workspace_lock_expired_total",
+		Help: "Count of workspace locks released after their lease expired",
+	}, []string{"org", "workspace"})
+	WebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "monotf_webhook_deliveries_total",
+		Help: "Count of webhook delivery attempts by result",
+	}, []string{"result"})
 )
 
 func Init() {
 	prometheus.MustRegister(OrgStatusSummary)
+	prometheus.MustRegister(OrgPendingChanges)
 	prometheus.MustRegister(WorkspaceStatus)
+	prometheus.MustRegister(WorkspaceStatusChangedAt)
 	prometheus.MustRegister(WorkspaceLastRun)
 	prometheus.MustRegister(WorkspaceRunning)
+	prometheus.MustRegister(WorkspaceReaders)
+	prometheus.MustRegister(WorkspaceLockExpiresAt)
+	prometheus.MustRegister(WorkspaceLockExpired)
+	prometheus.MustRegister(WebhookDeliveries)
 }
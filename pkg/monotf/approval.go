@@ -0,0 +1,304 @@
+package monotf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ApprovalStatus is the state of the approval of a plan which must be
+// approved before it is applied
+type ApprovalStatus string
+
+const (
+	ApprovalRequested ApprovalStatus = "requested"
+	ApprovalApproved  ApprovalStatus = "approved"
+	ApprovalRejected  ApprovalStatus = "rejected"
+	// ApprovalExpired plans were not approved before their approval timed
+	// out, or before their client released the workspace lock
+	ApprovalExpired ApprovalStatus = "expired"
+)
+
+const (
+	// DefaultApprovalTimeout is how long a plan waits for approval if no
+	// timeout is configured
+	DefaultApprovalTimeout = time.Hour
+	// approvalPollInterval is how often a client waiting for approval
+	// checks the plan run
+	approvalPollInterval = 5 * time.Second
+)
+
+var (
+	// ErrApprovalNotRequested is returned when approving or rejecting a run
+	// which is not awaiting approval
+	ErrApprovalNotRequested = errors.New("run is not awaiting approval")
+	// ErrApprovalExpired is returned when approving or rejecting a run whose
+	// approval has timed out
+	ErrApprovalExpired = errors.New("approval of run has expired")
+	// ErrNotApproved is returned when applying a plan which requires
+	// approval and has not been approved
+	ErrNotApproved = errors.New("plan has not been approved")
+)
+
+// ApprovalConfig marks the workspaces whose plans must be approved before
+// terraform-plan-apply applies them
+type ApprovalConfig struct {
+	// Workspaces are globs of workspace paths relative to the repo,
+	// e.g. prod/* or aws01/us-east-1
+	Workspaces []string `json:"workspaces" yaml:"workspaces"`
+	// Timeout is how long to wait for approval while holding the workspace
+	// lock. Defaults to DefaultApprovalTimeout.
+	Timeout string `json:"timeout" yaml:"timeout"`
+}
+
+// ApprovalRequest is sent by an approver to approve or reject a plan
+type ApprovalRequest struct {
+	// By is the identity of the token which made the request, which the
+	// server records as the approver. It is not read from the request.
+	By string `json:"-"`
+	// Comment is recorded with the decision
+	Comment string `json:"comment"`
+}
+
+// requiresApproval returns true if the plans of the workspace must be
+// approved before they are applied
+func (m *Monotf) requiresApproval(w *Workspace) bool {
+	if m.Approval == nil {
+		return false
+	}
+	rel := w.relPath()
+	for _, p := range m.Approval.Workspaces {
+		if ok, _ := filepath.Match(strings.Trim(p, "/"), rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// approvalTimeout returns how long to wait for approval of a plan
+func (m *Monotf) approvalTimeout() (time.Duration, error) {
+	if m.Approval == nil || m.Approval.Timeout == "" {
+		return DefaultApprovalTimeout, nil
+	}
+	d, err := time.ParseDuration(m.Approval.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid approval timeout %s: %w", m.Approval.Timeout, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid approval timeout %s", m.Approval.Timeout)
+	}
+	return d, nil
+}
+
+// requestApproval marks the run as awaiting approval until timeout from
+// now. Only plans which have been stored can be approved, so that the
+// approved plan is the one applied.
+func (r *Run) requestApproval(timeout time.Duration, now time.Time) error {
+	if r.Command != "plan" || r.Speculative || isDriftCheck(r.Args) {
+		return ErrNotPlan
+	}
+	if r.PlanKey == "" {
+		return ErrNoPlan
+	}
+	if timeout <= 0 {
+		timeout = DefaultApprovalTimeout
+	}
+	expires := now.Add(timeout)
+	r.Approval = ApprovalRequested
+	r.ApprovalExpiresAt = &expires
+	return nil
+}
+
+// checkApproved returns ErrNotApproved if the plan run requires approval
+// and has not been approved
+func (r *Run) checkApproved() error {
+	if r.Approval != "" && r.Approval != ApprovalApproved {
+		return fmt.Errorf("%w, its approval is %s", ErrNotApproved, r.Approval)
+	}
+	return nil
+}
+
+// Decide records the approval or rejection of a run awaiting approval, and
+// who made it. An approved plan is pending until it is applied, and a
+// rejected plan is cancelled along with its workspace. If the approval has
+// timed out, the run is expired instead and ErrApprovalExpired is returned.
+func (r *Run) Decide(status ApprovalStatus, req ApprovalRequest) error {
+	l := log.WithFields(log.Fields{
+		"pkg":      "ws",
+		"fn":       "Run.Decide",
+		"org":      r.Org,
+		"ws":       r.Name,
+		"run":      r.ID,
+		"approval": status,
+		"by":       req.By,
+	})
+	l.Debug("start")
+	if status != ApprovalApproved && status != ApprovalRejected {
+		return fmt.Errorf("invalid approval %s", status)
+	}
+	if req.By == "" {
+		return fmt.Errorf("the approver is required")
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		w, err := getWorkspaceForUpdate(tx, r.Org, r.Name)
+		hasWorkspace := err == nil
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("org = ? AND name = ?", r.Org, r.Name).
+			First(r, r.ID).Error; err != nil {
+			return err
+		}
+		if r.Approval != ApprovalRequested {
+			return ErrApprovalNotRequested
+		}
+		now := time.Now()
+		if r.ApprovalExpiresAt != nil && now.After(*r.ApprovalExpiresAt) {
+			status = ApprovalExpired
+		}
+		r.Approval = status
+		r.ApprovalAt = &now
+		if status != ApprovalExpired {
+			r.ApprovalBy = req.By
+			r.ApprovalComment = req.Comment
+		}
+		r.Status = WorkspaceStatusCancelled
+		if status == ApprovalApproved {
+			r.Status = WorkspaceStatusPending
+		}
+		if err := tx.Model(r).Updates(map[string]interface{}{
+			"status":           r.Status,
+			"approval":         r.Approval,
+			"approval_at":      r.ApprovalAt,
+			"approval_by":      r.ApprovalBy,
+			"approval_comment": r.ApprovalComment,
+		}).Error; err != nil {
+			return err
+		}
+		if status == ApprovalApproved || !hasWorkspace || !w.awaitingApprovalOf(r.ID) {
+			return nil
+		}
+		return w.transition(tx, WorkspaceStatusCancelled, &r.ID)
+	})
+	if err != nil {
+		l.WithError(err).Error("failed to decide approval")
+		return err
+	}
+	notify(runLogKey(r.ID))
+	if r.Approval == ApprovalExpired {
+		return ErrApprovalExpired
+	}
+	l.Debug("end")
+	return nil
+}
+
+// awaitingApprovalOf returns true if the workspace is awaiting approval of
+// the plan of the run
+func (w *Workspace) awaitingApprovalOf(runId uint) bool {
+	return w.Status == WorkspaceStatusAwaitingApproval && w.LatestRunId != nil && *w.LatestRunId == runId
+}
+
+// expireApprovals expires the approvals requested by the runs of lockId
+// when the lock is closed, as their client will no longer apply them, and
+// cancels the runs. A workspace left awaiting approval by the runs, whether
+// or not they were approved, takes the status of runs abandoned with the
+// lock.
+func expireApprovals(tx *gorm.DB, lockId string, lockStatus LockTicketStatus, now time.Time) error {
+	var runs []Run
+	if err := tx.Where("lock_id = ? AND approval IN ?", lockId,
+		[]ApprovalStatus{ApprovalRequested, ApprovalApproved}).Find(&runs).Error; err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	if err := tx.Model(&Run{}).
+		Where("lock_id = ? AND approval = ?", lockId, ApprovalRequested).
+		Updates(map[string]interface{}{
+			"status":      WorkspaceStatusCancelled,
+			"approval":    ApprovalExpired,
+			"approval_at": now,
+		}).Error; err != nil {
+		return err
+	}
+	for _, r := range runs {
+		w, err := getWorkspaceForUpdate(tx, r.Org, r.Name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !w.awaitingApprovalOf(r.ID) {
+			continue
+		}
+		if err := w.transition(tx, abandonedStatus(lockStatus), &r.ID); err != nil {
+			return err
+		}
+		notify(runLogKey(r.ID))
+	}
+	return nil
+}
+
+func handleDecideRun(w http.ResponseWriter, r *http.Request, status ApprovalStatus) {
+	l := log.WithFields(log.Fields{
+		"pkg":      "ws",
+		"fn":       "handleDecideRun",
+		"approval": status,
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to approve runs")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	run, err := runFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	var req ApprovalRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req.By = requestActor(r)
+	if err := run.Decide(status, req); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrApprovalNotRequested), errors.Is(err, ErrApprovalExpired):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(run); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleApproveRun(w http.ResponseWriter, r *http.Request) {
+	handleDecideRun(w, r, ApprovalApproved)
+}
+
+func HandleRejectRun(w http.ResponseWriter, r *http.Request) {
+	handleDecideRun(w, r, ApprovalRejected)
+}
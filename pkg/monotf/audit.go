@@ -0,0 +1,549 @@
+package monotf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// DefaultAuditListLimit is the number of audit entries returned if no
+	// limit is given
+	DefaultAuditListLimit = 100
+)
+
+var (
+	// auditSkipped are the endpoints which are called many times during
+	// each run, and which are not audited
+	auditSkipped = map[string]bool{
+		"/ws/{org}/{name}/lock/heartbeat": true,
+		"/ws/{org}/{name}/runs/{id}/logs": true,
+	}
+)
+
+// AuditEntry records a call to an endpoint which changes state. Entries
+// are chained by hash, so that changing or removing an entry breaks the
+// chain from that entry on.
+type AuditEntry struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+	// Actor identifies the token the request presented
+	Actor    string `json:"actor" gorm:"index"`
+	SourceIP string `json:"source_ip"`
+	// ForwardedFor is the X-Forwarded-For header of the request, which is
+	// set by proxies but may also be set by the client
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+	Method       string `json:"method"`
+	// Endpoint is the route of the request, e.g. /ws/{org}/{name}/lock,
+	// and Path the path which was requested
+	Endpoint   string `json:"endpoint" gorm:"index"`
+	Path       string `json:"path"`
+	StatusCode int    `json:"status_code"`
+	// Org and Name are the workspace changed by the request, if any. A
+	// request which changes several workspaces has an entry for each.
+	Org          string          `json:"org,omitempty" gorm:"index:idx_audit_org_name"`
+	Name         string          `json:"name,omitempty" gorm:"index:idx_audit_org_name"`
+	StatusBefore WorkspaceStatus `json:"status_before,omitempty"`
+	StatusAfter  WorkspaceStatus `json:"status_after,omitempty"`
+	LockBefore   *string         `json:"lock_before,omitempty"`
+	LockAfter    *string         `json:"lock_after,omitempty"`
+	// PrevHash is the hash of the previous entry, and Hash the hash of
+	// this entry including PrevHash
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash" gorm:"uniqueIndex"`
+}
+
+// AuditChainHead holds the hash of the latest audit entry. Its row is
+// locked while an entry is appended, so that entries form a single chain
+// across servers, and it shows if entries were removed from the end.
+type AuditChainHead struct {
+	ID   uint   `json:"id" gorm:"primarykey"`
+	Hash string `json:"hash"`
+}
+
+// AuditFilter selects audit entries. Empty fields match all entries.
+type AuditFilter struct {
+	Org      string
+	Name     string
+	Actor    string
+	Endpoint string
+	Method   string
+	Since    *time.Time
+	Until    *time.Time
+}
+
+// AuditVerification is the result of checking the audit chain
+type AuditVerification struct {
+	Valid   bool  `json:"valid"`
+	Entries int64 `json:"entries"`
+	// BrokenAt is the id of the first entry which does not match the
+	// chain, if any
+	BrokenAt *uint  `json:"broken_at,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// workspaceRef is a workspace changed by a request
+type workspaceRef struct {
+	Org  string
+	Name string
+}
+
+// digest returns the hash of the entry, which covers every field but the
+// id and the hash itself
+func (e *AuditEntry) digest() string {
+	fields := struct {
+		CreatedAt    string          `json:"created_at"`
+		Actor        string          `json:"actor"`
+		SourceIP     string          `json:"source_ip"`
+		ForwardedFor string          `json:"forwarded_for"`
+		Method       string          `json:"method"`
+		Endpoint     string          `json:"endpoint"`
+		Path         string          `json:"path"`
+		StatusCode   int             `json:"status_code"`
+		Org          string          `json:"org"`
+		Name         string          `json:"name"`
+		StatusBefore WorkspaceStatus `json:"status_before"`
+		StatusAfter  WorkspaceStatus `json:"status_after"`
+		LockBefore   *string         `json:"lock_before"`
+		LockAfter    *string         `json:"lock_after"`
+		PrevHash     string          `json:"prev_hash"`
+	}{
+		CreatedAt:    e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		Actor:        e.Actor,
+		SourceIP:     e.SourceIP,
+		ForwardedFor: e.ForwardedFor,
+		Method:       e.Method,
+		Endpoint:     e.Endpoint,
+		Path:         e.Path,
+		StatusCode:   e.StatusCode,
+		Org:          e.Org,
+		Name:         e.Name,
+		StatusBefore: e.StatusBefore,
+		StatusAfter:  e.StatusAfter,
+		LockBefore:   e.LockBefore,
+		LockAfter:    e.LockAfter,
+		PrevHash:     e.PrevHash,
+	}
+	bd, _ := json.Marshal(fields)
+	sum := sha256.Sum256(bd)
+	return hex.EncodeToString(sum[:])
+}
+
+// initAuditChain creates the head of the audit chain if it does not exist
+func initAuditChain() error {
+	return db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&AuditChainHead{ID: 1}).Error
+}
+
+// appendAudit adds the entries to the end of the audit chain
+func appendAudit(entries []AuditEntry) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var head AuditChainHead
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&head, 1).Error; err != nil {
+			return err
+		}
+		// times are stored with millisecond precision by some databases,
+		// so they are truncated before they are hashed
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		for i := range entries {
+			e := &entries[i]
+			e.ID = 0
+			e.CreatedAt = now
+			e.PrevHash = head.Hash
+			e.Hash = e.digest()
+			if err := tx.Create(e).Error; err != nil {
+				return err
+			}
+			head.Hash = e.Hash
+		}
+		return tx.Model(&head).Update("hash", head.Hash).Error
+	})
+}
+
+// requestActor identifies the token presented by the request
+func requestActor(r *http.Request) string {
+	if t := requestToken(r); t != nil {
+		return "token:" + t.Name
+	}
+	switch {
+	case hasAdminToken(r):
+		return "admin-token"
+	case os.Getenv("MONOTF_TOKEN") != "":
+		return "token"
+	}
+	return "anonymous"
+}
+
+// sourceIP returns the address the request was received from
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestWorkspaces returns the workspaces the request is for, from the
+// route or, for the endpoints which take them in the body, the request
+// body, which is restored for the handler
+func requestWorkspaces(r *http.Request, endpoint string) []workspaceRef {
+	vars := mux.Vars(r)
+	if vars["org"] != "" && vars["name"] != "" {
+		return []workspaceRef{{Org: vars["org"], Name: vars["name"]}}
+	}
+	switch endpoint {
+	case "/ws", "/locks", "/locks/release":
+	default:
+		return nil
+	}
+	// the handlers of these endpoints read the whole body anyway
+	bd, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(bd))
+	if err != nil {
+		return nil
+	}
+	if endpoint == "/ws" {
+		var w workspaceRef
+		if err := json.Unmarshal(bd, &w); err != nil || w.Org == "" || w.Name == "" {
+			return nil
+		}
+		return []workspaceRef{w}
+	}
+	var req LockSetRequest
+	if err := json.Unmarshal(bd, &req); err != nil {
+		return nil
+	}
+	var refs []workspaceRef
+	for _, m := range req.Locks {
+		refs = append(refs, workspaceRef{Org: m.Org, Name: m.Name})
+	}
+	return refs
+}
+
+// workspaceState returns the status and lock of the workspace, or nothing
+// if it does not exist
+func workspaceState(ref workspaceRef) (WorkspaceStatus, *string) {
+	var w Workspace
+	if err := db.DB.Select("status", "lock_id").
+		Where("org = ? AND name = ?", ref.Org, ref.Name).
+		First(&w).Error; err != nil {
+		return "", nil
+	}
+	return w.Status, w.LockId
+}
+
+// auditResponseWriter records the status code of the response
+type auditResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// auditMiddleware records each request which may change state, with the
+// status and lock of the workspaces it changes before and after it
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		endpoint := routeTemplate(r)
+		if auditSkipped[endpoint] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		l := log.WithFields(log.Fields{
+			"pkg":      "ws",
+			"fn":       "auditMiddleware",
+			"endpoint": endpoint,
+		})
+		refs := requestWorkspaces(r, endpoint)
+		entry := AuditEntry{
+			Actor:        requestActor(r),
+			SourceIP:     sourceIP(r),
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Method:       r.Method,
+			Endpoint:     endpoint,
+			Path:         r.URL.Path,
+		}
+		var entries []AuditEntry
+		for _, ref := range refs {
+			e := entry
+			e.Org, e.Name = ref.Org, ref.Name
+			e.StatusBefore, e.LockBefore = workspaceState(ref)
+			entries = append(entries, e)
+		}
+		if len(entries) == 0 {
+			entries = append(entries, entry)
+		}
+		aw := &auditResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(aw, r)
+		for i := range entries {
+			entries[i].StatusCode = aw.code
+			if entries[i].Name != "" {
+				entries[i].StatusAfter, entries[i].LockAfter = workspaceState(workspaceRef{
+					Org:  entries[i].Org,
+					Name: entries[i].Name,
+				})
+			}
+		}
+		if err := appendAudit(entries); err != nil {
+			l.WithError(err).Error("failed to record audit entry")
+		}
+	})
+}
+
+// query returns the entries selected by the filter
+func (f AuditFilter) query() *gorm.DB {
+	q := db.DB.Model(&AuditEntry{})
+	if f.Org != "" {
+		q = q.Where("org = ?", f.Org)
+	}
+	if f.Name != "" {
+		q = q.Where("name = ?", f.Name)
+	}
+	if f.Actor != "" {
+		q = q.Where("actor = ?", f.Actor)
+	}
+	if f.Endpoint != "" {
+		q = q.Where("endpoint = ?", f.Endpoint)
+	}
+	if f.Method != "" {
+		q = q.Where("method = ?", f.Method)
+	}
+	if f.Since != nil {
+		q = q.Where("created_at >= ?", *f.Since)
+	}
+	if f.Until != nil {
+		q = q.Where("created_at < ?", *f.Until)
+	}
+	return q
+}
+
+// ListAuditEntries returns the entries selected by the filter, newest first
+func ListAuditEntries(f AuditFilter, limit int) ([]AuditEntry, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ListAuditEntries",
+	})
+	l.Debug("start")
+	if limit <= 0 {
+		limit = DefaultAuditListLimit
+	}
+	var entries []AuditEntry
+	if err := f.query().Order("id desc").Limit(limit).Find(&entries).Error; err != nil {
+		l.WithError(err).Error("failed to list audit entries")
+		return nil, err
+	}
+	l.Debug("end")
+	return entries, nil
+}
+
+// ExportAuditEntries writes the entries selected by the filter to out as
+// json lines, oldest first
+func ExportAuditEntries(f AuditFilter, out io.Writer) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ExportAuditEntries",
+	})
+	l.Debug("start")
+	enc := json.NewEncoder(out)
+	var batch []AuditEntry
+	err := f.query().Order("id").FindInBatches(&batch, 500, func(tx *gorm.DB, n int) error {
+		for _, e := range batch {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		l.WithError(err).Error("failed to export audit entries")
+		return err
+	}
+	l.Debug("end")
+	return nil
+}
+
+// VerifyAuditChain checks that each entry hashes to its hash and follows
+// the entry before it, and that the chain ends at its head
+func VerifyAuditChain() (*AuditVerification, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "VerifyAuditChain",
+	})
+	l.Debug("start")
+	var head AuditChainHead
+	if err := db.DB.First(&head, 1).Error; err != nil {
+		return nil, err
+	}
+	v := &AuditVerification{Valid: true}
+	prev := ""
+	var batch []AuditEntry
+	err := db.DB.Order("id").FindInBatches(&batch, 500, func(tx *gorm.DB, n int) error {
+		for i := range batch {
+			if !v.Valid {
+				return nil
+			}
+			e := &batch[i]
+			v.Entries++
+			switch {
+			case e.PrevHash != prev:
+				v.Message = fmt.Sprintf("entry %d does not follow the entry before it", e.ID)
+			case e.digest() != e.Hash:
+				v.Message = fmt.Sprintf("entry %d does not match its hash", e.ID)
+			default:
+				prev = e.Hash
+				continue
+			}
+			id := e.ID
+			v.Valid = false
+			v.BrokenAt = &id
+		}
+		return nil
+	}).Error
+	if err != nil {
+		l.WithError(err).Error("failed to verify audit chain")
+		return nil, err
+	}
+	if v.Valid && prev != head.Hash {
+		v.Valid = false
+		v.Message = "the chain does not end at its head, entries were removed from the end"
+	}
+	l.WithField("valid", v.Valid).Debug("end")
+	return v, nil
+}
+
+// auditFilterFromRequest reads the filter from the query parameters org,
+// name, actor, endpoint, method, since, and until
+func auditFilterFromRequest(r *http.Request) (AuditFilter, error) {
+	f := AuditFilter{
+		Org:      r.FormValue("org"),
+		Name:     r.FormValue("name"),
+		Actor:    r.FormValue("actor"),
+		Endpoint: r.FormValue("endpoint"),
+		Method:   r.FormValue("method"),
+	}
+	for k, t := range map[string]**time.Time{"since": &f.Since, "until": &f.Until} {
+		v := r.FormValue(k)
+		if v == "" {
+			continue
+		}
+		tm, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("invalid %s %s, must be RFC3339", k, v)
+		}
+		*t = &tm
+	}
+	return f, nil
+}
+
+func HandleListAuditEntries(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleListAuditEntries",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to read the audit log")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f, err := auditFilterFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	var limit int
+	if v := r.FormValue("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid limit %s", v)
+			return
+		}
+	}
+	entries, err := ListAuditEntries(f, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleExportAuditEntries(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleExportAuditEntries",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to read the audit log")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f, err := auditFilterFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := ExportAuditEntries(f, w); err != nil {
+		// the entries written so far have been sent, so the export is cut
+		// short rather than replaced with an error
+		l.WithError(err).Error("failed to export audit entries")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleVerifyAuditChain(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleVerifyAuditChain",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to read the audit log")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	v, err := VerifyAuditChain()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
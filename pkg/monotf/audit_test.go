@@ -0,0 +1,100 @@
+package monotf
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/robertlestak/monotf/internal/db"
+)
+
+func TestVerifyAuditChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T)
+		valid  bool
+		broken uint
+	}{
+		{
+			name:   "untouched",
+			tamper: func(t *testing.T) {},
+			valid:  true,
+		},
+		{
+			name: "entry changed",
+			tamper: func(t *testing.T) {
+				if err := db.DB.Model(&AuditEntry{}).Where("id = ?", 3).Update("actor", "token:someone-else").Error; err != nil {
+					t.Fatal(err)
+				}
+			},
+			broken: 3,
+		},
+		{
+			name: "entry changed and rehashed",
+			tamper: func(t *testing.T) {
+				var e AuditEntry
+				if err := db.DB.First(&e, 3).Error; err != nil {
+					t.Fatal(err)
+				}
+				e.StatusCode = 200
+				e.Hash = e.digest()
+				if err := db.DB.Save(&e).Error; err != nil {
+					t.Fatal(err)
+				}
+			},
+			broken: 4,
+		},
+		{
+			name: "entry removed",
+			tamper: func(t *testing.T) {
+				if err := db.DB.Delete(&AuditEntry{}, 3).Error; err != nil {
+					t.Fatal(err)
+				}
+			},
+			broken: 4,
+		},
+		{
+			name: "last entry removed",
+			tamper: func(t *testing.T) {
+				if err := db.DB.Delete(&AuditEntry{}, 5).Error; err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initTestDB(t)
+			if err := initAuditChain(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 5; i++ {
+				e := AuditEntry{
+					Actor:      "token:deploy",
+					Method:     "POST",
+					Endpoint:   "/ws/{org}/{name}/lock",
+					Path:       fmt.Sprintf("/ws/org/ws-%d/lock", i),
+					StatusCode: 409,
+					Org:        "org",
+					Name:       fmt.Sprintf("ws-%d", i),
+				}
+				if err := appendAudit([]AuditEntry{e}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tt.tamper(t)
+			v, err := VerifyAuditChain()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Valid != tt.valid {
+				t.Fatalf("valid = %v, want %v: %s", v.Valid, tt.valid, v.Message)
+			}
+			switch {
+			case tt.broken == 0 && v.BrokenAt != nil:
+				t.Errorf("broken at %d, want none", *v.BrokenAt)
+			case tt.broken != 0 && (v.BrokenAt == nil || *v.BrokenAt != tt.broken):
+				t.Errorf("broken at %v, want %d", v.BrokenAt, tt.broken)
+			}
+		})
+	}
+}
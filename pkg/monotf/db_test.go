@@ -0,0 +1,31 @@
+package monotf
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/robertlestak/monotf/internal/blob"
+	"github.com/robertlestak/monotf/internal/db"
+	"gorm.io/gorm/logger"
+)
+
+// initTestDB points the database and the blob store at a sqlite database
+// and a directory which are removed after the test, and migrates them
+func initTestDB(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("DB_DRIVER", "sqlite")
+	t.Setenv("DB_PATH", filepath.Join(dir, "monotf.db"))
+	t.Setenv("BLOB_DRIVER", "local")
+	t.Setenv("BLOB_PATH", filepath.Join(dir, "blobs"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	db.DB.Logger = logger.Default.LogMode(logger.Silent)
+	if err := blob.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+}
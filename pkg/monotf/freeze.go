@@ -0,0 +1,558 @@
+package monotf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrFrozen is returned when an exclusive lock is requested for a
+	// workspace during one of its change freezes
+	ErrFrozen = errors.New("workspace is frozen")
+)
+
+// Freeze blocks exclusive locks, and so applies and other runs which may
+// change state, in the workspaces in its scope while it is active. Shared
+// locks, such as those of speculative plans and drift checks, are not
+// blocked. A freeze is either a one-off window from StartsAt to EndsAt, or
+// a recurring window which opens at each time matched by Schedule and
+// lasts for Duration.
+type Freeze struct {
+	gorm.Model
+	// Org limits the freeze to an org. If empty, the freeze applies to
+	// all orgs.
+	Org string `json:"org" gorm:"index"`
+	// Workspaces are globs of workspace paths relative to the repo,
+	// e.g. prod/*. If empty, the freeze applies to all workspaces in its
+	// org. Workspaces whose clients do not send their path are matched
+	// by name instead.
+	Workspaces []string `json:"workspaces" gorm:"serializer:json"`
+	Reason     string   `json:"reason"`
+	// StartsAt and EndsAt bound a one-off freeze. StartsAt defaults to when
+	// the freeze is created, and a freeze without EndsAt lasts until it is
+	// deleted.
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at"`
+	// Schedule is a cron expression of the times a recurring freeze
+	// starts, e.g. "0 18 * * 5" for every Friday at 18:00, in Timezone,
+	// which defaults to UTC. Each freeze lasts for Duration, e.g. "64h".
+	Schedule string `json:"schedule"`
+	Duration string `json:"duration"`
+	Timezone string `json:"timezone"`
+	// BreakGlassRole is the role allowed to take a lock during the freeze
+	// with a break-glass reason. If empty, the freeze cannot be broken.
+	BreakGlassRole string `json:"break_glass_role"`
+	CreatedBy      string `json:"created_by"`
+	// Active and Until are set when the freeze is listed, and describe the
+	// window it is in, if any
+	Active bool       `json:"active" gorm:"-"`
+	Until  *time.Time `json:"until,omitempty" gorm:"-"`
+}
+
+// String describes the freeze, e.g. "freeze 3 (holidays)"
+func (f *Freeze) String() string {
+	s := fmt.Sprintf("freeze %d", f.ID)
+	if f.Reason != "" {
+		s += " (" + f.Reason + ")"
+	}
+	return s
+}
+
+// Validate checks the freeze has a reason and exactly one valid window
+func (f *Freeze) Validate() error {
+	if f.Reason == "" {
+		return fmt.Errorf("a reason is required")
+	}
+	for _, g := range f.Workspaces {
+		if _, err := path.Match(strings.Trim(g, "/"), ""); err != nil {
+			return fmt.Errorf("invalid workspace glob %s", g)
+		}
+	}
+	if f.Schedule == "" {
+		if f.Duration != "" || f.Timezone != "" {
+			return fmt.Errorf("duration and timezone require a schedule")
+		}
+		if f.StartsAt != nil && f.EndsAt != nil && !f.EndsAt.After(*f.StartsAt) {
+			return fmt.Errorf("ends_at must be after starts_at")
+		}
+		return nil
+	}
+	if f.StartsAt != nil || f.EndsAt != nil {
+		return fmt.Errorf("a freeze has either a schedule or starts_at and ends_at, not both")
+	}
+	if _, err := parseCronSchedule(f.Schedule); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(f.Duration)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("a schedule requires a positive duration, e.g. 24h")
+	}
+	if _, err := time.LoadLocation(f.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %s", f.Timezone)
+	}
+	return nil
+}
+
+// window returns when the freeze window in effect at now ends, and
+// whether there is one. The end is nil for a one-off freeze without one.
+func (f *Freeze) window(now time.Time) (*time.Time, bool) {
+	if f.Schedule == "" {
+		if f.StartsAt != nil && now.Before(*f.StartsAt) {
+			return nil, false
+		}
+		if f.EndsAt != nil && !now.Before(*f.EndsAt) {
+			return nil, false
+		}
+		return f.EndsAt, true
+	}
+	s, err := parseCronSchedule(f.Schedule)
+	if err != nil {
+		return nil, false
+	}
+	d, err := time.ParseDuration(f.Duration)
+	if err != nil || d <= 0 {
+		return nil, false
+	}
+	loc, err := time.LoadLocation(f.Timezone)
+	if err != nil {
+		return nil, false
+	}
+	start, ok := s.prev(now.In(loc), d)
+	if !ok {
+		return nil, false
+	}
+	end := start.Add(d)
+	return &end, true
+}
+
+// covers returns true if the freeze applies to the workspace, whose path
+// relative to the repo is rel if known
+func (f *Freeze) covers(org, name, rel string) bool {
+	if f.Org != "" && f.Org != org {
+		return false
+	}
+	if len(f.Workspaces) == 0 {
+		return true
+	}
+	if rel == "" {
+		rel = name
+	}
+	for _, g := range f.Workspaces {
+		if ok, _ := path.Match(strings.Trim(g, "/"), rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// canBreak returns true if the lock request may be granted during the
+// freeze, which requires a break-glass reason and the break-glass role
+func (f *Freeze) canBreak(req LockRequest) bool {
+	if f.BreakGlassRole == "" || req.BreakGlass == "" {
+		return false
+	}
+	return rolesInclude(req.roles, f.BreakGlassRole)
+}
+
+// checkFreezes returns an error wrapping ErrFrozen if req is for an
+// exclusive lock of the workspace during an active freeze which it cannot
+// break. Breaking a freeze is logged.
+func checkFreezes(tx *gorm.DB, org, name string, req LockRequest, now time.Time) error {
+	if req.lockMode() == LockModeShared {
+		return nil
+	}
+	var freezes []Freeze
+	if err := tx.Where("org = ? OR org = ?", org, "").Order("id").Find(&freezes).Error; err != nil {
+		return err
+	}
+	for i := range freezes {
+		f := &freezes[i]
+		if !f.covers(org, name, req.Path) {
+			continue
+		}
+		until, active := f.window(now)
+		if !active {
+			continue
+		}
+		if f.canBreak(req) {
+			log.WithFields(log.Fields{
+				"pkg":    "ws",
+				"fn":     "checkFreezes",
+				"org":    org,
+				"ws":     name,
+				"lock":   req.LockId,
+				"freeze": f.ID,
+				"owner":  req.Owner.String(),
+			}).Warnf("%s broken: %s", f, req.BreakGlass)
+			continue
+		}
+		msg := fmt.Sprintf("%s/%s by %s", org, name, f)
+		if until != nil {
+			msg += " until " + until.UTC().Format(time.RFC3339)
+		}
+		if f.BreakGlassRole != "" {
+			msg += fmt.Sprintf(", break glass requires the %s role", f.BreakGlassRole)
+		}
+		return fmt.Errorf("%w: %s", ErrFrozen, msg)
+	}
+	return nil
+}
+
+// abandonWaitingTicket gives up the place in the queue of a request which
+// was refused, so that it does not hold up the requests behind it
+func abandonWaitingTicket(tx *gorm.DB, lockId string, now time.Time) error {
+	return tx.Model(&LockTicket{}).
+		Where("lock_id = ? AND status = ?", lockId, LockTicketWaiting).
+		Updates(map[string]interface{}{
+			"status":      LockTicketAbandoned,
+			"released_at": now,
+		}).Error
+}
+
+// ListFreezes returns all freezes, marking those which are active at now.
+// If active is set, only active freezes are returned.
+func ListFreezes(active bool) ([]Freeze, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ListFreezes",
+	})
+	l.Debug("start")
+	var freezes []Freeze
+	if err := db.DB.Order("id").Find(&freezes).Error; err != nil {
+		l.WithError(err).Error("failed to list freezes")
+		return nil, err
+	}
+	now := time.Now()
+	var res []Freeze
+	for _, f := range freezes {
+		f.Until, f.Active = f.window(now)
+		if active && !f.Active {
+			continue
+		}
+		res = append(res, f)
+	}
+	l.Debug("end")
+	return res, nil
+}
+
+// GetFreeze returns the freeze with the given id
+func GetFreeze(id string) (*Freeze, error) {
+	f := &Freeze{}
+	if err := db.DB.Where("id = ?", id).First(f).Error; err != nil {
+		return nil, err
+	}
+	f.Until, f.Active = f.window(time.Now())
+	return f, nil
+}
+
+// Save creates the freeze, or updates it if it has an id
+func (f *Freeze) Save() error {
+	l := log.WithFields(log.Fields{
+		"pkg":    "ws",
+		"fn":     "Freeze.Save",
+		"org":    f.Org,
+		"freeze": f.ID,
+	})
+	l.Debug("start")
+	if f.Schedule == "" && f.StartsAt == nil {
+		now := time.Now()
+		f.StartsAt = &now
+	}
+	if err := f.Validate(); err != nil {
+		l.WithError(err).Error("invalid freeze")
+		return err
+	}
+	var err error
+	if f.ID == 0 {
+		err = db.DB.Create(f).Error
+	} else {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var ef Freeze
+			if err := tx.First(&ef, f.ID).Error; err != nil {
+				return err
+			}
+			f.CreatedAt = ef.CreatedAt
+			if f.CreatedBy == "" {
+				f.CreatedBy = ef.CreatedBy
+			}
+			return tx.Save(f).Error
+		})
+	}
+	if err != nil {
+		l.WithError(err).Error("failed to save freeze")
+		return err
+	}
+	f.Until, f.Active = f.window(time.Now())
+	l.WithField("reason", f.Reason).Info("freeze saved")
+	l.Debug("end")
+	return nil
+}
+
+// DeleteFreeze removes the freeze with the given id
+func DeleteFreeze(id string) error {
+	l := log.WithFields(log.Fields{
+		"pkg":    "ws",
+		"fn":     "DeleteFreeze",
+		"freeze": id,
+	})
+	l.Debug("start")
+	res := db.DB.Unscoped().Where("id = ?", id).Delete(&Freeze{})
+	if res.Error != nil {
+		l.WithError(res.Error).Error("failed to delete freeze")
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	l.Info("freeze deleted")
+	l.Debug("end")
+	return nil
+}
+
+func HandleListFreezes(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleListFreezes",
+	})
+	l.Debug("start")
+	freezes, err := ListFreezes(r.FormValue("active") == "true")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(freezes); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleGetFreeze(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleGetFreeze",
+	})
+	l.Debug("start")
+	f, err := GetFreeze(mux.Vars(r)["id"])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(f); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleSaveFreeze(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleSaveFreeze",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to manage freezes")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var f Freeze
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.ID = 0
+	if v, ok := mux.Vars(r)["id"]; ok {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid freeze id %s", v)
+			return
+		}
+		f.ID = uint(id)
+	}
+	if err := f.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if err := f.Save(); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(f); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleDeleteFreeze(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleDeleteFreeze",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to manage freezes")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := DeleteFreeze(mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	l.Debug("end")
+}
+
+// cronSchedule is a parsed five field cron expression: minute, hour, day
+// of month, month, and day of week
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// anyDay and anyWeekday are set when the day of month or day of week
+	// is *. As in cron, if both are restricted either may match.
+	anyDay, anyWeekday bool
+}
+
+// parseCronField parses a comma separated list of *, values, ranges, and
+// steps, e.g. "*/15" or "1-5,0", into a bitmask of the values in min..max
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %s", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %s", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %s", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// parseCronSchedule parses a cron expression such as "0 18 * * 5". Day of
+// week is 0-7, where both 0 and 7 are Sunday.
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %s, expected 5 fields", expr)
+	}
+	s := &cronSchedule{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	ranges := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&s.minutes, 0, 59},
+		{&s.hours, 0, 23},
+		{&s.days, 1, 31},
+		{&s.months, 1, 12},
+		{&s.weekdays, 0, 7},
+	}
+	for i, r := range ranges {
+		var err error
+		if *r.bits, err = parseCronField(fields[i], r.min, r.max); err != nil {
+			return nil, fmt.Errorf("invalid schedule %s: %w", expr, err)
+		}
+	}
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+	return s, nil
+}
+
+// matchesDay returns true if the schedule runs on the day of t
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	if s.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+// prev returns the latest time the schedule ran at or before t and within
+// d of it, and whether there is one
+func (s *cronSchedule) prev(t time.Time, d time.Duration) (time.Time, bool) {
+	earliest := t.Add(-d)
+	loc := t.Location()
+	for c := t.Truncate(time.Minute); c.After(earliest); {
+		y, m, day := c.Date()
+		switch {
+		case !s.matchesDay(c):
+			c = time.Date(y, m, day, 0, 0, 0, 0, loc).Add(-time.Minute)
+		case s.hours&(1<<uint(c.Hour())) == 0:
+			c = time.Date(y, m, day, c.Hour(), 0, 0, 0, loc).Add(-time.Minute)
+		case s.minutes&(1<<uint(c.Minute())) != 0:
+			return c, true
+		default:
+			c = c.Add(-time.Minute)
+		}
+	}
+	return time.Time{}, false
+}
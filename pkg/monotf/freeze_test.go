@@ -0,0 +1,83 @@
+package monotf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFreezeWindow(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	starts := at("2026-10-01T00:00:00Z")
+	ends := at("2026-10-08T00:00:00Z")
+	tests := []struct {
+		name   string
+		freeze Freeze
+		now    string
+		active bool
+		until  string
+	}{
+		// 2026-10-16 is a Friday
+		{"weekend before it starts", Freeze{Schedule: "0 18 * * 5", Duration: "62h"}, "2026-10-16T17:59:00Z", false, ""},
+		{"weekend as it starts", Freeze{Schedule: "0 18 * * 5", Duration: "62h"}, "2026-10-16T18:00:00Z", true, "2026-10-19T08:00:00Z"},
+		{"weekend on sunday", Freeze{Schedule: "0 18 * * 5", Duration: "62h"}, "2026-10-18T12:00:00Z", true, "2026-10-19T08:00:00Z"},
+		{"weekend as it ends", Freeze{Schedule: "0 18 * * 5", Duration: "62h"}, "2026-10-19T08:00:00Z", false, ""},
+		{"nightly before midnight", Freeze{Schedule: "0 22 * * *", Duration: "8h"}, "2026-10-16T23:30:00Z", true, "2026-10-17T06:00:00Z"},
+		{"nightly after midnight", Freeze{Schedule: "0 22 * * *", Duration: "8h"}, "2026-10-17T03:00:00Z", true, "2026-10-17T06:00:00Z"},
+		{"nightly in the day", Freeze{Schedule: "0 22 * * *", Duration: "8h"}, "2026-10-17T12:00:00Z", false, ""},
+		{"weeknights after friday midnight", Freeze{Schedule: "0 22 * * 1-5", Duration: "8h"}, "2026-10-17T03:00:00Z", true, "2026-10-17T06:00:00Z"},
+		{"weeknights after saturday midnight", Freeze{Schedule: "0 22 * * 1-5", Duration: "8h"}, "2026-10-18T03:00:00Z", false, ""},
+		{"sunday as 7", Freeze{Schedule: "0 0 * * 7", Duration: "24h"}, "2026-10-18T12:00:00Z", true, "2026-10-19T00:00:00Z"},
+		{"sunday as 7 on saturday", Freeze{Schedule: "0 0 * * 7", Duration: "24h"}, "2026-10-17T12:00:00Z", false, ""},
+		{"day of month or week on monday", Freeze{Schedule: "0 0 1 * 1", Duration: "1h"}, "2026-10-19T00:30:00Z", true, "2026-10-19T01:00:00Z"},
+		{"day of month or week on the 1st", Freeze{Schedule: "0 0 1 * 1", Duration: "1h"}, "2026-11-01T00:30:00Z", true, "2026-11-01T01:00:00Z"},
+		{"day of month or week on neither", Freeze{Schedule: "0 0 1 * 1", Duration: "1h"}, "2026-10-20T00:30:00Z", false, ""},
+		{"timezone before it starts", Freeze{Schedule: "0 18 * * 5", Duration: "62h", Timezone: "America/New_York"}, "2026-10-16T21:30:00Z", false, ""},
+		{"timezone after it starts", Freeze{Schedule: "0 18 * * 5", Duration: "62h", Timezone: "America/New_York"}, "2026-10-16T22:30:00Z", true, "2026-10-19T12:00:00Z"},
+		{"one-off before", Freeze{StartsAt: &starts, EndsAt: &ends}, "2026-09-30T23:59:00Z", false, ""},
+		{"one-off during", Freeze{StartsAt: &starts, EndsAt: &ends}, "2026-10-01T00:00:00Z", true, "2026-10-08T00:00:00Z"},
+		{"one-off after", Freeze{StartsAt: &starts, EndsAt: &ends}, "2026-10-08T00:00:00Z", false, ""},
+		{"one-off without end", Freeze{StartsAt: &starts}, "2027-01-01T00:00:00Z", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until, active := tt.freeze.window(at(tt.now))
+			if active != tt.active {
+				t.Fatalf("active = %v, want %v", active, tt.active)
+			}
+			switch {
+			case tt.until == "" && until != nil:
+				t.Errorf("until = %s, want none", until)
+			case tt.until != "" && (until == nil || !until.Equal(at(tt.until))):
+				t.Errorf("until = %v, want %s", until, tt.until)
+			}
+		})
+	}
+}
+
+func TestParseCronSchedule(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"0 18 * * 5", false},
+		{"*/15 9-17 * * 1-5", false},
+		{"0 0 1,15 * 0,7", false},
+		{"0 18 * *", true},
+		{"60 * * * *", true},
+		{"*/0 * * * *", true},
+		{"0 0 * * 8", true},
+		{"0 0 0 * *", true},
+		{"0 17-9 * * *", true},
+	}
+	for _, tt := range tests {
+		if _, err := parseCronSchedule(tt.expr); (err != nil) != tt.wantErr {
+			t.Errorf("parseCronSchedule(%q) error = %v, want error %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
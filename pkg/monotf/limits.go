@@ -0,0 +1,324 @@
+package monotf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// ConcurrencyLimitGlobal limits the running workspaces across all orgs
+	ConcurrencyLimitGlobal ConcurrencyLimitScope = "global"
+	// ConcurrencyLimitOrg limits the running workspaces in an org
+	ConcurrencyLimitOrg ConcurrencyLimitScope = "org"
+	// ConcurrencyLimitPathVar limits the running workspaces with the same
+	// value of a path var, such as AWS_PROFILE
+	ConcurrencyLimitPathVar ConcurrencyLimitScope = "path_var"
+)
+
+type ConcurrencyLimitScope string
+
+// ConcurrencyLimit caps the number of workspaces which can hold an
+// exclusive lock at once. Shared locks are not limited.
+type ConcurrencyLimit struct {
+	gorm.Model
+	Scope ConcurrencyLimitScope `json:"scope" gorm:"uniqueIndex:idx_limit"`
+	// Org is the org of an org limit. For a path var limit it optionally
+	// restricts the limit to a single org.
+	Org string `json:"org" gorm:"uniqueIndex:idx_limit"`
+	// Key is the path var of a path var limit, e.g. AWS_PROFILE
+	Key string `json:"key" gorm:"column:var_key;uniqueIndex:idx_limit"`
+	// Value optionally restricts a path var limit to a single value of
+	// the path var. If empty, each value of the path var is limited separately.
+	Value string `json:"value" gorm:"column:var_value;uniqueIndex:idx_limit"`
+	Max   int    `json:"max"`
+}
+
+// String describes the limit, e.g. "org testing limit of 2 running"
+func (c *ConcurrencyLimit) String() string {
+	switch c.Scope {
+	case ConcurrencyLimitOrg:
+		return fmt.Sprintf("org %s limit of %d running", c.Org, c.Max)
+	case ConcurrencyLimitPathVar:
+		v := c.Value
+		if v == "" {
+			v = "*"
+		}
+		if c.Org != "" {
+			return fmt.Sprintf("org %s %s=%s limit of %d running", c.Org, c.Key, v, c.Max)
+		}
+		return fmt.Sprintf("%s=%s limit of %d running", c.Key, v, c.Max)
+	}
+	return fmt.Sprintf("global limit of %d running", c.Max)
+}
+
+// Validate checks the limit has the fields required by its scope
+func (c *ConcurrencyLimit) Validate() error {
+	if c.Max < 1 {
+		return fmt.Errorf("max must be at least 1")
+	}
+	switch c.Scope {
+	case ConcurrencyLimitGlobal:
+		if c.Org != "" || c.Key != "" || c.Value != "" {
+			return fmt.Errorf("global limit cannot have an org, key, or value")
+		}
+	case ConcurrencyLimitOrg:
+		if c.Org == "" {
+			return fmt.Errorf("org limit requires an org")
+		}
+		if c.Key != "" || c.Value != "" {
+			return fmt.Errorf("org limit cannot have a key or value")
+		}
+	case ConcurrencyLimitPathVar:
+		if c.Key == "" {
+			return fmt.Errorf("path var limit requires a key")
+		}
+	default:
+		return fmt.Errorf("invalid scope %s", c.Scope)
+	}
+	return nil
+}
+
+// applies returns true if the limit applies to the lock ticket t
+func (c *ConcurrencyLimit) applies(t *LockTicket) bool {
+	switch c.Scope {
+	case ConcurrencyLimitGlobal:
+		return true
+	case ConcurrencyLimitOrg:
+		return t.Org == c.Org
+	case ConcurrencyLimitPathVar:
+		if c.Org != "" && t.Org != c.Org {
+			return false
+		}
+		v, ok := t.PathVars[c.Key]
+		return ok && (c.Value == "" || v == c.Value)
+	}
+	return false
+}
+
+// shares returns true if the lock tickets a and b count against the same
+// instance of the limit, which for a path var limit without a value
+// means they have the same value of the path var
+func (c *ConcurrencyLimit) shares(a, b *LockTicket) bool {
+	if !c.applies(a) || !c.applies(b) {
+		return false
+	}
+	if c.Scope == ConcurrencyLimitPathVar && c.Value == "" {
+		return a.PathVars[c.Key] == b.PathVars[c.Key]
+	}
+	return true
+}
+
+// blockingLimit returns the first concurrency limit which would be exceeded
+// by granting exclusive locks to all of the tickets, or nil if there is none.
+// It returns an error if the tickets alone exceed a limit, since they could
+// never be granted together.
+func blockingLimit(tx *gorm.DB, tickets []*LockTicket, now time.Time) (*ConcurrencyLimit, error) {
+	var exclusive []*LockTicket
+	for _, t := range tickets {
+		if t.Mode != LockModeShared && t.Status != LockTicketGranted {
+			exclusive = append(exclusive, t)
+		}
+	}
+	if len(exclusive) == 0 {
+		return nil, nil
+	}
+	// the limit rows are locked before the running tickets are counted,
+	// so that acquisitions on different workspaces under the same limit
+	// are serialized and cannot both count the same running tickets
+	var limits []ConcurrencyLimit
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Order("id").Find(&limits).Error; err != nil {
+		return nil, err
+	}
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	var running []LockTicket
+	if err := tx.Where("status = ? AND mode = ? AND expires_at > ?", LockTicketGranted, LockModeExclusive, now).
+		Find(&running).Error; err != nil {
+		return nil, err
+	}
+	for i := range limits {
+		c := &limits[i]
+		for _, t := range exclusive {
+			if !c.applies(t) {
+				continue
+			}
+			var requested, held int
+			for _, o := range exclusive {
+				if c.shares(t, o) {
+					requested++
+				}
+			}
+			if requested > c.Max {
+				return nil, fmt.Errorf("lock set needs %d locks under the %s", requested, c)
+			}
+			for j := range running {
+				if c.shares(t, &running[j]) {
+					held++
+				}
+			}
+			if held+requested > c.Max {
+				return c, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ListConcurrencyLimits returns all concurrency limits
+func ListConcurrencyLimits() ([]ConcurrencyLimit, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ListConcurrencyLimits",
+	})
+	l.Debug("start")
+	var limits []ConcurrencyLimit
+	if err := db.DB.Order("id").Find(&limits).Error; err != nil {
+		l.WithError(err).Error("failed to list concurrency limits")
+		return nil, err
+	}
+	l.Debug("end")
+	return limits, nil
+}
+
+// Save creates the concurrency limit, or updates the max of the existing
+// limit with the same scope, org, key, and value
+func (c *ConcurrencyLimit) Save() error {
+	l := log.WithFields(log.Fields{
+		"pkg":   "ws",
+		"fn":    "ConcurrencyLimit.Save",
+		"scope": c.Scope,
+		"org":   c.Org,
+		"key":   c.Key,
+		"value": c.Value,
+	})
+	l.Debug("start")
+	if err := c.Validate(); err != nil {
+		l.WithError(err).Error("invalid concurrency limit")
+		return err
+	}
+	if err := db.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "scope"}, {Name: "org"}, {Name: "var_key"}, {Name: "var_value"}},
+		DoUpdates: clause.AssignmentColumns([]string{"max", "updated_at"}),
+	}).Create(c).Error; err != nil {
+		l.WithError(err).Error("failed to save concurrency limit")
+		return err
+	}
+	if err := db.DB.Where("scope = ? AND org = ? AND var_key = ? AND var_value = ?", c.Scope, c.Org, c.Key, c.Value).
+		First(c).Error; err != nil {
+		l.WithError(err).Error("failed to get concurrency limit")
+		return err
+	}
+	l.Debug("end")
+	return nil
+}
+
+// DeleteConcurrencyLimit removes the concurrency limit with the given id. It
+// returns gorm.ErrRecordNotFound if there is no such limit.
+func DeleteConcurrencyLimit(id string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "DeleteConcurrencyLimit",
+		"id":  id,
+	})
+	l.Debug("start")
+	res := db.DB.Unscoped().Where("id = ?", id).Delete(&ConcurrencyLimit{})
+	if res.Error != nil {
+		l.WithError(res.Error).Error("failed to delete concurrency limit")
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	l.Debug("end")
+	return nil
+}
+
+func HandleListConcurrencyLimits(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleListConcurrencyLimits",
+	})
+	l.Debug("start")
+	limits, err := ListConcurrencyLimits()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(limits); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleSaveConcurrencyLimit(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleSaveConcurrencyLimit",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to manage concurrency limits")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var c ConcurrencyLimit
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := c.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if err := c.Save(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleDeleteConcurrencyLimit(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleDeleteConcurrencyLimit",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to manage concurrency limits")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	vars := mux.Vars(r)
+	if err := DeleteConcurrencyLimit(vars["id"]); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	l.Debug("end")
+}
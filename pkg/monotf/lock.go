@@ -0,0 +1,859 @@
+package monotf
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	"github.com/robertlestak/monotf/internal/metrics"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrLockHeld    = errors.New("workspace is locked")
+	ErrLockNotHeld = errors.New("lock is not held")
+	// ErrLockEvicted is returned for writes from a holder whose lock was
+	// force-unlocked
+	ErrLockEvicted = errors.New("lock was force-unlocked")
+)
+
+const (
+	// LockModeExclusive is held by a single run which may change the
+	// workspace, such as an apply
+	LockModeExclusive LockMode = "exclusive"
+	// LockModeShared may be held by any number of read-only runs at once,
+	// such as speculative plans
+	LockModeShared LockMode = "shared"
+
+	LockPriorityLow    LockPriority = -1
+	LockPriorityNormal LockPriority = 0
+	LockPriorityHigh   LockPriority = 1
+
+	DefaultLockTTL = 5 * time.Minute
+	MinLockTTL     = 10 * time.Second
+)
+
+type LockMode string
+
+// LockPriority orders the workspace queue. Higher priority requests are
+// granted before lower priority ones, and requests of the same priority
+// are granted in the order they were made.
+type LockPriority int
+
+// ParseLockPriority parses a priority name, one of low, normal, or high
+func ParseLockPriority(s string) (LockPriority, error) {
+	switch s {
+	case "low":
+		return LockPriorityLow, nil
+	case "", "normal":
+		return LockPriorityNormal, nil
+	case "high":
+		return LockPriorityHigh, nil
+	}
+	return LockPriorityNormal, fmt.Errorf("invalid priority %s, must be one of low, normal, high", s)
+}
+
+func (p LockPriority) String() string {
+	switch {
+	case p < LockPriorityNormal:
+		return "low"
+	case p > LockPriorityNormal:
+		return "high"
+	}
+	return "normal"
+}
+
+// LockRequest is sent by clients to acquire, renew, or release a workspace lock
+type LockRequest struct {
+	LockId        string `json:"lock_id"`
+	WorkspaceName string `json:"workspace_name"`
+	Version       string `json:"version"`
+	// TTL is the lease duration, e.g. "5m". If the lease is not renewed
+	// before it elapses, the lock is released by the server.
+	TTL string `json:"ttl"`
+	// Mode is the lock mode, exclusive if not set
+	Mode LockMode `json:"mode"`
+	// PathVars are the path vars of the workspace, used to enforce
+	// per path var concurrency limits
+	PathVars map[string]string `json:"path_vars"`
+	// Owner describes the run requesting the lock
+	Owner *LockOwner `json:"owner"`
+	// Priority orders the request in the workspace queue
+	Priority LockPriority `json:"priority"`
+	// Preemptible shared locks are asked to give up the lock when a higher
+	// priority exclusive request is waiting for it
+	Preemptible bool `json:"preemptible"`
+	// Path is the path of the workspace relative to the repo, used to
+	// match the workspace globs of freezes
+	Path string `json:"path"`
+	// BreakGlass is the reason for taking an exclusive lock during a
+	// freeze, which is allowed if the request has its break-glass role
+	BreakGlass string `json:"break_glass"`
+	// roles are the roles of the request, set by the server
+	roles []string
+}
+
+// LockRenewal is returned by the heartbeat endpoint
+type LockRenewal struct {
+	Workspace Workspace `json:"workspace"`
+	// Preempted is set when a higher priority run is waiting for the lock,
+	// and the holder should release it as soon as possible
+	Preempted bool `json:"preempted"`
+}
+
+// LockOwner describes the run holding a lock, so that a stuck lock
+// can be traced back to the pipeline which took it
+type LockOwner struct {
+	Hostname string `json:"hostname"`
+	User     string `json:"user"`
+	RunURL   string `json:"run_url"`
+	GitSHA   string `json:"git_sha"`
+	Command  string `json:"command"`
+	// AcquiredAt is set by the server when the lock is granted
+	AcquiredAt *time.Time `json:"acquired_at"`
+}
+
+// String describes the owner, e.g. "ci@runner-1 running terraform plan"
+func (o *LockOwner) String() string {
+	if o == nil {
+		return "unknown"
+	}
+	s := o.User + "@" + o.Hostname
+	if o.Command != "" {
+		s += " running " + o.Command
+	}
+	if o.RunURL != "" {
+		s += " (" + o.RunURL + ")"
+	}
+	return s
+}
+
+// Value stores the owner as json
+func (o LockOwner) Value() (driver.Value, error) {
+	bd, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	return string(bd), nil
+}
+
+// Scan reads the owner from json
+func (o *LockOwner) Scan(v interface{}) error {
+	switch bd := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(bd), o)
+	case []byte:
+		return json.Unmarshal(bd, o)
+	}
+	return fmt.Errorf("unsupported lock owner type %T", v)
+}
+
+func (r LockRequest) lockMode() LockMode {
+	if r.Mode == LockModeShared {
+		return LockModeShared
+	}
+	return LockModeExclusive
+}
+
+// leaseTTL returns the requested lease duration, falling back to
+// MONOTF_LOCK_TTL and then DefaultLockTTL
+func (r LockRequest) leaseTTL() time.Duration {
+	for _, v := range []string{r.TTL, os.Getenv("MONOTF_LOCK_TTL")} {
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			continue
+		}
+		if d < MinLockTTL {
+			return MinLockTTL
+		}
+		return d
+	}
+	return DefaultLockTTL
+}
+
+// LockResult is returned by the lock endpoints
+type LockResult struct {
+	Acquired  bool      `json:"acquired"`
+	Holder    *string   `json:"holder"`
+	Workspace Workspace `json:"workspace"`
+	// Queue is set when the lock was not acquired
+	Queue QueueStatus `json:"queue"`
+}
+
+// lockWorkspaceRow loads the workspace row for update within tx, by its
+// org and name. The row is created first if it does not yet exist, and
+// restored if the workspace was deleted.
+func lockWorkspaceRow(tx *gorm.DB, w *Workspace) error {
+	err := findWorkspaceRow(tx, w)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		nw := Workspace{
+			Org:           w.Org,
+			Name:          w.Name,
+			WorkspaceName: w.WorkspaceName,
+			Version:       w.Version,
+			Status:        WorkspaceStatusUnknown,
+		}
+		// another request may create the row first, in which case the
+		// insert does nothing and its row is locked below
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&nw).Error; err != nil {
+			return err
+		}
+		err = findWorkspaceRow(tx, w)
+	}
+	if err != nil {
+		return err
+	}
+	if !w.DeletedAt.Valid {
+		return nil
+	}
+	// a deleted workspace starts over unlocked, keeping its run history
+	restored := map[string]interface{}{
+		"deleted_at":      nil,
+		"status":          WorkspaceStatusUnknown,
+		"running":         false,
+		"lock_id":         nil,
+		"readers":         0,
+		"lock_expires_at": nil,
+		"lock_owner":      nil,
+	}
+	if err := tx.Unscoped().Model(w).Updates(restored).Error; err != nil {
+		return err
+	}
+	return findWorkspaceRow(tx, w)
+}
+
+// findWorkspaceRow loads the workspace row with the org and name of w for
+// update within tx, including a deleted row
+func findWorkspaceRow(tx *gorm.DB, w *Workspace) error {
+	return tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("org = ? AND name = ?", w.Org, w.Name).
+		First(w).Error
+}
+
+// lockExpired returns true if the workspace is locked but its lease has elapsed
+func (w *Workspace) lockExpired(now time.Time) bool {
+	if w.Running == nil || !*w.Running {
+		return false
+	}
+	return w.LockExpiresAt != nil && w.LockExpiresAt.Before(now)
+}
+
+// expireLock releases an abandoned lock within tx and records the expiry
+func expireLock(tx *gorm.DB, w *Workspace, now time.Time) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "expireLock",
+		"org": w.Org,
+		"ws":  w.Name,
+	})
+	if w.LockId != nil {
+		l = l.WithField("lock", *w.LockId)
+	}
+	l.Warn("lock lease expired, releasing")
+	running := false
+	w.Running = &running
+	w.ExpiredLockId = w.LockId
+	w.LockId = nil
+	w.LockExpiresAt = nil
+	w.LockExpiredAt = &now
+	w.LockOwner = nil
+	if w.ExpiredLockId != nil {
+		if err := closeTicket(tx, *w.ExpiredLockId, LockTicketExpired, now); err != nil {
+			return err
+		}
+	}
+	if err := tx.Model(&Workspace{}).Where("id = ?", w.ID).Updates(map[string]interface{}{
+		"running":         false,
+		"lock_id":         nil,
+		"lock_expires_at": nil,
+		"lock_expired_at": now,
+		"expired_lock_id": w.ExpiredLockId,
+		"lock_owner":      nil,
+	}).Error; err != nil {
+		return err
+	}
+	metrics.WorkspaceLockExpired.WithLabelValues(w.Org, w.Name).Inc()
+	return nil
+}
+
+// syncReaders updates the count of shared lock holders of the workspace
+func syncReaders(tx *gorm.DB, w *Workspace) error {
+	var n int64
+	if err := tx.Model(&LockTicket{}).
+		Where("org = ? AND name = ? AND status = ? AND mode = ?", w.Org, w.Name, LockTicketGranted, LockModeShared).
+		Count(&n).Error; err != nil {
+		return err
+	}
+	w.Readers = int(n)
+	return tx.Model(&Workspace{}).Where("id = ?", w.ID).Update("readers", w.Readers).Error
+}
+
+// expireSharedLock releases an abandoned shared lock within tx and records the expiry
+func expireSharedLock(tx *gorm.DB, w *Workspace, t *LockTicket, now time.Time) error {
+	l := log.WithFields(log.Fields{
+		"pkg":  "ws",
+		"fn":   "expireSharedLock",
+		"org":  w.Org,
+		"ws":   w.Name,
+		"lock": t.LockId,
+	})
+	l.Warn("shared lock lease expired, releasing")
+	if err := closeTicket(tx, t.LockId, LockTicketExpired, now); err != nil {
+		return err
+	}
+	w.ExpiredLockId = &t.LockId
+	w.LockExpiredAt = &now
+	if err := tx.Model(&Workspace{}).Where("id = ?", w.ID).Updates(map[string]interface{}{
+		"lock_expired_at": now,
+		"expired_lock_id": t.LockId,
+	}).Error; err != nil {
+		return err
+	}
+	if err := syncReaders(tx, w); err != nil {
+		return err
+	}
+	metrics.WorkspaceLockExpired.WithLabelValues(w.Org, w.Name).Inc()
+	return nil
+}
+
+// prepareLock queues req.LockId for the lock of w within tx, first releasing
+// the lock if its lease has expired. It returns the ticket, whether it holds
+// or can be granted the lock, and whether an expired lock was released.
+func prepareLock(tx *gorm.DB, w *Workspace, req LockRequest, now time.Time) (*LockTicket, bool, bool, error) {
+	var expired bool
+	w.WorkspaceName = req.WorkspaceName
+	w.Version = req.Version
+	if err := lockWorkspaceRow(tx, w); err != nil {
+		return nil, false, expired, err
+	}
+	if w.lockExpired(now) {
+		if err := expireLock(tx, w, now); err != nil {
+			return nil, false, expired, err
+		}
+		expired = true
+	}
+	if err := abandonStaleTickets(tx, w.Org, w.Name, now); err != nil {
+		return nil, false, expired, err
+	}
+	t, err := enqueue(tx, w.Org, w.Name, req, now)
+	if err != nil {
+		return nil, false, expired, err
+	}
+	if t.Status == LockTicketGranted {
+		// already granted, acquiring again is a no-op
+		return t, true, expired, nil
+	}
+	ok, err := canGrant(tx, w, t)
+	if err != nil || ok {
+		return t, ok, expired, err
+	}
+	if t.Mode != LockModeShared && w.Readers > 0 {
+		if err := requestPreemption(tx, w, t, now); err != nil {
+			return t, ok, expired, err
+		}
+	}
+	return t, ok, expired, nil
+}
+
+// requestPreemption asks the preemptible shared holders of the lock of w
+// with a lower priority than t to release it. They are told so on their
+// next heartbeat.
+func requestPreemption(tx *gorm.DB, w *Workspace, t *LockTicket, now time.Time) error {
+	res := tx.Model(&LockTicket{}).
+		Where("org = ? AND name = ? AND status = ? AND mode = ?", w.Org, w.Name, LockTicketGranted, LockModeShared).
+		Where("preemptible = ? AND priority < ? AND preempted_at IS NULL", true, t.Priority).
+		Update("preempted_at", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		log.WithFields(log.Fields{
+			"pkg":  "ws",
+			"fn":   "requestPreemption",
+			"org":  w.Org,
+			"ws":   w.Name,
+			"lock": t.LockId,
+		}).Infof("requested preemption of %d shared locks", res.RowsAffected)
+	}
+	return nil
+}
+
+// grantLock grants the ticket t the lock of w within tx
+func grantLock(tx *gorm.DB, w *Workspace, t *LockTicket, req LockRequest, now time.Time) error {
+	if t.Status == LockTicketGranted {
+		return nil
+	}
+	expires := now.Add(req.leaseTTL())
+	var owner *LockOwner
+	if req.Owner != nil {
+		o := *req.Owner
+		o.AcquiredAt = &now
+		owner = &o
+	}
+	if err := tx.Model(t).Updates(map[string]interface{}{
+		"status":     LockTicketGranted,
+		"granted_at": now,
+		"expires_at": expires,
+		"owner":      owner,
+	}).Error; err != nil {
+		return err
+	}
+	t.Owner = owner
+	if t.Mode == LockModeShared {
+		return syncReaders(tx, w)
+	}
+	running := true
+	w.Running = &running
+	w.LockId = &t.LockId
+	w.LockExpiresAt = &expires
+	w.LockOwner = owner
+	return tx.Model(&Workspace{}).Where("id = ?", w.ID).Updates(map[string]interface{}{
+		"running":         true,
+		"lock_id":         t.LockId,
+		"lock_expires_at": expires,
+		"lock_owner":      owner,
+	}).Error
+}
+
+// AcquireLock atomically grants lockId the workspace lock in the requested
+// mode. An exclusive lock is granted when there are no other holders and
+// lockId is at the head of the workspace queue. A shared lock is granted
+// when there is no exclusive holder and no exclusive request queued ahead
+// of it, so that readers cannot starve a writer. Exclusive locks are also
+// subject to the configured concurrency limits, and are refused with
+// ErrFrozen during a freeze of the workspace. Otherwise lockId is
+// queued and ErrLockHeld is returned along with the queue status, and w is
+// populated with the current state.
+func (w *Workspace) AcquireLock(req LockRequest) (QueueStatus, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "ws",
+		"fn":   "AcquireLock",
+		"org":  w.Org,
+		"ws":   w.Name,
+		"lock": req.LockId,
+		"mode": req.lockMode(),
+	})
+	l.Debug("start")
+	var qs QueueStatus
+	if w.Org == "" || w.Name == "" {
+		l.Error("org or name is empty")
+		return qs, fmt.Errorf("org or name is empty")
+	}
+	if req.LockId == "" {
+		l.Error("lock id is empty")
+		return qs, fmt.Errorf("lock id is empty")
+	}
+	var queued, expired bool
+	var frozen error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if frozen = checkFreezes(tx, w.Org, w.Name, req, now); frozen != nil {
+			if !errors.Is(frozen, ErrFrozen) {
+				return frozen
+			}
+			return abandonWaitingTicket(tx, req.LockId, now)
+		}
+		t, ok, exp, err := prepareLock(tx, w, req, now)
+		expired = exp
+		if err != nil {
+			return err
+		}
+		var limit *ConcurrencyLimit
+		if ok {
+			if limit, err = blockingLimit(tx, []*LockTicket{t}, now); err != nil {
+				return err
+			}
+		}
+		if !ok || limit != nil {
+			// commit the ticket so the caller keeps its place in the queue
+			queued = true
+			qs, err = queueStatus(tx, w.Org, w.Name, req.LockId)
+			if limit != nil {
+				qs.BlockedBy = limit.String()
+			}
+			return err
+		}
+		return grantLock(tx, w, t, req, now)
+	})
+	if err != nil {
+		l.WithError(err).Error("failed to acquire lock")
+		return qs, err
+	}
+	if frozen != nil {
+		l.WithError(frozen).Info("workspace is frozen")
+		return qs, frozen
+	}
+	if expired || !queued {
+		notifyLockChange(w.Org, w.Name)
+	}
+	if queued {
+		l.Debug("lock is held, queued")
+		return qs, ErrLockHeld
+	}
+	l.Debug("end")
+	return qs, nil
+}
+
+// grantedSharedTicket returns the granted shared lock ticket for lockId
+// in the workspace, or nil if there is none
+func grantedSharedTicket(tx *gorm.DB, w *Workspace, lockId string) (*LockTicket, error) {
+	var ts []LockTicket
+	if err := tx.Where("org = ? AND name = ? AND lock_id = ? AND status = ? AND mode = ?",
+		w.Org, w.Name, lockId, LockTicketGranted, LockModeShared).
+		Limit(1).Find(&ts).Error; err != nil {
+		return nil, err
+	}
+	if len(ts) == 0 {
+		return nil, nil
+	}
+	return &ts[0], nil
+}
+
+// releaseLock releases the lock of w held by lockId within tx. If lockId is
+// still waiting in the queue, its ticket is abandoned. Releasing a lock
+// which is not held is a no-op, unless the workspace is held exclusively by
+// another lock, in which case ErrLockNotHeld is returned.
+func releaseLock(tx *gorm.DB, w *Workspace, lockId string, now time.Time) error {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("org = ? AND name = ?", w.Org, w.Name).
+		First(w).Error; err != nil {
+		return err
+	}
+	held := w.Running != nil && *w.Running
+	if !held || w.LockId == nil || *w.LockId != lockId {
+		t, err := grantedSharedTicket(tx, w, lockId)
+		if err != nil {
+			return err
+		}
+		if t != nil {
+			if err := closeTicket(tx, lockId, LockTicketReleased, now); err != nil {
+				return err
+			}
+			return syncReaders(tx, w)
+		}
+		// a request which gave up waiting leaves the queue, so that it
+		// does not hold up the requests behind it
+		var waiting int64
+		if err := tx.Model(&LockTicket{}).
+			Where("lock_id = ? AND status = ?", lockId, LockTicketWaiting).
+			Count(&waiting).Error; err != nil {
+			return err
+		}
+		if waiting > 0 {
+			return abandonWaitingTicket(tx, lockId, now)
+		}
+		if held {
+			return ErrLockNotHeld
+		}
+		return nil
+	}
+	running := false
+	w.Running = &running
+	w.LockId = nil
+	w.LockExpiresAt = nil
+	w.LockOwner = nil
+	if err := closeTicket(tx, lockId, LockTicketReleased, now); err != nil {
+		return err
+	}
+	return tx.Model(&Workspace{}).Where("id = ?", w.ID).Updates(map[string]interface{}{
+		"running":         false,
+		"lock_id":         nil,
+		"lock_expires_at": nil,
+		"lock_owner":      nil,
+	}).Error
+}
+
+// ReleaseLock atomically releases the workspace lock if it is held by lockId.
+// Releasing a lock which is not held is a no-op, unless the workspace is
+// held exclusively by another lock.
+func (w *Workspace) ReleaseLock(lockId string) error {
+	l := log.WithFields(log.Fields{
+		"pkg":  "ws",
+		"fn":   "ReleaseLock",
+		"org":  w.Org,
+		"ws":   w.Name,
+		"lock": lockId,
+	})
+	l.Debug("start")
+	if w.Org == "" || w.Name == "" {
+		l.Error("org or name is empty")
+		return fmt.Errorf("org or name is empty")
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return releaseLock(tx, w, lockId, time.Now())
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// the workspace has never been locked, such as when its first
+		// lock request was refused during a freeze
+		l.Debug("workspace not found, nothing to release")
+		return nil
+	}
+	if err != nil {
+		l.WithError(err).Error("failed to release lock")
+		return err
+	}
+	notifyLockChange(w.Org, w.Name)
+	l.Debug("end")
+	return nil
+}
+
+// RenewLock extends the lease of the lock held by req.LockId, and returns
+// true if the holder has been asked to release it for a higher priority run.
+// It returns ErrLockNotHeld if the lock has been lost.
+func (w *Workspace) RenewLock(req LockRequest) (bool, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "ws",
+		"fn":   "RenewLock",
+		"org":  w.Org,
+		"ws":   w.Name,
+		"lock": req.LockId,
+	})
+	l.Debug("start")
+	if w.Org == "" || w.Name == "" {
+		l.Error("org or name is empty")
+		return false, fmt.Errorf("org or name is empty")
+	}
+	var preempted bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("org = ? AND name = ?", w.Org, w.Name).
+			First(w).Error; err != nil {
+			return err
+		}
+		expires := time.Now().Add(req.leaseTTL())
+		if w.Running == nil || !*w.Running || w.LockId == nil || *w.LockId != req.LockId {
+			t, err := grantedSharedTicket(tx, w, req.LockId)
+			if err != nil {
+				return err
+			}
+			if t == nil {
+				return ErrLockNotHeld
+			}
+			preempted = t.PreemptedAt != nil
+			return tx.Model(t).Update("expires_at", expires).Error
+		}
+		w.LockExpiresAt = &expires
+		if err := tx.Model(&LockTicket{}).Where("lock_id = ?", req.LockId).Update("expires_at", expires).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Workspace{}).Where("id = ?", w.ID).Update("lock_expires_at", expires).Error
+	})
+	if err != nil {
+		l.WithError(err).Error("failed to renew lock")
+		return false, err
+	}
+	l.Debug("end")
+	return preempted, nil
+}
+
+// ReapExpiredLocks releases all locks whose lease has elapsed
+func ReapExpiredLocks() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ReapExpiredLocks",
+	})
+	l.Debug("start")
+	if err := abandonStaleTickets(db.DB, "", "", time.Now()); err != nil {
+		l.WithError(err).Error("failed to abandon stale queue tickets")
+		return err
+	}
+	var ids []uint
+	if err := db.DB.Model(&Workspace{}).
+		Where("running = ? AND lock_expires_at < ?", true, time.Now()).
+		Pluck("id", &ids).Error; err != nil {
+		l.WithError(err).Error("failed to list expired locks")
+		return err
+	}
+	for _, id := range ids {
+		var org, name string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var w Workspace
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&w, id).Error; err != nil {
+				return err
+			}
+			// the lease may have been renewed since it was listed
+			now := time.Now()
+			if !w.lockExpired(now) {
+				return nil
+			}
+			if err := expireLock(tx, &w, now); err != nil {
+				return err
+			}
+			org, name = w.Org, w.Name
+			return nil
+		})
+		if err != nil {
+			l.WithError(err).WithField("id", id).Error("failed to expire lock")
+			continue
+		}
+		if org != "" {
+			notifyLockChange(org, name)
+		}
+	}
+	var tickets []LockTicket
+	if err := db.DB.Where("status = ? AND mode = ? AND expires_at < ?", LockTicketGranted, LockModeShared, time.Now()).
+		Find(&tickets).Error; err != nil {
+		l.WithError(err).Error("failed to list expired shared locks")
+		return err
+	}
+	for _, t := range tickets {
+		w := Workspace{Org: t.Org, Name: t.Name}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("org = ? AND name = ?", w.Org, w.Name).
+				First(&w).Error; err != nil {
+				return err
+			}
+			// the lease may have been renewed since it was listed
+			ct, err := grantedSharedTicket(tx, &w, t.LockId)
+			if err != nil || ct == nil {
+				return err
+			}
+			now := time.Now()
+			if ct.ExpiresAt == nil || ct.ExpiresAt.After(now) {
+				return nil
+			}
+			return expireSharedLock(tx, &w, ct, now)
+		})
+		if err != nil {
+			l.WithError(err).WithField("lock", t.LockId).Error("failed to expire shared lock")
+			continue
+		}
+		notifyLockChange(w.Org, w.Name)
+	}
+	l.Debug("end")
+	return nil
+}
+
+func reapExpiredLocks() {
+	l := log.WithField("func", "reapExpiredLocks")
+	l.Debug("reaping expired locks")
+	for {
+		time.Sleep(10 * time.Second)
+		if err := ReapExpiredLocks(); err != nil {
+			l.WithError(err).Error("error reaping expired locks")
+		}
+		if err := ReportStuckLocks(); err != nil {
+			l.WithError(err).Error("error reporting stuck locks")
+		}
+	}
+}
+
+func HandleAcquireLock(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleAcquireLock",
+	})
+	l.Debug("start")
+	var req LockRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req.roles = requestRoles(r)
+	var ws Workspace
+	vars := mux.Vars(r)
+	ws.Org = vars["org"]
+	ws.Name = vars["name"]
+	res := LockResult{}
+	qs, err := ws.AcquireLock(req)
+	if errors.Is(err, ErrFrozen) {
+		w.WriteHeader(http.StatusLocked)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	} else if err != nil && !errors.Is(err, ErrLockHeld) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	res.Acquired = err == nil
+	res.Holder = ws.LockId
+	res.Workspace = ws
+	res.Queue = qs
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Acquired {
+		w.WriteHeader(http.StatusConflict)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleReleaseLock(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleReleaseLock",
+	})
+	l.Debug("start")
+	var ws Workspace
+	vars := mux.Vars(r)
+	ws.Org = vars["org"]
+	ws.Name = vars["name"]
+	lockId := r.FormValue("lock_id")
+	if err := ws.ReleaseLock(lockId); err != nil {
+		if errors.Is(err, ErrLockNotHeld) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleRenewLock(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleRenewLock",
+	})
+	l.Debug("start")
+	var req LockRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var ws Workspace
+	vars := mux.Vars(r)
+	ws.Org = vars["org"]
+	ws.Name = vars["name"]
+	preempted, err := ws.RenewLock(req)
+	if err != nil {
+		if errors.Is(err, ErrLockNotHeld) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	res := LockRenewal{
+		Workspace: ws,
+		Preempted: preempted,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
@@ -0,0 +1,281 @@
+package monotf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// LockSetMember is a workspace lock requested as part of a set. Each
+// member has its own lock id, which is used to renew it as usual.
+type LockSetMember struct {
+	Org  string `json:"org"`
+	Name string `json:"name"`
+	LockRequest
+}
+
+// LockSetRequest is sent by clients to acquire or release the locks of a
+// set of workspaces together
+type LockSetRequest struct {
+	Locks []LockSetMember `json:"locks"`
+}
+
+// LockSetResult is returned by the lock set endpoints
+type LockSetResult struct {
+	Acquired bool `json:"acquired"`
+	// Locks has the result of each member, in lock order
+	Locks []LockResult `json:"locks"`
+}
+
+// sortedMembers validates the members of the set and returns them in the
+// order in which they are locked. Always locking in the same order means
+// two sets which overlap cannot deadlock each other.
+func (r LockSetRequest) sortedMembers() ([]LockSetMember, error) {
+	if len(r.Locks) == 0 {
+		return nil, fmt.Errorf("lock set is empty")
+	}
+	ms := make([]LockSetMember, len(r.Locks))
+	copy(ms, r.Locks)
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].Org != ms[j].Org {
+			return ms[i].Org < ms[j].Org
+		}
+		return ms[i].Name < ms[j].Name
+	})
+	for i, m := range ms {
+		if m.Org == "" || m.Name == "" {
+			return nil, fmt.Errorf("org or name is empty")
+		}
+		if m.LockId == "" {
+			return nil, fmt.Errorf("lock id is empty for %s/%s", m.Org, m.Name)
+		}
+		if i > 0 && ms[i-1].Org == m.Org && ms[i-1].Name == m.Name {
+			return nil, fmt.Errorf("workspace %s/%s is in the lock set more than once", m.Org, m.Name)
+		}
+	}
+	return ms, nil
+}
+
+// AcquireLockSet atomically grants the locks of all workspaces in the set, or
+// none of them. Members are queued on every workspace in the set, so a set
+// waiting for a busy workspace keeps its place in the queues of the others.
+// Since a set never holds some of its locks while waiting for the rest, sets
+// cannot deadlock each other. If any lock cannot be granted, ErrLockHeld is
+// returned along with the queue status of each member. If any exclusive
+// lock is frozen, none are queued and ErrFrozen is returned.
+func AcquireLockSet(req LockSetRequest) (LockSetResult, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "ws",
+		"fn":   "AcquireLockSet",
+		"size": len(req.Locks),
+	})
+	l.Debug("start")
+	var res LockSetResult
+	ms, err := req.sortedMembers()
+	if err != nil {
+		l.WithError(err).Error("invalid lock set")
+		return res, err
+	}
+	res.Locks = make([]LockResult, len(ms))
+	var queued bool
+	var frozen error
+	changed := make([]bool, len(ms))
+	err = db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for _, m := range ms {
+			if frozen = checkFreezes(tx, m.Org, m.Name, m.LockRequest, now); frozen != nil {
+				break
+			}
+		}
+		if frozen != nil {
+			if !errors.Is(frozen, ErrFrozen) {
+				return frozen
+			}
+			for _, m := range ms {
+				if err := abandonWaitingTicket(tx, m.LockId, now); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		tickets := make([]*LockTicket, len(ms))
+		for i, m := range ms {
+			w := &res.Locks[i].Workspace
+			w.Org, w.Name = m.Org, m.Name
+			t, ok, expired, err := prepareLock(tx, w, m.LockRequest, now)
+			if err != nil {
+				return err
+			}
+			changed[i] = expired
+			tickets[i] = t
+			res.Locks[i].Acquired = ok
+			if !ok {
+				queued = true
+			}
+		}
+		var limit *ConcurrencyLimit
+		if !queued {
+			var err error
+			if limit, err = blockingLimit(tx, tickets, now); err != nil {
+				return err
+			}
+			queued = limit != nil
+		}
+		for i, m := range ms {
+			w := &res.Locks[i].Workspace
+			if queued {
+				// commit the tickets so the set keeps its place in every queue
+				res.Locks[i].Acquired = false
+				qs, err := queueStatus(tx, w.Org, w.Name, m.LockId)
+				if err != nil {
+					return err
+				}
+				if limit != nil && limit.applies(tickets[i]) {
+					qs.BlockedBy = limit.String()
+				}
+				res.Locks[i].Queue = qs
+			} else {
+				if err := grantLock(tx, w, tickets[i], m.LockRequest, now); err != nil {
+					return err
+				}
+				changed[i] = true
+			}
+			res.Locks[i].Holder = w.LockId
+		}
+		return nil
+	})
+	if err != nil {
+		l.WithError(err).Error("failed to acquire lock set")
+		return res, err
+	}
+	if frozen != nil {
+		l.WithError(frozen).Info("lock set is frozen")
+		return res, frozen
+	}
+	for i, m := range ms {
+		if changed[i] {
+			notifyLockChange(m.Org, m.Name)
+		}
+	}
+	if queued {
+		l.Debug("lock set is held, queued")
+		return res, ErrLockHeld
+	}
+	res.Acquired = true
+	l.Debug("end")
+	return res, nil
+}
+
+// ReleaseLockSet atomically releases the locks of all workspaces in the set.
+// Members which are not held are skipped, and ErrLockNotHeld is returned if
+// any of them is held exclusively by another lock.
+func ReleaseLockSet(req LockSetRequest) error {
+	l := log.WithFields(log.Fields{
+		"pkg":  "ws",
+		"fn":   "ReleaseLockSet",
+		"size": len(req.Locks),
+	})
+	l.Debug("start")
+	ms, err := req.sortedMembers()
+	if err != nil {
+		l.WithError(err).Error("invalid lock set")
+		return err
+	}
+	var notHeld bool
+	err = db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for _, m := range ms {
+			w := &Workspace{Org: m.Org, Name: m.Name}
+			err := releaseLock(tx, w, m.LockId, now)
+			if errors.Is(err, ErrLockNotHeld) {
+				notHeld = true
+			} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		l.WithError(err).Error("failed to release lock set")
+		return err
+	}
+	for _, m := range ms {
+		notifyLockChange(m.Org, m.Name)
+	}
+	if notHeld {
+		l.Debug("lock set was partially held by another lock")
+		return ErrLockNotHeld
+	}
+	l.Debug("end")
+	return nil
+}
+
+func HandleAcquireLockSet(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleAcquireLockSet",
+	})
+	l.Debug("start")
+	var req LockSetRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	roles := requestRoles(r)
+	for i := range req.Locks {
+		req.Locks[i].roles = roles
+	}
+	res, err := AcquireLockSet(req)
+	if errors.Is(err, ErrFrozen) {
+		w.WriteHeader(http.StatusLocked)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	} else if err != nil && !errors.Is(err, ErrLockHeld) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Acquired {
+		w.WriteHeader(http.StatusConflict)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleReleaseLockSet(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleReleaseLockSet",
+	})
+	l.Debug("start")
+	var req LockSetRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := ReleaseLockSet(req); err != nil {
+		if errors.Is(err, ErrLockNotHeld) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	l.Debug("end")
+}
@@ -0,0 +1,239 @@
+package monotf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxRunLogChunkSize is the largest log chunk accepted from a client
+	MaxRunLogChunkSize = 1 << 20
+)
+
+// RunLog is a chunk of the output of a run, streamed by the client while
+// terraform is running. Chunks are numbered from 1 in the order they were
+// written.
+type RunLog struct {
+	ID        uint      `json:"-" gorm:"primarykey"`
+	RunID     uint      `json:"run_id" gorm:"uniqueIndex:idx_run_log_seq"`
+	Seq       int       `json:"seq" gorm:"uniqueIndex:idx_run_log_seq"`
+	Data      string    `json:"data"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func runLogKey(runId uint) string {
+	return fmt.Sprintf("run/%d", runId)
+}
+
+// AppendLog stores a chunk of the output of the run. Chunks which were
+// already stored, such as those resent by a client retrying after an
+// error, are ignored.
+func (r *Run) AppendLog(seq int, data string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "Run.AppendLog",
+		"org": r.Org,
+		"ws":  r.Name,
+		"run": r.ID,
+		"seq": seq,
+	})
+	l.Debug("start")
+	if seq < 1 {
+		return fmt.Errorf("invalid seq %d", seq)
+	}
+	if err := db.DB.Where("org = ? AND name = ?", r.Org, r.Name).First(r, r.ID).Error; err != nil {
+		l.WithError(err).Error("failed to get run")
+		return err
+	}
+	if r.FinishedAt != nil {
+		return ErrRunFinished
+	}
+	rl := RunLog{
+		RunID: r.ID,
+		Seq:   seq,
+		Data:  data,
+	}
+	if err := db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&rl).Error; err != nil {
+		l.WithError(err).Error("failed to append run log")
+		return err
+	}
+	notify(runLogKey(r.ID))
+	l.Debug("end")
+	return nil
+}
+
+// GetRunLogs returns the log chunks of the run after seq, in order
+func GetRunLogs(runId uint, after int) ([]RunLog, error) {
+	var logs []RunLog
+	if err := db.DB.Where("run_id = ? AND seq > ?", runId, after).
+		Order("seq").Find(&logs).Error; err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+func HandleAppendRunLog(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleAppendRunLog",
+	})
+	l.Debug("start")
+	run, err := runFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	seq, err := strconv.Atoi(r.FormValue("seq"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid seq %s", r.FormValue("seq"))
+		return
+	}
+	defer r.Body.Close()
+	bd, err := io.ReadAll(io.LimitReader(r.Body, MaxRunLogChunkSize+1))
+	if err != nil {
+		l.WithError(err).Error("failed to read request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(bd) > MaxRunLogChunkSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "log chunk exceeds %d bytes", MaxRunLogChunkSize)
+		return
+	}
+	if err := run.AppendLog(seq, string(bd)); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrRunFinished):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	l.Debug("end")
+}
+
+// HandleRunLogs returns the log chunks of the run after the after query
+// param. If follow is set, the chunks are streamed as server-sent events as
+// they arrive, followed by a finished event with the run once it finishes,
+// until the server maximum hold time elapses or the client disconnects.
+// Following clients reconnect with the seq of the last chunk they received.
+func HandleRunLogs(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleRunLogs",
+	})
+	l.Debug("start")
+	run, err := runFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	var after int
+	if v := r.FormValue("after"); v != "" {
+		after, err = strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid after %s", v)
+			return
+		}
+	}
+	if err := db.DB.Where("org = ? AND name = ?", run.Org, run.Name).First(&run, run.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if r.FormValue("follow") != "true" {
+		logs, err := GetRunLogs(run.ID, after)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(logs); err != nil {
+			l.WithError(err).Error("failed to encode response body")
+			return
+		}
+		l.Debug("end")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		l.Error("streaming unsupported")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ch, unwatch := watch(runLogKey(run.ID))
+	defer unwatch()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	deadline := time.NewTimer(requestHold(r))
+	defer deadline.Stop()
+	recheck := time.NewTicker(waitRecheckInterval)
+	defer recheck.Stop()
+	for {
+		// check if the run has finished before reading the logs, so that
+		// no chunks are missed when it has
+		if err := db.DB.First(&run, run.ID).Error; err != nil {
+			l.WithError(err).Error("failed to get run")
+			return
+		}
+		logs, err := GetRunLogs(run.ID, after)
+		if err != nil {
+			l.WithError(err).Error("failed to get run logs")
+			return
+		}
+		for _, rl := range logs {
+			bd, err := json.Marshal(rl)
+			if err != nil {
+				l.WithError(err).Error("failed to encode event")
+				return
+			}
+			fmt.Fprintf(w, "event: log\nid: %d\ndata: %s\n\n", rl.Seq, bd)
+			after = rl.Seq
+		}
+		if run.FinishedAt != nil {
+			bd, err := json.Marshal(run)
+			if err != nil {
+				l.WithError(err).Error("failed to encode event")
+				return
+			}
+			fmt.Fprintf(w, "event: finished\ndata: %s\n\n", bd)
+			flusher.Flush()
+			l.Debug("end")
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-ch:
+		case <-recheck.C:
+		case <-deadline.C:
+			l.Debug("end")
+			return
+		case <-r.Context().Done():
+			l.Debug("client disconnected")
+			return
+		}
+	}
+}
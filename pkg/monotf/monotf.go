@@ -1,14 +1,21 @@
 package monotf
 
 import (
+	"bufio"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -35,6 +42,25 @@ type Monotf struct {
 	PathVars       []PathVar `json:"-" yaml:"-"`
 	VaultEnv       *VaultEnv `json:"vault_env" yaml:"vault_env"`
 	VarScript      string    `json:"var_script" yaml:"var_script"`
+	LockTTL        string    `json:"lock_ttl" yaml:"lock_ttl"`
+	Priority       string    `json:"priority" yaml:"priority"`
+	// SensitiveEnv lists environment variables whose values are masked in
+	// terraform output, in addition to those loaded from vault and the var script
+	SensitiveEnv []string `json:"sensitive_env" yaml:"sensitive_env"`
+	// Approval marks the workspaces whose plans must be approved before
+	// they are applied
+	Approval *ApprovalConfig `json:"approval" yaml:"approval"`
+	// Policies are checked against each plan, along with those in PolicyFile
+	Policies   []PolicyRule `json:"policies" yaml:"policies"`
+	PolicyFile string       `json:"policy_file" yaml:"policy_file"`
+	// Protection marks the workspaces which are protected from being destroyed
+	Protection *ProtectionConfig `json:"protection" yaml:"protection"`
+	// Override is the reason given to override the protection of a
+	// workspace. It can only be set with a flag.
+	Override string `json:"-" yaml:"-"`
+	// BreakGlass is the reason given to take exclusive locks during a
+	// freeze. It can only be set with a flag.
+	BreakGlass string `json:"-" yaml:"-"`
 
 	RepoDir string `json:"dir" yaml:"dir"`
 }
@@ -47,21 +73,58 @@ type PathVar struct {
 
 type Workspace struct {
 	gorm.Model
-	Org           string          `json:"org" gorm:"uniqueIndex:idx_org_name"`
-	Name          string          `json:"name" gorm:"uniqueIndex:idx_org_name"`
+	Org           string          `json:"org" gorm:"uniqueIndex:idx_org_name;uniqueIndex:idx_ws_org_name"`
+	Name          string          `json:"name" gorm:"uniqueIndex:idx_org_name;uniqueIndex:idx_ws_org_name"`
 	WorkspaceName string          `json:"workspace_name" gorm:"uniqueIndex:idx_org_name"`
 	Path          string          `json:"path" yaml:"path" gorm:"-"`
 	Version       string          `json:"version" yaml:"version"`
 	Status        WorkspaceStatus `json:"status"`
-	Output        string          `json:"output"`
-	Running       *bool           `json:"running"`
-	LockId        *string         `json:"lock_id"`
-	Force         bool            `json:"force" yaml:"force" gorm:"-"`
-	PathVars      []PathVar       `json:"-" yaml:"-" gorm:"-"`
-	EnvVars       []string        `json:"-" yaml:"-" gorm:"-"`
+	// StatusChangedAt is the time of the latest status transition
+	StatusChangedAt *time.Time `json:"status_changed_at"`
+	// Output is the output of the latest run. It is stored with the run,
+	// not the workspace.
+	Output      string `json:"output,omitempty" gorm:"-"`
+	LatestRunId *uint  `json:"latest_run_id"`
+	// LatestDriftRunId is the latest drift check of the workspace
+	LatestDriftRunId *uint      `json:"latest_drift_run_id"`
+	Running          *bool      `json:"running"`
+	LockId           *string    `json:"lock_id"`
+	Readers          int        `json:"readers"`
+	LockExpiresAt    *time.Time `json:"lock_expires_at"`
+	LockExpiredAt    *time.Time `json:"lock_expired_at"`
+	ExpiredLockId    *string    `json:"expired_lock_id"`
+	LockOwner        *LockOwner `json:"lock_owner" gorm:"type:text"`
+	// ForceUnlockedAt, ForceUnlockedBy, ForceUnlockReason, and EvictedLockId
+	// record the last force-unlock of the workspace
+	ForceUnlockedAt   *time.Time `json:"force_unlocked_at"`
+	ForceUnlockedBy   string     `json:"force_unlocked_by"`
+	ForceUnlockReason string     `json:"force_unlock_reason"`
+	EvictedLockId     *string    `json:"evicted_lock_id"`
+	// SharedLocks are the granted shared locks of the workspace
+	SharedLocks []LockTicket `json:"shared_locks,omitempty" gorm:"-"`
+	Force       bool         `json:"force" yaml:"force" gorm:"-"`
+	PathVars    []PathVar    `json:"-" yaml:"-" gorm:"-"`
+	EnvVars     []string     `json:"-" yaml:"-" gorm:"-"`
 
 	Init   bool `json:"init" yaml:"init" gorm:"-"`
 	IsInit bool `json:"is_init" yaml:"is_init" gorm:"-"`
+
+	lockMode      LockMode
+	preemptible   bool
+	stopHeartbeat chan struct{}
+	// runCtx is cancelled to stop the running terraform command when
+	// the run is preempted or its lock lease is lost
+	runCtx    context.Context
+	cancelRun context.CancelCauseFunc
+	// logStream sends the output of the running terraform command to the server
+	logStream *runLogStreamer
+	// planRunId is the plan run whose stored plan is being applied
+	planRunId *uint
+	// approvalTimeout is set while planning a plan which may be applied,
+	// and is how long the plan waits for approval if it must be approved.
+	// requireApproval is set if the workspace requires approval.
+	approvalTimeout time.Duration
+	requireApproval bool
 }
 
 func LoadConfig(f string) error {
@@ -182,6 +245,9 @@ func (m *Monotf) Init() error {
 	if err := m.ParsePathVarKeys(); err != nil {
 		return err
 	}
+	if err := m.loadPolicies(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -358,6 +424,11 @@ func (w *Workspace) SetName(parentDir string) {
 	l.Debugf("workspace %s name is %s", w.Path, w.WorkspaceName)
 }
 
+// relPath returns the path of the workspace relative to the repo
+func (w *Workspace) relPath() string {
+	return strings.TrimPrefix(w.Path, M.RepoDir+"/")
+}
+
 func (m *Monotf) SupportsVersion(v string) bool {
 	l := log.WithFields(log.Fields{
 		"app": "monotf",
@@ -431,6 +502,17 @@ func (b *Monotf) GetWorkspaceLocal(w string) (*Workspace, error) {
 	return ws, nil
 }
 
+// RemoteWorkspace returns the workspace at the path relative to the repo
+// with only its org and name set, for commands which only talk to the
+// server, such as logs and approve. It does not need the workspace to be
+// checked out, and does not load its environment.
+func (b *Monotf) RemoteWorkspace(path string) *Workspace {
+	return &Workspace{
+		Org:  b.Org,
+		Name: strings.ReplaceAll(strings.Trim(path, "/"), "/", "-"),
+	}
+}
+
 func (w *Workspace) CreateWorkspaceIfNotExist() error {
 	l := log.WithFields(log.Fields{
 		"app": "monotf",
@@ -472,24 +554,7 @@ func (w *Workspace) Terraform(args []string) (string, string, error) {
 	}
 	argStr := strings.Join(args, " ")
 	l.Debugf("running %s %s", binPath, argStr)
-	cmd := exec.Command(binPath, args...)
-	cmd.Env = os.Environ()
-	// and env vars:
-	cmd.Env = append(cmd.Env, "TF_IN_AUTOMATION=true")
-	if w.IsInit {
-		l.Debugf("setting TF_WORKSPACE=%s", w.WorkspaceName)
-		cmd.Env = append(cmd.Env, "TF_WORKSPACE="+w.WorkspaceName)
-	}
-	// for each of the path vars, export them
-	for _, pv := range w.PathVars {
-		if pv.Key != "" {
-			l.Debugf("setting %s=%s", pv.Key, pv.Value)
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", pv.Key, pv.Value))
-		}
-	}
-	// for each of the env vars, export them
-	cmd.Env = append(cmd.Env, w.EnvVars...)
-	cmd.Dir = w.Path
+	cmd := w.terraformCmd(binPath, args)
 	// tee the out to both the stdout and out var
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -505,40 +570,17 @@ func (w *Workspace) Terraform(args []string) (string, string, error) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	red := NewRedactor(w.secrets())
 	go func() {
 		defer wg.Done()
-		for {
-			buf := make([]byte, 1024)
-			n, err := stdout.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					l.Errorf("error reading stdout: %v", err)
-				}
-				break
-			}
-			out = append(out, buf[:n]...)
-			outStr = string(out)
-			// write to stdout
-			fmt.Print(string(buf[:n]))
-		}
+		out = w.copyOutput(stdout, os.Stdout, red)
+		outStr = string(out)
 	}()
 
 	go func() {
 		defer wg.Done()
-		for {
-			buf := make([]byte, 1024)
-			n, err := stderr.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					l.Errorf("error reading stderr: %v", err)
-				}
-				break
-			}
-			errOut = append(errOut, buf[:n]...)
-			errOutStr = string(errOut)
-			// write to stderr
-			fmt.Fprint(os.Stderr, string(buf[:n]))
-		}
+		errOut = w.copyOutput(stderr, os.Stderr, red)
+		errOutStr = string(errOut)
 	}()
 
 	err = cmd.Start()
@@ -550,17 +592,135 @@ func (w *Workspace) Terraform(args []string) (string, string, error) {
 	wg.Wait()
 
 	err = cmd.Wait()
+	// combine stdout and stderr, base64 encode, and set to w.Output
+	w.Output = base64.StdEncoding.EncodeToString(append(out, errOut...))
+	if w.runCtx != nil && errors.Is(context.Cause(w.runCtx), errLeaseLost) {
+		l.Errorf("stopped %s %s: %v", binPath, argStr, errLeaseLost)
+		return outStr, errOutStr, errLeaseLost
+	}
 	if err != nil {
-		l.Errorf("error running %s %s: %v", binPath, argStr, err)
+		if statusFromExitCode(args, exitCode(err)) != WorkspaceStatusFailed {
+			l.Debugf("%s %s exited with changes present", binPath, argStr)
+		} else {
+			l.Errorf("error running %s %s: %v", binPath, argStr, err)
+		}
 		return outStr, errOutStr, err
 	}
 
 	l.Debugf("ran %s %s", binPath, argStr)
-	// combine stdout and stderr, base64 encode, and set to w.Output
-	w.Output = base64.StdEncoding.EncodeToString(append(out, errOut...))
 	return outStr, errOutStr, err
 }
 
+// terraformCmd returns the command to run the terraform binary with args in
+// the workspace, with the environment of the workspace
+func (w *Workspace) terraformCmd(binPath string, args []string) *exec.Cmd {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "terraformCmd",
+		"ws":  w.Name,
+		"ver": w.Version,
+	})
+	ctx := w.runCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cmd := exec.CommandContext(ctx, binPath, args...)
+	// give terraform the chance to exit cleanly when the run is cancelled
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = 30 * time.Second
+	cmd.Env = os.Environ()
+	// and env vars:
+	cmd.Env = append(cmd.Env, "TF_IN_AUTOMATION=true")
+	if w.IsInit {
+		l.Debugf("setting TF_WORKSPACE=%s", w.WorkspaceName)
+		cmd.Env = append(cmd.Env, "TF_WORKSPACE="+w.WorkspaceName)
+	}
+	// for each of the path vars, export them
+	for _, pv := range w.PathVars {
+		if pv.Key != "" {
+			l.Debugf("setting %s=%s", pv.Key, pv.Value)
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", pv.Key, pv.Value))
+		}
+	}
+	// for each of the env vars, export them
+	cmd.Env = append(cmd.Env, w.EnvVars...)
+	cmd.Dir = w.Path
+	return cmd
+}
+
+// TerraformShowPlan returns the counts of the resource changes in the plan
+// file, and the changes themselves, read from terraform show -json. If drift
+// is set, the resources which have drifted from the state are returned
+// instead.
+func (w *Workspace) TerraformShowPlan(planFile string, drift bool) (*PlanChanges, []PlanResource, error) {
+	_, changes, resources, err := w.showPlan(planFile, drift)
+	return changes, resources, err
+}
+
+// showPlan returns the output of terraform show -json for planFile, along
+// with the changes parsed from it as in TerraformShowPlan
+func (w *Workspace) showPlan(planFile string, drift bool) ([]byte, *PlanChanges, []PlanResource, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "showPlan",
+		"ws":  w.Name,
+		"ver": w.Version,
+	})
+	binPath, err := M.BinForVersion(w.Version)
+	if err != nil {
+		l.Errorf("error getting binary for version %s: %v", w.Version, err)
+		return nil, nil, nil, err
+	}
+	out, err := w.terraformCmd(binPath, []string{"show", "-json", planFile}).Output()
+	if err != nil {
+		l.Errorf("error showing plan %s: %v", planFile, err)
+		return nil, nil, nil, err
+	}
+	parse := ParsePlan
+	if drift {
+		parse = ParsePlanDrift
+	}
+	changes, resources, err := parse(out)
+	if err != nil {
+		l.Errorf("error parsing plan %s: %v", planFile, err)
+		return out, nil, nil, err
+	}
+	return out, changes, resources, nil
+}
+
+// copyOutput copies the output of terraform from r to console and the run
+// log stream line by line as it is written, masking secrets, and returns
+// all of the masked output
+func (w *Workspace) copyOutput(r io.Reader, console io.Writer, red *Redactor) []byte {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "copyOutput",
+		"ws":  w.Name,
+	})
+	var out []byte
+	br := bufio.NewReader(r)
+	for {
+		// whole lines are masked so that secrets split across reads are caught
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = red.Redact(line)
+			out = append(out, line...)
+			if w.logStream != nil {
+				w.logStream.Write([]byte(line))
+			}
+			fmt.Fprint(console, line)
+		}
+		if err != nil {
+			if err != io.EOF {
+				l.Errorf("error reading output: %v", err)
+			}
+			return out
+		}
+	}
+}
+
 func (w *Workspace) TerraformInit() (string, string, error) {
 	l := log.WithFields(log.Fields{
 		"app": "monotf",
@@ -665,12 +825,94 @@ func (w *Workspace) WaitForReady(timeoutStr string) error {
 		l.Errorf("error parsing timeout %s: %v", timeoutStr, err)
 		return err
 	}
+	return w.waitForReady(timeout)
+}
+
+// errWaitUnsupported is returned by WaitForLockChange when the server
+// does not have the wait endpoint
+var errWaitUnsupported = errors.New("server does not support waiting for lock changes")
+
+// errLeaseLost is the cause of a run being cancelled because its lock
+// lease expired or was taken by another client
+var errLeaseLost = errors.New("workspace lock lease was lost")
+
+// WaitForLockChange long-polls the server until the workspace lock is no
+// longer held exclusively by holder (empty for unlocked) with the given
+// number of shared holders, or the timeout elapses.
+func (w *Workspace) WaitForLockChange(holder string, readers int, timeout time.Duration) (LockState, error) {
+	l := log.WithFields(log.Fields{
+		"app":    "monotf",
+		"fn":     "WaitForLockChange",
+		"ws":     w.Name,
+		"holder": holder,
+	})
+	var s LockState
+	q := url.Values{}
+	q.Set("holder", holder)
+	q.Set("readers", strconv.Itoa(readers))
+	if w.LockId != nil {
+		q.Set("lock_id", *w.LockId)
+	}
+	if timeout > 0 {
+		q.Set("timeout", timeout.String())
+	}
+	resp, err := w.serverRequest("GET", "/ws/"+w.Org+"/"+w.Name+"/wait?"+q.Encode(), nil)
+	if err != nil {
+		l.Errorf("error waiting for lock change: %v", err)
+		return s, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return s, errWaitUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error waiting for lock change: %s: %s", resp.Status, string(bd))
+		return s, fmt.Errorf("error waiting for lock change: %s: %s", resp.Status, string(bd))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		l.Errorf("error decoding lock state: %v", err)
+		return s, err
+	}
+	return s, nil
+}
+
+func (w *Workspace) waitForReady(timeout time.Duration) error {
+	l := log.WithFields(log.Fields{
+		"app":     "monotf",
+		"fn":      "waitForReady",
+		"ws":      w.Name,
+		"timeout": timeout,
+	})
 	l.Debugf("waiting for workspace %s to be ready for %s", w.Name, timeout)
 	start := time.Now()
+	var remaining time.Duration
+	var current LockState
+	poll := false
 	for {
-		if timeout > 0 && time.Since(start) > timeout {
-			l.Errorf("timeout waiting for workspace %s to be ready", w.Name)
-			return fmt.Errorf("timeout waiting for workspace %s to be ready", w.Name)
+		if timeout > 0 {
+			remaining = timeout - time.Since(start)
+			if remaining <= 0 {
+				l.Errorf("timeout waiting for workspace %s to be ready", w.Name)
+				return fmt.Errorf("timeout waiting for workspace %s to be ready", w.Name)
+			}
+		}
+		if !poll {
+			s, err := w.WaitForLockChange(current.holder(), current.Readers, remaining)
+			if err == nil {
+				if !s.Running {
+					l.Debugf("workspace %s is ready", w.Name)
+					return nil
+				}
+				current = s
+				l.Debugf("workspace %s is locked by %s", w.Name, current.holder())
+				continue
+			}
+			if !errors.Is(err, errWaitUnsupported) {
+				return err
+			}
+			l.Debug("server does not support waiting, falling back to polling")
+			poll = true
 		}
 		wss, err := w.GetStatus()
 		if err != nil {
@@ -680,12 +922,11 @@ func (w *Workspace) WaitForReady(timeoutStr string) error {
 		// wait for running to not be true
 		if wss.Running == nil || !*wss.Running {
 			l.Debugf("workspace %s is ready", w.Name)
-			break
+			return nil
 		}
 		l.Debugf("workspace %s is not ready", w.Name)
 		time.Sleep(10 * time.Second)
 	}
-	return nil
 }
 
 func (w *Workspace) SaveRemote() error {
@@ -730,183 +971,1668 @@ func (w *Workspace) SaveRemote() error {
 	return nil
 }
 
-func (w *Workspace) SetRunning(running bool) error {
-	l := log.WithFields(log.Fields{
-		"app": "monotf",
-		"fn":  "SetRunning",
-		"ws":  w.Name,
-		"run": running,
-	})
-	l.Debugf("locking workspace %s", w.Name)
-	w.Running = &running
-	if w.Running == nil || !*w.Running {
-		w.LockId = nil
+// serverRequest sends a request with an optional json body to the monotf server
+func (w *Workspace) serverRequest(method, path string, body interface{}) (*http.Response, error) {
+	return w.tokenRequest(method, path, w.MonotfToken(), body)
+}
+
+// adminRequest sends a request to the monotf server like serverRequest,
+// authorized with MONOTF_ADMIN_TOKEN if set
+func (w *Workspace) adminRequest(method, path string, body interface{}) (*http.Response, error) {
+	tokenVar := os.Getenv("MONOTF_ADMIN_TOKEN")
+	if tokenVar == "" {
+		tokenVar = w.MonotfToken()
+	}
+	return w.tokenRequest(method, path, tokenVar, body)
+}
+
+// tokenRequest sends a request with an optional json body to the monotf
+// server, authorized with tokenVar if set
+func (w *Workspace) tokenRequest(method, path, tokenVar string, body interface{}) (*http.Response, error) {
+	var rb io.Reader
+	if body != nil {
+		bd, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rb = strings.NewReader(string(bd))
 	}
-	if err := w.SaveRemote(); err != nil {
-		l.Errorf("error saving workspace: %v", err)
-		return err
+	req, err := http.NewRequest(method, M.ServerAddr+path, rb)
+	if err != nil {
+		return nil, err
 	}
-	l.Debugf("workspace %s %t", w.Name, running)
-	return nil
+	req.Header.Set("Content-Type", "application/json")
+	if tokenVar != "" {
+		req.Header.Set("Authorization", "token "+tokenVar)
+	}
+	client := &http.Client{}
+	return client.Do(req)
 }
 
-func (w *Workspace) SetOutput() error {
-	l := log.WithFields(log.Fields{
-		"app": "monotf",
-		"fn":  "SetOutput",
-		"ws":  w.Name,
+var (
+	lockOwnerOnce sync.Once
+	lockOwner     *LockOwner
+)
+
+// currentLockOwner describes this run, to be recorded on the locks it holds
+func currentLockOwner() *LockOwner {
+	lockOwnerOnce.Do(func() {
+		o := &LockOwner{}
+		o.Hostname, _ = os.Hostname()
+		if u, err := user.Current(); err == nil {
+			o.User = u.Username
+		} else {
+			o.User = os.Getenv("USER")
+		}
+		if len(os.Args) > 0 {
+			o.Command = strings.Join(append([]string{filepath.Base(os.Args[0])}, os.Args[1:]...), " ")
+		}
+		switch {
+		case os.Getenv("MONOTF_RUN_URL") != "":
+			o.RunURL = os.Getenv("MONOTF_RUN_URL")
+		case os.Getenv("GITHUB_RUN_ID") != "":
+			o.RunURL = fmt.Sprintf("%s/%s/actions/runs/%s",
+				os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID"))
+		case os.Getenv("CI_JOB_URL") != "":
+			o.RunURL = os.Getenv("CI_JOB_URL")
+		case os.Getenv("BUILD_URL") != "":
+			o.RunURL = os.Getenv("BUILD_URL")
+		}
+		for _, k := range []string{"MONOTF_GIT_SHA", "GITHUB_SHA", "CI_COMMIT_SHA", "GIT_COMMIT"} {
+			if v := os.Getenv(k); v != "" {
+				o.GitSHA = v
+				break
+			}
+		}
+		if o.GitSHA == "" && M != nil {
+			if out, err := exec.Command("git", "-C", M.RepoDir, "rev-parse", "HEAD").Output(); err == nil {
+				o.GitSHA = strings.TrimSpace(string(out))
+			}
+		}
+		lockOwner = o
 	})
-	l.Debugf("setting output for workspace %s", w.Name)
-	if err := w.SaveRemote(); err != nil {
-		l.Errorf("error saving workspace: %v", err)
-		return err
-	}
-	l.Debugf("output set for workspace %s", w.Name)
-	return nil
+	return lockOwner
 }
 
-func (ws *Workspace) LockedTerraform(waitTimeout *string, args []string) (string, string, error) {
+// TryLock makes a single attempt to acquire the workspace lock on the server.
+// If the lock is held by another run, it returns false along with the current holder.
+func (w *Workspace) TryLock() (bool, *LockResult, error) {
 	l := log.WithFields(log.Fields{
 		"app": "monotf",
-		"fn":  "LockedTerraform",
-		"ws":  ws.Name,
-		"ver": ws.Version,
+		"fn":  "TryLock",
+		"ws":  w.Name,
 	})
-	if err := ws.TerraformWorkspacePreflight(); err != nil {
-		l.Errorf("error running terraform preflight: %v", err)
-		os.Exit(1)
-	}
-	lid := uuid.New().String()
-	ws.LockId = &lid
-	var stdoutstr, stderrstr string
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	cleanup := func() {
-		if err := ws.SetRunning(false); err != nil {
-			l.Errorf("error setting workspace to not running: %v", err)
-			return
-		}
-	}
-	go func() {
-		sig := <-sigs
-		l.Debugf("Received signal: %s, stopping services...", sig)
-		cleanup()
-		os.Exit(0)
-	}()
-	defer cleanup()
-	if err := ws.WaitForReady(*waitTimeout); err != nil {
-		l.Errorf("error waiting for workspace to be ready: %v", err)
-		return stdoutstr, stderrstr, err
-	}
-	if err := ws.SetRunning(true); err != nil {
-		l.Errorf("error setting workspace to running: %v", err)
-		return stdoutstr, stderrstr, err
-	}
-	var err error
-	stdoutstr, stderrstr, err = ws.Terraform(args)
+	l.Debugf("acquiring lock for workspace %s", w.Name)
+	if w.LockId == nil {
+		lid := uuid.New().String()
+		w.LockId = &lid
+	}
+	lr := LockRequest{
+		LockId:        *w.LockId,
+		WorkspaceName: w.WorkspaceName,
+		Version:       w.Version,
+		TTL:           M.LockTTL,
+		Mode:          w.lockMode,
+		PathVars:      w.pathVarMap(),
+		Owner:         currentLockOwner(),
+		Priority:      M.lockPriority(),
+		Preemptible:   w.preemptible,
+		Path:          w.relPath(),
+		BreakGlass:    M.BreakGlass,
+	}
+	request := w.serverRequest
+	if M.BreakGlass != "" {
+		// breaking a freeze requires the role of the admin token
+		request = w.adminRequest
+	}
+	resp, err := request("POST", "/ws/"+w.Org+"/"+w.Name+"/lock", lr)
 	if err != nil {
-		l.Errorf("error running terraform: %v", err)
-		return stdoutstr, stderrstr, err
+		l.Errorf("error acquiring lock: %v", err)
+		return false, nil, err
 	}
-	if log.GetLevel() == log.DebugLevel {
-		l.Debugf("stdout: %s", stdoutstr)
-		l.Debugf("stderr: %s", stderrstr)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusLocked {
+		bd, _ := io.ReadAll(resp.Body)
+		return false, nil, errors.New(string(bd))
 	}
-	if err := ws.SetOutput(); err != nil {
-		l.Errorf("error setting workspace output: %v", err)
-		return stdoutstr, stderrstr, err
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error acquiring lock: %s: %s", resp.Status, string(bd))
+		return false, nil, fmt.Errorf("error acquiring lock: %s: %s", resp.Status, string(bd))
 	}
-	stat, err := ws.GetStatus()
-	if err != nil {
-		l.Errorf("error getting workspace status: %v", err)
-		return stdoutstr, stderrstr, err
+	res := &LockResult{}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		l.Errorf("error decoding lock result: %v", err)
+		return false, nil, err
 	}
-	l.Debugf("workspace status is %s", stat.Status)
-	if stat.Status == WorkspaceStatusFailed {
-		l.Errorf("workspace status is failed")
-		return stdoutstr, stderrstr, fmt.Errorf("workspace status is failed")
+	if res.Acquired && w.lockMode != LockModeShared {
+		running := true
+		w.Running = &running
 	}
-	return stdoutstr, stderrstr, nil
+	return res.Acquired, res, nil
 }
 
-func (ws *Workspace) LockedTerraformSpeculativePlan(waitTimeout *string, args []string) (string, string, error) {
-	l := log.WithFields(log.Fields{
-		"app": "monotf",
-		"fn":  "LockedTerraformSpeculativePlan",
-		"ws":  ws.Name,
-		"ver": ws.Version,
-	})
-	l.Debugf("running terraform speculative plan")
-	var stdoutstr, stderrstr string
-	var err error
-	// get the current status
-	stat, err := ws.GetStatus()
-	if err != nil {
-		l.Errorf("error getting workspace status: %v", err)
-		return stdoutstr, stderrstr, err
+// lockPriority returns the configured lock priority
+func (m *Monotf) lockPriority() LockPriority {
+	p, _ := ParseLockPriority(m.Priority)
+	return p
+}
+
+// limitRetryInterval is how often a client blocked by a concurrency limit
+// retries the lock
+const limitRetryInterval = 5 * time.Second
+
+// sleepFor sleeps for d, or for remaining if it is shorter and not 0
+func sleepFor(d, remaining time.Duration) {
+	if remaining > 0 && remaining < d {
+		d = remaining
 	}
-	l.Debugf("workspace status is %s", stat.Status)
-	// run terraform plan
-	stdoutstr, stderrstr, err = ws.LockedTerraform(waitTimeout, args)
-	if err != nil {
-		l.Errorf("error running terraform: %v", err)
-		return stdoutstr, stderrstr, err
+	time.Sleep(d)
+}
+
+// pathVarMap returns the path vars of the workspace by key
+func (w *Workspace) pathVarMap() map[string]string {
+	if len(w.PathVars) == 0 {
+		return nil
 	}
-	// set the status back to the original
-	ws.Status = stat.Status
-	ws.Output = stat.Output
-	if err := ws.SaveRemote(); err != nil {
-		l.Errorf("error saving workspace: %v", err)
+	pv := make(map[string]string)
+	for _, v := range w.PathVars {
+		if v.Key != "" {
+			pv[v.Key] = v.Value
+		}
 	}
-	return stdoutstr, stderrstr, err
+	return pv
 }
 
-func (ws *Workspace) LockedTerraformPlanApply(waitTimeout *string) (string, string, error) {
+// Lock blocks until the workspace lock is acquired or the timeout elapses.
+// A timeout of 0 waits indefinitely.
+func (w *Workspace) Lock(timeoutStr string) error {
 	l := log.WithFields(log.Fields{
-		"app": "monotf",
-		"fn":  "LockedTerraformPlanApply",
-		"ws":  ws.Name,
-		"ver": ws.Version,
+		"app":     "monotf",
+		"fn":      "Lock",
+		"ws":      w.Name,
+		"timeout": timeoutStr,
 	})
-	l.Debugf("running terraform plan apply")
-	var stdoutstr, stderrstr string
-	var err error
-	// run a plan, writing the plan file to a temp file
-	// if the plan is successful, then run an apply using that plan file
-	outFile, err := os.CreateTemp("", "monotf-plan-*.tfplan")
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil {
+		l.Errorf("error parsing timeout %s: %v", timeoutStr, err)
+		return err
+	}
+	start := time.Now()
+	for {
+		acquired, res, err := w.TryLock()
+		if err != nil {
+			return err
+		}
+		if acquired {
+			l.Debugf("workspace %s locked with %s", w.Name, *w.LockId)
+			w.startHeartbeat()
+			return nil
+		}
+		l.Infof("workspace %s is queued: %s", w.Name, res.Queue.String())
+		var remaining time.Duration
+		if timeout > 0 {
+			remaining = timeout - time.Since(start)
+			if remaining <= 0 {
+				l.Errorf("timeout waiting for workspace %s lock", w.Name)
+				// give up the place in the queue, so that the requests
+				// behind it are not held up
+				if err := w.Unlock(); err != nil {
+					l.Errorf("error leaving lock queue: %v", err)
+				}
+				return fmt.Errorf("timeout waiting for workspace %s lock", w.Name)
+			}
+		}
+		if res.Queue.BlockedBy != "" {
+			// a concurrency limit is freed by other workspaces, so poll for it
+			sleepFor(limitRetryInterval, remaining)
+			continue
+		}
+		// wait for the lock state to change from what we last saw before trying again
+		current := res.Workspace.lockState()
+		if _, err := w.WaitForLockChange(current.holder(), current.Readers, remaining); errors.Is(err, errWaitUnsupported) {
+			time.Sleep(10 * time.Second)
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// RenewLeaseRemote extends the lease on the lock held by this run, and
+// returns true if the server has asked the run to give up the lock
+func (w *Workspace) RenewLeaseRemote() (bool, error) {
+	if w.LockId == nil {
+		return false, fmt.Errorf("workspace %s is not locked", w.Name)
+	}
+	return w.renewLease(*w.LockId)
+}
+
+// renewLease extends the lease on the lock with the given id. It returns
+// an error wrapping errLeaseLost if the server no longer holds the lock
+// for this run.
+func (w *Workspace) renewLease(lockId string) (bool, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "renewLease",
+		"ws":  w.Name,
+	})
+	lr := LockRequest{
+		LockId: lockId,
+		TTL:    M.LockTTL,
+	}
+	resp, err := w.serverRequest("POST", "/ws/"+w.Org+"/"+w.Name+"/lock/heartbeat", lr)
+	if err != nil {
+		l.Errorf("error renewing lock: %v", err)
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error renewing lock: %s: %s", resp.Status, string(bd))
+		return false, fmt.Errorf("%w: %s", errLeaseLost, string(bd))
+	}
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error renewing lock: %s: %s", resp.Status, string(bd))
+		return false, fmt.Errorf("error renewing lock: %s: %s", resp.Status, string(bd))
+	}
+	var res LockRenewal
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		l.Errorf("error decoding lock renewal: %v", err)
+		return false, err
+	}
+	return res.Preempted, nil
+}
+
+// preemptCheckInterval is the longest a preemptible run waits between
+// heartbeats, so that it gives way to a higher priority run promptly
+const preemptCheckInterval = 15 * time.Second
+
+// startHeartbeat renews the lock lease in the background until the lock is
+// released. If the run is preemptible and the server asks for the lock back,
+// the running terraform command is cancelled. If the lease is lost, or
+// cannot be renewed before it expires, the running terraform command
+// is cancelled and the run fails, since another client may now hold the lock.
+func (w *Workspace) startHeartbeat() {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "startHeartbeat",
+		"ws":  w.Name,
+	})
+	ttl := LockRequest{TTL: M.LockTTL}.leaseTTL()
+	interval := ttl / 3
+	if w.preemptible && interval > preemptCheckInterval {
+		interval = preemptCheckInterval
+	}
+	l.Debugf("renewing lock lease every %s", interval)
+	stop := make(chan struct{})
+	w.stopHeartbeat = stop
+	if w.runCtx == nil || w.runCtx.Err() != nil {
+		w.runCtx, w.cancelRun = context.WithCancelCause(context.Background())
+	}
+	cancel := w.cancelRun
+	// the lock id is captured as Unlock clears it while the heartbeat stops
+	lockId := *w.LockId
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		renewed := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				preempted, err := w.renewLease(lockId)
+				if err != nil {
+					// the lease expires a ttl after it was last renewed
+					if errors.Is(err, errLeaseLost) || time.Since(renewed) >= ttl {
+						l.Errorf("lost lock lease on workspace %s, cancelling: %v", w.Name, err)
+						cancel(errLeaseLost)
+						return
+					}
+					l.Errorf("error renewing lock lease: %v", err)
+					continue
+				}
+				renewed = time.Now()
+				if preempted && w.preemptible {
+					l.Warnf("a higher priority run is waiting for workspace %s, cancelling", w.Name)
+					cancel(nil)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (w *Workspace) stopLockHeartbeat() {
+	if w.stopHeartbeat != nil {
+		close(w.stopHeartbeat)
+		w.stopHeartbeat = nil
+	}
+}
+
+// Unlock releases the workspace lock held by this run
+func (w *Workspace) Unlock() error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "Unlock",
+		"ws":  w.Name,
+	})
+	if w.LockId == nil {
+		l.Debugf("workspace %s is not locked", w.Name)
+		return nil
+	}
+	w.stopLockHeartbeat()
+	l.Debugf("releasing lock %s for workspace %s", *w.LockId, w.Name)
+	resp, err := w.serverRequest("DELETE", "/ws/"+w.Org+"/"+w.Name+"/lock?lock_id="+*w.LockId, nil)
+	if err != nil {
+		l.Errorf("error releasing lock: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error releasing lock: %s: %s", resp.Status, string(bd))
+		return fmt.Errorf("error releasing lock: %s: %s", resp.Status, string(bd))
+	}
+	running := false
+	w.Running = &running
+	w.LockId = nil
+	return nil
+}
+
+// WorkspaceSet is a set of workspaces which are locked together, for
+// changes which must be rolled out across all of them at once
+type WorkspaceSet []*Workspace
+
+// lockSetRequest returns the lock set request for the workspaces in the set,
+// creating a lock id for each workspace which does not have one
+func (s WorkspaceSet) lockSetRequest() LockSetRequest {
+	var req LockSetRequest
+	for _, w := range s {
+		if w.LockId == nil {
+			lid := uuid.New().String()
+			w.LockId = &lid
+		}
+		req.Locks = append(req.Locks, LockSetMember{
+			Org:  w.Org,
+			Name: w.Name,
+			LockRequest: LockRequest{
+				LockId:        *w.LockId,
+				WorkspaceName: w.WorkspaceName,
+				Version:       w.Version,
+				TTL:           M.LockTTL,
+				Mode:          w.lockMode,
+				PathVars:      w.pathVarMap(),
+				Owner:         currentLockOwner(),
+				Priority:      M.lockPriority(),
+				Preemptible:   w.preemptible,
+				Path:          w.relPath(),
+				BreakGlass:    M.BreakGlass,
+			},
+		})
+	}
+	return req
+}
+
+// workspace returns the workspace in the set with the given name
+func (s WorkspaceSet) workspace(name string) *Workspace {
+	for _, w := range s {
+		if w.Name == name {
+			return w
+		}
+	}
+	return nil
+}
+
+// TryLock makes a single attempt to acquire the locks of all workspaces in
+// the set on the server. Either all locks are acquired, or none are.
+func (s WorkspaceSet) TryLock() (bool, *LockSetResult, error) {
+	l := log.WithFields(log.Fields{
+		"app":  "monotf",
+		"fn":   "WorkspaceSet.TryLock",
+		"size": len(s),
+	})
+	if len(s) == 0 {
+		return false, nil, fmt.Errorf("workspace set is empty")
+	}
+	l.Debugf("acquiring locks for %d workspaces", len(s))
+	request := s[0].serverRequest
+	if M.BreakGlass != "" {
+		request = s[0].adminRequest
+	}
+	resp, err := request("POST", "/locks", s.lockSetRequest())
+	if err != nil {
+		l.Errorf("error acquiring locks: %v", err)
+		return false, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusLocked {
+		bd, _ := io.ReadAll(resp.Body)
+		return false, nil, errors.New(string(bd))
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error acquiring locks: %s: %s", resp.Status, string(bd))
+		return false, nil, fmt.Errorf("error acquiring locks: %s: %s", resp.Status, string(bd))
+	}
+	res := &LockSetResult{}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		l.Errorf("error decoding lock set result: %v", err)
+		return false, nil, err
+	}
+	if res.Acquired {
+		for _, w := range s {
+			if w.lockMode != LockModeShared {
+				running := true
+				w.Running = &running
+			}
+		}
+	}
+	return res.Acquired, res, nil
+}
+
+// Lock blocks until the locks of all workspaces in the set are acquired or
+// the timeout elapses. A timeout of 0 waits indefinitely.
+func (s WorkspaceSet) Lock(timeoutStr string) error {
+	l := log.WithFields(log.Fields{
+		"app":     "monotf",
+		"fn":      "WorkspaceSet.Lock",
+		"size":    len(s),
+		"timeout": timeoutStr,
+	})
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil {
+		l.Errorf("error parsing timeout %s: %v", timeoutStr, err)
+		return err
+	}
+	start := time.Now()
+	for {
+		acquired, res, err := s.TryLock()
+		if err != nil {
+			return err
+		}
+		if acquired {
+			for _, w := range s {
+				l.Debugf("workspace %s locked with %s", w.Name, *w.LockId)
+				w.startHeartbeat()
+			}
+			return nil
+		}
+		// wait on the first workspace which is held, or the first in the
+		// set if the set is only waiting behind other queued requests
+		blocking := res.Locks[0].Workspace
+		held, limited := false, false
+		for _, lr := range res.Locks {
+			l.Infof("workspace %s is queued: %s", lr.Workspace.Name, lr.Queue.String())
+			limited = limited || lr.Queue.BlockedBy != ""
+			if st := lr.Workspace.lockState(); !held && (st.holder() != "" || st.Readers > 0) {
+				blocking = lr.Workspace
+				held = true
+			}
+		}
+		var remaining time.Duration
+		if timeout > 0 {
+			remaining = timeout - time.Since(start)
+			if remaining <= 0 {
+				l.Errorf("timeout waiting for workspace set lock")
+				if err := s.Unlock(); err != nil {
+					l.Errorf("error leaving lock queue: %v", err)
+				}
+				return fmt.Errorf("timeout waiting for workspace set lock")
+			}
+		}
+		if limited && !held {
+			// a concurrency limit is freed by other workspaces, so poll for it
+			sleepFor(limitRetryInterval, remaining)
+			continue
+		}
+		w := s.workspace(blocking.Name)
+		if w == nil {
+			return fmt.Errorf("workspace %s is not in the set", blocking.Name)
+		}
+		current := blocking.lockState()
+		if _, err := w.WaitForLockChange(current.holder(), current.Readers, remaining); errors.Is(err, errWaitUnsupported) {
+			time.Sleep(10 * time.Second)
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Unlock releases the locks of all workspaces in the set held by this run
+func (s WorkspaceSet) Unlock() error {
+	l := log.WithFields(log.Fields{
+		"app":  "monotf",
+		"fn":   "WorkspaceSet.Unlock",
+		"size": len(s),
+	})
+	var held WorkspaceSet
+	for _, w := range s {
+		if w.LockId != nil {
+			w.stopLockHeartbeat()
+			held = append(held, w)
+		}
+	}
+	if len(held) == 0 {
+		l.Debugf("workspace set is not locked")
+		return nil
+	}
+	l.Debugf("releasing locks for %d workspaces", len(held))
+	resp, err := held[0].serverRequest("POST", "/locks/release", held.lockSetRequest())
+	if err != nil {
+		l.Errorf("error releasing locks: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error releasing locks: %s: %s", resp.Status, string(bd))
+		return fmt.Errorf("error releasing locks: %s: %s", resp.Status, string(bd))
+	}
+	for _, w := range held {
+		running := false
+		w.Running = &running
+		w.LockId = nil
+	}
+	return nil
+}
+
+// LockedTerraform runs a terraform command in each workspace of the set in
+// turn, while holding the locks of all of them. It stops at the first
+// workspace which fails.
+func (s WorkspaceSet) LockedTerraform(waitTimeout *string, args []string) error {
+	l := log.WithFields(log.Fields{
+		"app":  "monotf",
+		"fn":   "WorkspaceSet.LockedTerraform",
+		"size": len(s),
+	})
+	overridden := make(map[string]string)
+	for _, ws := range s {
+		if err := ws.TerraformWorkspacePreflight(); err != nil {
+			l.Errorf("error running terraform preflight for workspace %s: %v", ws.Name, err)
+			os.Exit(1)
+		}
+		command, err := ws.checkProtection(args)
+		if err != nil {
+			l.Errorf("error running terraform: %v", err)
+			return err
+		}
+		overridden[ws.Name] = command
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	cleanup := func() {
+		if err := s.Unlock(); err != nil {
+			l.Errorf("error unlocking workspaces: %v", err)
+			return
+		}
+	}
+	go func() {
+		sig := <-sigs
+		l.Debugf("Received signal: %s, stopping services...", sig)
+		cleanup()
+		os.Exit(0)
+	}()
+	defer cleanup()
+	if err := s.Lock(*waitTimeout); err != nil {
+		l.Errorf("error locking workspaces: %v", err)
+		return err
+	}
+	for _, ws := range s {
+		if overridden[ws.Name] != "" {
+			if err := ws.RecordOverrideRemote(overridden[ws.Name]); err != nil {
+				l.Errorf("error recording override: %v", err)
+				return err
+			}
+		}
+	}
+	for _, ws := range s {
+		l.Infof("running terraform in workspace %s", ws.Name)
+		if _, _, err := ws.TerraformRun(args, false); err != nil {
+			l.Errorf("error running terraform in workspace %s: %v", ws.Name, err)
+			return err
+		}
+		stat, err := ws.GetStatus()
+		if err != nil {
+			l.Errorf("error getting workspace status: %v", err)
+			return err
+		}
+		l.Debugf("workspace %s status is %s", ws.Name, stat.Status)
+		if stat.Status == WorkspaceStatusFailed {
+			l.Errorf("workspace %s status is failed", ws.Name)
+			return fmt.Errorf("workspace %s status is failed", ws.Name)
+		}
+	}
+	return nil
+}
+
+// ForceUnlockRemote releases the workspace lock on the server regardless of
+// its holder, recording the reason. MONOTF_ADMIN_TOKEN is used to authorize
+// the request if set.
+func (w *Workspace) ForceUnlockRemote(reason string) (Workspace, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "ForceUnlockRemote",
+		"ws":  w.Name,
+	})
+	var rw Workspace
+	resp, err := w.adminRequest("POST", "/ws/"+w.Org+"/"+w.Name+"/unlock", ForceUnlockRequest{
+		Reason: reason,
+	})
+	if err != nil {
+		l.Errorf("error force-unlocking workspace: %v", err)
+		return rw, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return rw, fmt.Errorf("workspace %s is not locked", w.Name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error force-unlocking workspace: %s: %s", resp.Status, string(bd))
+		return rw, fmt.Errorf("error force-unlocking workspace: %s: %s", resp.Status, string(bd))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rw); err != nil {
+		l.Errorf("error decoding workspace: %v", err)
+		return rw, err
+	}
+	return rw, nil
+}
+
+func (w *Workspace) SetOutput() error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "SetOutput",
+		"ws":  w.Name,
+	})
+	l.Debugf("setting output for workspace %s", w.Name)
+	if err := w.SaveRemote(); err != nil {
+		l.Errorf("error saving workspace: %v", err)
+		return err
+	}
+	l.Debugf("output set for workspace %s", w.Name)
+	return nil
+}
+
+// errRunsUnsupported is returned by the run endpoints of servers which
+// predate run history
+var errRunsUnsupported = errors.New("server does not support runs")
+
+// StartRunRemote records the start of a terraform run on the server
+func (w *Workspace) StartRunRemote(args []string, speculative bool) (*Run, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "StartRunRemote",
+		"ws":  w.Name,
+	})
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	run := &Run{
+		LockId:      w.LockId,
+		Command:     command,
+		Args:        args,
+		Version:     w.Version,
+		GitSha:      gitSha(),
+		Speculative: speculative,
+		PlanRunId:   w.planRunId,
+		Owner:       currentLockOwner(),
+	}
+	resp, err := w.serverRequest("POST", "/ws/"+w.Org+"/"+w.Name+"/runs", run)
+	if err != nil {
+		l.Errorf("error starting run: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return nil, errRunsUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error starting run: %s: %s", resp.Status, string(bd))
+		return nil, fmt.Errorf("error starting run: %s: %s", resp.Status, string(bd))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(run); err != nil {
+		l.Errorf("error decoding run: %v", err)
+		return nil, err
+	}
+	return run, nil
+}
+
+// FinishRunRemote records the result and output of the run on the server,
+// and sets the workspace status to the status of the run
+func (w *Workspace) FinishRunRemote(run *Run, rr RunResult) error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "FinishRunRemote",
+		"ws":  w.Name,
+		"run": run.ID,
+	})
+	rr.Output = w.Output
+	if run.LockId != nil {
+		rr.LockId = *run.LockId
+	}
+	resp, err := w.serverRequest("PUT", fmt.Sprintf("/ws/%s/%s/runs/%d", w.Org, w.Name, run.ID), rr)
+	if err != nil {
+		l.Errorf("error finishing run: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error finishing run: %s: %s", resp.Status, string(bd))
+		return fmt.Errorf("error finishing run: %s: %s", resp.Status, string(bd))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(run); err != nil {
+		l.Errorf("error decoding run: %v", err)
+		return err
+	}
+	w.Status = run.Status
+	return nil
+}
+
+// exitCode returns the exit code of a command which returned err
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	return -1
+}
+
+// gitSha returns the commit checked out in the repository, or empty if it
+// is not a git repository
+func gitSha() string {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = M.RepoDir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// UploadPlanRemote stores the plan file of the run on the server, so that it
+// can be applied later with LockedTerraformApplyPlan
+func (w *Workspace) UploadPlanRemote(run *Run, planFile string) error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "UploadPlanRemote",
+		"ws":  w.Name,
+		"run": run.ID,
+	})
+	f, err := os.Open(planFile)
+	if err != nil {
+		l.Errorf("error opening plan file: %v", err)
+		return err
+	}
+	defer f.Close()
+	path := fmt.Sprintf("/ws/%s/%s/runs/%d/plan", w.Org, w.Name, run.ID)
+	if run.LockId != nil {
+		path += "?lock_id=" + url.QueryEscape(*run.LockId)
+	}
+	req, err := http.NewRequest("PUT", M.ServerAddr+path, f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if tokenVar := w.MonotfToken(); tokenVar != "" {
+		req.Header.Set("Authorization", "token "+tokenVar)
+	}
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		l.Errorf("error uploading plan: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error uploading plan: %s: %s", resp.Status, string(bd))
+		return fmt.Errorf("error uploading plan: %s: %s", resp.Status, string(bd))
+	}
+	l.Debugf("stored plan of run %d", run.ID)
+	return nil
+}
+
+// DownloadPlanRemote writes the stored plan file of the run to planFile. The
+// server refuses plans which are stale.
+func (w *Workspace) DownloadPlanRemote(id uint, planFile string) error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "DownloadPlanRemote",
+		"ws":  w.Name,
+		"run": id,
+	})
+	resp, err := w.serverRequest("GET", fmt.Sprintf("/ws/%s/%s/runs/%d/plan", w.Org, w.Name, id), nil)
+	if err != nil {
+		l.Errorf("error downloading plan: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error downloading plan: %s: %s", resp.Status, string(bd))
+		return fmt.Errorf("error downloading plan: %s: %s", resp.Status, string(bd))
+	}
+	f, err := os.Create(planFile)
+	if err != nil {
+		l.Errorf("error creating plan file: %v", err)
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		l.Errorf("error writing plan file: %v", err)
+		return err
+	}
+	return f.Close()
+}
+
+// startRun records the start of a run of a terraform command with args,
+// and streams its output to the server. It returns nil if the server does
+// not support runs.
+func (w *Workspace) startRun(args []string, speculative bool) (*Run, error) {
+	run, err := w.StartRunRemote(args, speculative)
+	if errors.Is(err, errRunsUnsupported) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	w.logStream = w.newRunLogStreamer(run)
+	return run, nil
+}
+
+// finishRun records the result of the run, and sets the status of the
+// workspace. Servers without run history are sent the output of the
+// command, unless it failed without a status, as before.
+func (w *Workspace) finishRun(run *Run, rr RunResult, speculative bool) error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "finishRun",
+		"ws":  w.Name,
+	})
+	if w.logStream != nil {
+		w.logStream.Close()
+		w.logStream = nil
+	}
+	w.Status = rr.Status
+	if run == nil {
+		if speculative || (rr.Status == "" && rr.ExitCode != 0) {
+			return nil
+		}
+		if err := w.SetOutput(); err != nil {
+			l.Errorf("error setting workspace output: %v", err)
+			return err
+		}
+		return nil
+	}
+	if err := w.FinishRunRemote(run, rr); err != nil {
+		l.Errorf("error recording run: %v", err)
+		return err
+	}
+	l.Debugf("run %d finished with status %s", run.ID, run.Status)
+	return nil
+}
+
+// TerraformRun runs a terraform command and records it in the run history
+// of the workspace. The status of the run is inferred by the server from
+// its exit code and output.
+func (w *Workspace) TerraformRun(args []string, speculative bool) (string, string, error) {
+	run, err := w.startRun(args, speculative)
+	if err != nil {
+		return "", "", err
+	}
+	stdoutstr, stderrstr, tfErr := w.Terraform(args)
+	if err := w.finishRun(run, RunResult{ExitCode: exitCode(tfErr)}, speculative); err != nil && tfErr == nil {
+		return stdoutstr, stderrstr, err
+	}
+	return stdoutstr, stderrstr, tfErr
+}
+
+// TerraformPlan runs a plan with -detailed-exitcode, writing the plan to
+// planFile, and records it in the run history of the workspace. The status
+// of the run is taken from the exit code, and its changes from the plan.
+// A plan with changes does not return an error.
+func (w *Workspace) TerraformPlan(planFile string, speculative bool) (RunResult, string, string, error) {
+	args := []string{"plan", "-detailed-exitcode", "-out", planFile}
+	return w.terraformPlan(args, planFile, speculative)
+}
+
+// TerraformDrift runs a refresh-only plan with -detailed-exitcode, writing
+// the plan to planFile, and records it in the run history of the workspace
+// as a drift check. The status of the run is drifted if the infrastructure
+// differs from the state, and its changes are the drifted resources.
+func (w *Workspace) TerraformDrift(planFile string) (RunResult, string, string, error) {
+	args := []string{"plan", "-refresh-only", "-detailed-exitcode", "-out", planFile}
+	return w.terraformPlan(args, planFile, false)
+}
+
+// terraformPlan runs a plan with args, which must include
+// -detailed-exitcode and write the plan to planFile
+func (w *Workspace) terraformPlan(args []string, planFile string, speculative bool) (RunResult, string, string, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "terraformPlan",
+		"ws":  w.Name,
+		"ver": w.Version,
+	})
+	drift := isDriftCheck(args)
+	run, err := w.startRun(args, speculative)
+	if err != nil {
+		return RunResult{}, "", "", err
+	}
+	stdoutstr, stderrstr, tfErr := w.Terraform(args)
+	rr := RunResult{ExitCode: exitCode(tfErr)}
+	rr.Status = statusFromExitCode(args, rr.ExitCode)
+	if rr.Status != WorkspaceStatusFailed {
+		tfErr = nil
+		planJSON, changes, resources, err := w.showPlan(planFile, drift)
+		if err != nil {
+			l.Warnf("error reading plan changes: %v", err)
+		}
+		rr.Changes = changes
+		rr.Resources = resources
+		if !drift {
+			rr.PlanJSON = planJSON
+		}
+		if !drift && len(M.Policies) > 0 {
+			rr.Policy = M.EvaluatePolicies(w, changes, resources)
+		}
+		if res, ok := M.protectionResult(w, changes); ok && !drift {
+			// the deletions of a plan which may be applied can be overridden
+			if res.Outcome == PolicyFail && !speculative && M.Override != "" {
+				if err := w.RecordOverrideRemote(res.Message); err != nil {
+					l.Errorf("error recording override: %v", err)
+				} else {
+					res.Outcome = PolicyWarn
+					res.Approval = false
+					res.Message += ", overridden: " + M.Override
+				}
+			}
+			rr.Policy = append(rr.Policy, res)
+		}
+		w.logPolicyResults(rr.Policy)
+	}
+	// store plans with changes, so that they can be applied later
+	stored := false
+	if run != nil && rr.Status == WorkspaceStatusPending && !drift {
+		if err := w.UploadPlanRemote(run, planFile); err != nil {
+			l.Warnf("error storing plan: %v", err)
+		} else {
+			stored = true
+		}
+	}
+	// a stored plan which must be approved awaits approval, and is then
+	// applied as the stored plan so that the server can enforce it
+	needsApproval := w.requireApproval || rr.Policy.NeedsApproval()
+	if stored && !speculative && w.approvalTimeout > 0 {
+		// the timeout is sent with every stored plan, as the server may
+		// require approval under its own policies
+		rr.ApprovalTimeoutSeconds = int(w.approvalTimeout.Seconds())
+		if needsApproval && !rr.Policy.Failed() {
+			rr.Status = WorkspaceStatusAwaitingApproval
+		}
+	}
+	// a drift check only sets the status of the workspace, which servers
+	// without run history cannot do without replacing its output
+	if err := w.finishRun(run, rr, speculative || drift); err != nil && tfErr == nil {
+		return rr, stdoutstr, stderrstr, err
+	}
+	if run != nil && run.FinishedAt != nil && !drift {
+		rr = w.serverPolicyResults(run, rr)
+	}
+	if rr.Status == WorkspaceStatusAwaitingApproval {
+		w.planRunId = &run.ID
+	}
+	return rr, stdoutstr, stderrstr, tfErr
+}
+
+// serverPolicyResults returns the result of the plan run with the policy
+// results and status recorded by the server, which checks the plan against
+// its own policies
+func (w *Workspace) serverPolicyResults(run *Run, rr RunResult) RunResult {
+	if run.Policy.Failed() != rr.Policy.Failed() || run.Policy.NeedsApproval() != rr.Policy.NeedsApproval() {
+		w.logPolicyResults(run.Policy)
+	}
+	rr.Policy = run.Policy
+	if rr.Status == WorkspaceStatusPending || rr.Status == WorkspaceStatusAwaitingApproval {
+		rr.Status = run.Status
+	}
+	return rr
+}
+
+// TerraformApplyPlan applies the plan in planFile, and records it in the
+// run history of the workspace along with the changes of the plan
+func (w *Workspace) TerraformApplyPlan(planFile string, plan RunResult) (RunResult, string, string, error) {
+	args := []string{"apply", "-auto-approve", planFile}
+	run, err := w.startRun(args, false)
+	if err != nil {
+		return RunResult{}, "", "", err
+	}
+	stdoutstr, stderrstr, tfErr := w.Terraform(args)
+	rr := RunResult{
+		ExitCode:  exitCode(tfErr),
+		Status:    WorkspaceStatusApplied,
+		Changes:   plan.Changes,
+		Resources: plan.Resources,
+	}
+	if tfErr != nil {
+		rr.Status = WorkspaceStatusFailed
+	}
+	if err := w.finishRun(run, rr, false); err != nil && tfErr == nil {
+		return rr, stdoutstr, stderrstr, err
+	}
+	return rr, stdoutstr, stderrstr, tfErr
+}
+
+// runLogStreamInterval is how often the output of a running terraform
+// command is sent to the server
+const runLogStreamInterval = 2 * time.Second
+
+// maxRunLogBuffer is the most output kept to send to the server while it
+// cannot be reached. Older output is dropped, as the full output is sent
+// when the run finishes.
+const maxRunLogBuffer = 8 * MaxRunLogChunkSize
+
+// runLogStreamer sends the output of a run to the server in chunks as it
+// is written, so that the run can be followed from other machines
+type runLogStreamer struct {
+	w    *Workspace
+	run  *Run
+	mu   sync.Mutex
+	buf  []byte
+	seq  int
+	warn bool
+	// stopped is set once the server will not accept more output, such
+	// as when the run has finished
+	stopped bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (w *Workspace) newRunLogStreamer(run *Run) *runLogStreamer {
+	s := &runLogStreamer{
+		w:    w,
+		run:  run,
+		warn: true,
+		done: make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(runLogStreamInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.flush()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Write buffers p to be sent with the next chunk
+func (s *runLogStreamer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		s.buf = append(s.buf, p...)
+	}
+	return len(p), nil
+}
+
+// flush sends the buffered output to the server. Output which fails to send
+// because of a server or network error is kept and sent again with the next
+// chunk, up to maxRunLogBuffer. Output which the server rejects is dropped,
+// and if the run is gone or finished, no more output is sent.
+func (s *runLogStreamer) flush() {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "runLogStreamer.flush",
+		"ws":  s.w.Name,
+		"run": s.run.ID,
+	})
+	s.mu.Lock()
+	buf := s.buf
+	s.buf = nil
+	s.mu.Unlock()
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > MaxRunLogChunkSize {
+			n = MaxRunLogChunkSize
+		}
+		path := fmt.Sprintf("/ws/%s/%s/runs/%d/logs?seq=%d", s.w.Org, s.w.Name, s.run.ID, s.seq+1)
+		req, err := http.NewRequest("POST", M.ServerAddr+path, strings.NewReader(string(buf[:n])))
+		if err == nil {
+			req.Header.Set("Content-Type", "text/plain")
+			if tokenVar := s.w.MonotfToken(); tokenVar != "" {
+				req.Header.Set("Authorization", "token "+tokenVar)
+			}
+			client := &http.Client{}
+			var resp *http.Response
+			resp, err = client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+					l.Warnf("server rejected run logs, dropping %d bytes: %s", len(buf), resp.Status)
+					if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict {
+						s.mu.Lock()
+						s.stopped = true
+						s.buf = nil
+						s.mu.Unlock()
+					}
+					return
+				}
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("%s", resp.Status)
+				}
+			}
+		}
+		if err != nil {
+			if s.warn {
+				l.Warnf("error streaming run logs, will retry: %v", err)
+				s.warn = false
+			}
+			s.mu.Lock()
+			s.buf = append(buf, s.buf...)
+			if len(s.buf) > maxRunLogBuffer {
+				s.buf = s.buf[len(s.buf)-maxRunLogBuffer:]
+			}
+			s.mu.Unlock()
+			return
+		}
+		s.seq++
+		buf = buf[n:]
+	}
+}
+
+// Close stops the streamer and sends any remaining output
+func (s *runLogStreamer) Close() {
+	close(s.done)
+	s.wg.Wait()
+	s.flush()
+}
+
+// ListRunsRemote returns the most recent runs of the workspace, newest first
+func (w *Workspace) ListRunsRemote(limit int) ([]Run, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "ListRunsRemote",
+		"ws":  w.Name,
+	})
+	var runs []Run
+	resp, err := w.serverRequest("GET", fmt.Sprintf("/ws/%s/%s/runs?limit=%d", w.Org, w.Name, limit), nil)
+	if err != nil {
+		l.Errorf("error listing runs: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error listing runs: %s: %s", resp.Status, string(bd))
+		return nil, fmt.Errorf("error listing runs: %s: %s", resp.Status, string(bd))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&runs); err != nil {
+		l.Errorf("error decoding runs: %v", err)
+		return nil, err
+	}
+	return runs, nil
+}
+
+// GetRunRemote returns the run of the workspace with the given id
+func (w *Workspace) GetRunRemote(id uint) (*Run, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "GetRunRemote",
+		"ws":  w.Name,
+		"run": id,
+	})
+	resp, err := w.serverRequest("GET", fmt.Sprintf("/ws/%s/%s/runs/%d", w.Org, w.Name, id), nil)
+	if err != nil {
+		l.Errorf("error getting run: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error getting run: %s: %s", resp.Status, string(bd))
+		return nil, fmt.Errorf("error getting run: %s: %s", resp.Status, string(bd))
+	}
+	run := &Run{}
+	if err := json.NewDecoder(resp.Body).Decode(run); err != nil {
+		l.Errorf("error decoding run: %v", err)
+		return nil, err
+	}
+	return run, nil
+}
+
+// WaitForApproval waits for the plan run with id to be approved or rejected,
+// and returns the run. It returns an error if the plan is not decided
+// within timeout.
+func (w *Workspace) WaitForApproval(id uint, timeout time.Duration) (*Run, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "WaitForApproval",
+		"ws":  w.Name,
+		"run": id,
+	})
+	l.Infof("plan run %d is awaiting approval for up to %s, approve with: monotf -w %s -run %d approve",
+		id, timeout, w.relPath(), id)
+	deadline := time.Now().Add(timeout)
+	for {
+		run, err := w.GetRunRemote(id)
+		if err != nil {
+			return nil, err
+		}
+		if run.Approval != ApprovalRequested {
+			return run, nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("plan run %d was not approved within %s", id, timeout)
+		}
+		sleepFor(approvalPollInterval, remaining)
+	}
+}
+
+// DecideRunRemote approves or rejects the plan run with id, recording the
+// comment. MONOTF_ADMIN_TOKEN is used to authorize the request if set.
+func (w *Workspace) DecideRunRemote(id uint, status ApprovalStatus, comment string) (*Run, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "DecideRunRemote",
+		"ws":  w.Name,
+		"run": id,
+	})
+	path := "approve"
+	if status == ApprovalRejected {
+		path = "reject"
+	}
+	resp, err := w.adminRequest("POST", fmt.Sprintf("/ws/%s/%s/runs/%d/%s", w.Org, w.Name, id, path), ApprovalRequest{
+		Comment: comment,
+	})
+	if err != nil {
+		l.Errorf("error deciding approval: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error deciding approval: %s: %s", resp.Status, string(bd))
+		return nil, fmt.Errorf("error deciding approval: %s: %s", resp.Status, string(bd))
+	}
+	run := &Run{}
+	if err := json.NewDecoder(resp.Body).Decode(run); err != nil {
+		l.Errorf("error decoding run: %v", err)
+		return nil, err
+	}
+	return run, nil
+}
+
+// RecordOverrideRemote records on the server that command overrode the
+// protection of the workspace, with the reason given by -override.
+// MONOTF_ADMIN_TOKEN is used to authorize the request if set.
+func (w *Workspace) RecordOverrideRemote(command string) error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "RecordOverrideRemote",
+		"ws":  w.Name,
+	})
+	resp, err := w.adminRequest("POST", "/ws/"+w.Org+"/"+w.Name+"/overrides", ProtectionOverride{
+		LockId:  w.LockId,
+		Command: command,
+		Reason:  M.Override,
+	})
+	if err != nil {
+		l.Errorf("error recording override: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error recording override: %s: %s", resp.Status, string(bd))
+		return fmt.Errorf("error recording override: %s: %s", resp.Status, string(bd))
+	}
+	l.Warnf("overriding the protection of workspace %s for %s: %s", w.Name, command, M.Override)
+	return nil
+}
+
+// ListFreezesRemote returns the freezes on the server. If active is set,
+// only those in effect are returned.
+func ListFreezesRemote(active bool) ([]Freeze, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "ListFreezesRemote",
+	})
+	var w Workspace
+	path := "/freezes"
+	if active {
+		path += "?active=true"
+	}
+	resp, err := w.serverRequest("GET", path, nil)
+	if err != nil {
+		l.Errorf("error listing freezes: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error listing freezes: %s: %s", resp.Status, string(bd))
+		return nil, fmt.Errorf("error listing freezes: %s: %s", resp.Status, string(bd))
+	}
+	var freezes []Freeze
+	if err := json.NewDecoder(resp.Body).Decode(&freezes); err != nil {
+		l.Errorf("error decoding freezes: %v", err)
+		return nil, err
+	}
+	return freezes, nil
+}
+
+// CreateFreezeRemote creates the freeze on the server, recording the
+// current user as its creator. MONOTF_ADMIN_TOKEN is used to authorize the
+// request if set.
+func CreateFreezeRemote(f *Freeze) error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "CreateFreezeRemote",
+	})
+	var w Workspace
+	o := currentLockOwner()
+	f.CreatedBy = o.User + "@" + o.Hostname
+	resp, err := w.adminRequest("POST", "/freezes", f)
+	if err != nil {
+		l.Errorf("error creating freeze: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error creating freeze: %s: %s", resp.Status, string(bd))
+		return fmt.Errorf("error creating freeze: %s: %s", resp.Status, string(bd))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(f); err != nil {
+		l.Errorf("error decoding freeze: %v", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteFreezeRemote deletes the freeze with the given id on the server,
+// lifting it. MONOTF_ADMIN_TOKEN is used to authorize the request if set.
+func DeleteFreezeRemote(id uint) error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "DeleteFreezeRemote",
+	})
+	var w Workspace
+	resp, err := w.adminRequest("DELETE", fmt.Sprintf("/freezes/%d", id), nil)
+	if err != nil {
+		l.Errorf("error deleting freeze: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("freeze %d not found", id)
+	}
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error deleting freeze: %s: %s", resp.Status, string(bd))
+		return fmt.Errorf("error deleting freeze: %s: %s", resp.Status, string(bd))
+	}
+	return nil
+}
+
+// ListTokensRemote returns the API tokens on the server. MONOTF_ADMIN_TOKEN
+// is used to authorize the request if set.
+func ListTokensRemote() ([]APIToken, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "ListTokensRemote",
+	})
+	var w Workspace
+	resp, err := w.adminRequest("GET", "/tokens", nil)
+	if err != nil {
+		l.Errorf("error listing tokens: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error listing tokens: %s: %s", resp.Status, string(bd))
+		return nil, fmt.Errorf("error listing tokens: %s: %s", resp.Status, string(bd))
+	}
+	var tokens []APIToken
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		l.Errorf("error decoding tokens: %v", err)
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// CreateTokenRemote creates the API token on the server, recording the
+// current user as its creator, and sets its secret. MONOTF_ADMIN_TOKEN is
+// used to authorize the request if set.
+func CreateTokenRemote(t *APIToken) error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "CreateTokenRemote",
+	})
+	var w Workspace
+	o := currentLockOwner()
+	t.CreatedBy = o.User + "@" + o.Hostname
+	resp, err := w.adminRequest("POST", "/tokens", t)
 	if err != nil {
-		l.Errorf("error creating plan file: %v", err)
-		return stdoutstr, stderrstr, err
+		l.Errorf("error creating token: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error creating token: %s: %s", resp.Status, string(bd))
+		return fmt.Errorf("error creating token: %s: %s", resp.Status, string(bd))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(t); err != nil {
+		l.Errorf("error decoding token: %v", err)
+		return err
+	}
+	return nil
+}
+
+// RevokeTokenRemote revokes the API token with the given id or name on the
+// server. MONOTF_ADMIN_TOKEN is used to authorize the request if set.
+func RevokeTokenRemote(idOrName string) (*APIToken, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "RevokeTokenRemote",
+	})
+	var w Workspace
+	resp, err := w.adminRequest("DELETE", "/tokens/"+url.PathEscape(idOrName), nil)
+	if err != nil {
+		l.Errorf("error revoking token: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("token %s not found", idOrName)
+	}
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		l.Errorf("error revoking token: %s: %s", resp.Status, string(bd))
+		return nil, fmt.Errorf("error revoking token: %s: %s", resp.Status, string(bd))
+	}
+	t := &APIToken{}
+	if err := json.NewDecoder(resp.Body).Decode(t); err != nil {
+		l.Errorf("error decoding token: %v", err)
+		return nil, err
+	}
+	return t, nil
+}
+
+// RunLogs writes the output of the run to out. If id is 0, the most recent
+// run of the workspace is used. If follow is set and the run is in progress,
+// its output is streamed until it finishes, and the finished run is returned.
+func (w *Workspace) RunLogs(id uint, follow bool, out io.Writer) (*Run, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "RunLogs",
+		"ws":  w.Name,
+		"run": id,
+	})
+	if id == 0 {
+		runs, err := w.ListRunsRemote(1)
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) == 0 {
+			return nil, fmt.Errorf("workspace %s has no runs", w.Name)
+		}
+		id = runs[0].ID
+	}
+	run, err := w.GetRunRemote(id)
+	if err != nil {
+		return nil, err
+	}
+	if run.FinishedAt != nil {
+		fmt.Fprint(out, run.Output)
+		return run, nil
+	}
+	l.Debugf("run %d is in progress", run.ID)
+	var after int
+	for {
+		finished, err := w.streamRunLogs(run, &after, follow, out)
+		if err != nil {
+			l.Errorf("error streaming run logs: %v", err)
+			return run, err
+		}
+		if finished || !follow {
+			return run, nil
+		}
+	}
+}
+
+// streamRunLogs writes the log chunks of the run after seq *after to out,
+// and updates *after. If follow is set, chunks are streamed until the run
+// finishes or the server ends the stream. It returns true once the run
+// has finished, updating run.
+func (w *Workspace) streamRunLogs(run *Run, after *int, follow bool, out io.Writer) (bool, error) {
+	path := fmt.Sprintf("/ws/%s/%s/runs/%d/logs?after=%d", w.Org, w.Name, run.ID, *after)
+	if follow {
+		path += "&follow=true"
+	}
+	resp, err := w.serverRequest("GET", path, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("%s: %s", resp.Status, string(bd))
+	}
+	if !follow {
+		var logs []RunLog
+		if err := json.NewDecoder(resp.Body).Decode(&logs); err != nil {
+			return false, err
+		}
+		for _, rl := range logs {
+			fmt.Fprint(out, rl.Data)
+			*after = rl.Seq
+		}
+		return false, nil
+	}
+	// read server-sent events until the stream ends
+	rd := bufio.NewReader(resp.Body)
+	var event, data string
+	for {
+		line, err := rd.ReadString('\n')
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			switch event {
+			case "log":
+				var rl RunLog
+				if err := json.Unmarshal([]byte(data), &rl); err != nil {
+					return false, err
+				}
+				fmt.Fprint(out, rl.Data)
+				*after = rl.Seq
+			case "finished":
+				if err := json.Unmarshal([]byte(data), run); err != nil {
+					return false, err
+				}
+				return true, nil
+			}
+			event, data = "", ""
+		}
 	}
+}
+
+func (ws *Workspace) LockedTerraform(waitTimeout *string, args []string) (string, string, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "LockedTerraform",
+		"ws":  ws.Name,
+		"ver": ws.Version,
+	})
 	if err := ws.TerraformWorkspacePreflight(); err != nil {
 		l.Errorf("error running terraform preflight: %v", err)
 		os.Exit(1)
 	}
-	lid := uuid.New().String()
-	ws.LockId = &lid
-	defer func() {
-		if err := ws.SetRunning(false); err != nil {
-			l.Errorf("error setting workspace to not running: %v", err)
+	var stdoutstr, stderrstr string
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	cleanup := func() {
+		if err := ws.Unlock(); err != nil {
+			l.Errorf("error unlocking workspace: %v", err)
 			return
 		}
+	}
+	go func() {
+		sig := <-sigs
+		l.Debugf("Received signal: %s, stopping services...", sig)
+		cleanup()
+		os.Exit(0)
 	}()
-	if err := ws.WaitForReady(*waitTimeout); err != nil {
-		l.Errorf("error waiting for workspace to be ready: %v", err)
+	defer cleanup()
+	overridden, err := ws.checkProtection(args)
+	if err != nil {
+		l.Errorf("error running terraform: %v", err)
 		return stdoutstr, stderrstr, err
 	}
-	if err := ws.SetRunning(true); err != nil {
-		l.Errorf("error setting workspace to running: %v", err)
+	if err := ws.Lock(*waitTimeout); err != nil {
+		l.Errorf("error locking workspace: %v", err)
 		return stdoutstr, stderrstr, err
 	}
-	planArgs := []string{"plan", "-out", outFile.Name()}
-	stdoutstr, stderrstr, err = ws.Terraform(planArgs)
+	if overridden != "" {
+		if err := ws.RecordOverrideRemote(overridden); err != nil {
+			l.Errorf("error recording override: %v", err)
+			return stdoutstr, stderrstr, err
+		}
+	}
+	stdoutstr, stderrstr, err = ws.TerraformRun(args, false)
 	if err != nil {
 		l.Errorf("error running terraform: %v", err)
 		return stdoutstr, stderrstr, err
 	}
-	if err := ws.SetOutput(); err != nil {
-		l.Errorf("error setting workspace output: %v", err)
-		return stdoutstr, stderrstr, err
+	if log.GetLevel() == log.DebugLevel {
+		l.Debugf("stdout: %s", stdoutstr)
+		l.Debugf("stderr: %s", stderrstr)
 	}
 	stat, err := ws.GetStatus()
 	if err != nil {
@@ -914,26 +2640,312 @@ func (ws *Workspace) LockedTerraformPlanApply(waitTimeout *string) (string, stri
 		return stdoutstr, stderrstr, err
 	}
 	l.Debugf("workspace status is %s", stat.Status)
-	// if the status is pending, apply it
-	if stat.Status == WorkspaceStatusPending || stat.Status == WorkspaceStatusUnknown {
-		applyArgs := []string{"apply", "-auto-approve", outFile.Name()}
-		stdoutstr, stderrstr, err = ws.Terraform(applyArgs)
+	if stat.Status == WorkspaceStatusFailed {
+		l.Errorf("workspace status is failed")
+		return stdoutstr, stderrstr, fmt.Errorf("workspace status is failed")
+	}
+	return stdoutstr, stderrstr, nil
+}
+
+// lockedSharedPlan runs plan with a temporary plan file under a shared
+// workspace lock. The run is preemptible, and if it is preempted by a higher
+// priority run it is queued again behind it.
+func (ws *Workspace) lockedSharedPlan(waitTimeout *string, plan func(planFile string) (RunResult, string, string, error)) (RunResult, string, string, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "lockedSharedPlan",
+		"ws":  ws.Name,
+		"ver": ws.Version,
+	})
+	if err := ws.TerraformWorkspacePreflight(); err != nil {
+		l.Errorf("error running terraform preflight: %v", err)
+		os.Exit(1)
+	}
+	var rr RunResult
+	var stdoutstr, stderrstr string
+	outFile, err := os.CreateTemp("", "monotf-plan-*.tfplan")
+	if err != nil {
+		l.Errorf("error creating plan file: %v", err)
+		return rr, stdoutstr, stderrstr, err
+	}
+	outFile.Close()
+	defer os.Remove(outFile.Name())
+	ws.lockMode = LockModeShared
+	ws.preemptible = true
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	cleanup := func() {
+		if err := ws.Unlock(); err != nil {
+			l.Errorf("error unlocking workspace: %v", err)
+			return
+		}
+	}
+	go func() {
+		sig := <-sigs
+		l.Debugf("Received signal: %s, stopping services...", sig)
+		cleanup()
+		os.Exit(0)
+	}()
+	defer cleanup()
+	for {
+		ws.runCtx, ws.cancelRun = context.WithCancelCause(context.Background())
+		if err := ws.Lock(*waitTimeout); err != nil {
+			l.Errorf("error locking workspace: %v", err)
+			return rr, stdoutstr, stderrstr, err
+		}
+		rr, stdoutstr, stderrstr, err = plan(outFile.Name())
+		if err == nil || ws.runCtx.Err() == nil || errors.Is(context.Cause(ws.runCtx), errLeaseLost) {
+			break
+		}
+		// the plan was cancelled to let a higher priority run go first,
+		// so queue up again behind it
+		l.Warnf("plan was preempted by a higher priority run, queueing again")
+		if err := ws.Unlock(); err != nil {
+			l.Errorf("error unlocking workspace: %v", err)
+			return rr, stdoutstr, stderrstr, err
+		}
+	}
+	ws.cancelRun(nil)
+	if err != nil {
+		l.Errorf("error running terraform: %v", err)
+		return rr, stdoutstr, stderrstr, err
+	}
+	return rr, stdoutstr, stderrstr, nil
+}
+
+// LockedTerraformSpeculativePlan runs a plan under a shared workspace lock,
+// so that any number of speculative plans can run at once. The plan does not
+// change the workspace, so it is recorded as a speculative run which leaves
+// the status of the workspace as is.
+func (ws *Workspace) LockedTerraformSpeculativePlan(waitTimeout *string) (string, string, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "LockedTerraformSpeculativePlan",
+		"ws":  ws.Name,
+		"ver": ws.Version,
+	})
+	l.Debugf("running terraform speculative plan")
+	rr, stdoutstr, stderrstr, err := ws.lockedSharedPlan(waitTimeout, func(planFile string) (RunResult, string, string, error) {
+		return ws.TerraformPlan(planFile, true)
+	})
+	if err != nil {
+		return stdoutstr, stderrstr, err
+	}
+	l.Debugf("speculative plan status is %s", rr.Status)
+	if rr.Status == WorkspaceStatusFailed {
+		l.Errorf("workspace status is failed")
+		return stdoutstr, stderrstr, fmt.Errorf("workspace status is failed")
+	}
+	return stdoutstr, stderrstr, nil
+}
+
+// LockedTerraformDrift checks the workspace for drift with a refresh-only
+// plan under a shared workspace lock. The workspace is set to drifted if
+// the infrastructure differs from the state, and back to applied once it
+// no longer does. The status of the result is drifted if there is drift.
+func (ws *Workspace) LockedTerraformDrift(waitTimeout *string) (RunResult, string, string, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "LockedTerraformDrift",
+		"ws":  ws.Name,
+		"ver": ws.Version,
+	})
+	l.Debugf("running terraform drift check")
+	rr, stdoutstr, stderrstr, err := ws.lockedSharedPlan(waitTimeout, ws.TerraformDrift)
+	if err != nil {
+		return rr, stdoutstr, stderrstr, err
+	}
+	l.Debugf("drift check status is %s", rr.Status)
+	if rr.Status == WorkspaceStatusFailed {
+		l.Errorf("workspace status is failed")
+		return rr, stdoutstr, stderrstr, fmt.Errorf("workspace status is failed")
+	}
+	return rr, stdoutstr, stderrstr, nil
+}
+
+// LockedTerraformPlanApply plans the workspace under an exclusive workspace
+// lock, and applies the plan if it has changes and passes the policy checks.
+// The plans of workspaces which require approval, and those which fail
+// policy rules which require approval, are stored and wait for approval
+// before they are applied, still holding the lock.
+func (ws *Workspace) LockedTerraformPlanApply(waitTimeout *string) (string, string, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "LockedTerraformPlanApply",
+		"ws":  ws.Name,
+		"ver": ws.Version,
+	})
+	l.Debugf("running terraform plan apply")
+	var stdoutstr, stderrstr string
+	var err error
+	approval := M.requiresApproval(ws)
+	timeout, err := M.approvalTimeout()
+	if err != nil {
+		return stdoutstr, stderrstr, err
+	}
+	// run a plan, writing the plan file to a temp file
+	// if the plan is successful, then run an apply using that plan file
+	outFile, err := os.CreateTemp("", "monotf-plan-*.tfplan")
+	if err != nil {
+		l.Errorf("error creating plan file: %v", err)
+		return stdoutstr, stderrstr, err
+	}
+	outFile.Close()
+	defer os.Remove(outFile.Name())
+	if err := ws.TerraformWorkspacePreflight(); err != nil {
+		l.Errorf("error running terraform preflight: %v", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := ws.Unlock(); err != nil {
+			l.Errorf("error unlocking workspace: %v", err)
+			return
+		}
+	}()
+	if err := ws.Lock(*waitTimeout); err != nil {
+		l.Errorf("error locking workspace: %v", err)
+		return stdoutstr, stderrstr, err
+	}
+	ws.approvalTimeout = timeout
+	ws.requireApproval = approval
+	defer func() {
+		ws.approvalTimeout = 0
+		ws.requireApproval = false
+		ws.planRunId = nil
+	}()
+	rr, stdoutstr, stderrstr, err := ws.TerraformPlan(outFile.Name(), false)
+	if err != nil {
+		l.Errorf("error running terraform: %v", err)
+		return stdoutstr, stderrstr, err
+	}
+	l.Debugf("workspace status is %s", rr.Status)
+	if rr.Policy.Failed() {
+		l.Errorf("plan failed policy checks: %s", strings.Join(rr.Policy.failures(), ", "))
+		return stdoutstr, stderrstr, fmt.Errorf("plan failed policy checks: %s", strings.Join(rr.Policy.failures(), ", "))
+	}
+	if (approval || rr.Policy.NeedsApproval()) && rr.Status == WorkspaceStatusPending {
+		return stdoutstr, stderrstr, fmt.Errorf("plan of workspace %s must be approved, but could not be stored on the server", ws.Name)
+	}
+	// wait for approval while holding the lock, so that the approved plan
+	// cannot go stale before it is applied
+	if rr.Status == WorkspaceStatusAwaitingApproval {
+		run, err := ws.WaitForApproval(*ws.planRunId, timeout)
 		if err != nil {
-			l.Errorf("error running terraform: %v", err)
+			l.Errorf("error waiting for approval: %v", err)
 			return stdoutstr, stderrstr, err
 		}
-		if err := ws.SetOutput(); err != nil {
-			l.Errorf("error setting workspace output: %v", err)
-			return stdoutstr, stderrstr, err
+		if run.Approval != ApprovalApproved {
+			l.Errorf("plan run %d was %s", run.ID, run.Approval)
+			return stdoutstr, stderrstr, fmt.Errorf("plan run %d was %s", run.ID, run.Approval)
 		}
-		stat, err = ws.GetStatus()
+		l.Infof("plan run %d was approved by %s", run.ID, run.ApprovalBy)
+		rr.Status = WorkspaceStatusPending
+	}
+	// if the plan has changes, apply it
+	if rr.Status == WorkspaceStatusPending {
+		rr, stdoutstr, stderrstr, err = ws.TerraformApplyPlan(outFile.Name(), rr)
 		if err != nil {
-			l.Errorf("error getting workspace status: %v", err)
+			l.Errorf("error running terraform: %v", err)
 			return stdoutstr, stderrstr, err
 		}
-		l.Debugf("workspace status is %s", stat.Status)
+		l.Debugf("workspace status is %s", rr.Status)
 	}
-	if stat.Status == WorkspaceStatusFailed {
+	if rr.Status == WorkspaceStatusFailed {
+		l.Errorf("workspace status is failed")
+		return stdoutstr, stderrstr, fmt.Errorf("workspace status is failed")
+	}
+	return stdoutstr, stderrstr, nil
+}
+
+// LockedTerraformApplyPlan applies the plan stored by the plan run with id,
+// which may have been made by another client, under an exclusive workspace
+// lock. The plan must have been made with the same terraform version, and
+// is refused by the server if the workspace has been applied since.
+func (ws *Workspace) LockedTerraformApplyPlan(waitTimeout *string, id uint) (string, string, error) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "LockedTerraformApplyPlan",
+		"ws":  ws.Name,
+		"ver": ws.Version,
+		"run": id,
+	})
+	l.Debugf("running terraform apply of stored plan")
+	var stdoutstr, stderrstr string
+	if id == 0 {
+		return stdoutstr, stderrstr, fmt.Errorf("a plan run is required")
+	}
+	plan, err := ws.GetRunRemote(id)
+	if err != nil {
+		return stdoutstr, stderrstr, err
+	}
+	if plan.PlanSize == 0 {
+		return stdoutstr, stderrstr, fmt.Errorf("run %d has no stored plan", id)
+	}
+	if plan.Version != ws.Version {
+		return stdoutstr, stderrstr, fmt.Errorf("run %d was planned with terraform %s, not %s", id, plan.Version, ws.Version)
+	}
+	if sha := gitSha(); plan.GitSha != "" && sha != plan.GitSha {
+		l.Warnf("run %d was planned at commit %s, not %s", id, plan.GitSha, sha)
+	}
+	if plan.Policy.Failed() {
+		return stdoutstr, stderrstr, fmt.Errorf("run %d failed policy checks: %s", id, strings.Join(plan.Policy.failures(), ", "))
+	}
+	// the protection of the workspace may have changed since the plan was
+	// made, so its deletions are checked again
+	overridden := ""
+	if res, ok := M.protectionResult(ws, plan.Changes); ok && res.Outcome == PolicyFail && !plan.Policy.has(protectionPolicy) {
+		plan.Policy = append(plan.Policy, res)
+	}
+	if plan.Policy.NeedsApproval() && plan.Approval != ApprovalApproved {
+		if M.Override == "" {
+			return stdoutstr, stderrstr, fmt.Errorf("run %d must be approved or overridden with -override: %s", id, strings.Join(plan.Policy.failures(), ", "))
+		}
+		overridden = fmt.Sprintf("apply of run %d which failed %s", id, strings.Join(plan.Policy.failures(), ", "))
+	}
+	outFile, err := os.CreateTemp("", "monotf-plan-*.tfplan")
+	if err != nil {
+		l.Errorf("error creating plan file: %v", err)
+		return stdoutstr, stderrstr, err
+	}
+	outFile.Close()
+	defer os.Remove(outFile.Name())
+	if err := ws.TerraformWorkspacePreflight(); err != nil {
+		l.Errorf("error running terraform preflight: %v", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := ws.Unlock(); err != nil {
+			l.Errorf("error unlocking workspace: %v", err)
+			return
+		}
+	}()
+	if err := ws.Lock(*waitTimeout); err != nil {
+		l.Errorf("error locking workspace: %v", err)
+		return stdoutstr, stderrstr, err
+	}
+	if overridden != "" {
+		if err := ws.RecordOverrideRemote(overridden); err != nil {
+			l.Errorf("error recording override: %v", err)
+			return stdoutstr, stderrstr, err
+		}
+	}
+	// download the plan under the lock, so that it cannot go stale before
+	// it is applied
+	if err := ws.DownloadPlanRemote(id, outFile.Name()); err != nil {
+		return stdoutstr, stderrstr, err
+	}
+	ws.planRunId = &id
+	defer func() { ws.planRunId = nil }()
+	rr, stdoutstr, stderrstr, err := ws.TerraformApplyPlan(outFile.Name(), RunResult{
+		Changes:   plan.Changes,
+		Resources: plan.Resources,
+	})
+	if err != nil {
+		l.Errorf("error running terraform: %v", err)
+		return stdoutstr, stderrstr, err
+	}
+	l.Debugf("workspace status is %s", rr.Status)
+	if rr.Status == WorkspaceStatusFailed {
 		l.Errorf("workspace status is failed")
 		return stdoutstr, stderrstr, fmt.Errorf("workspace status is failed")
 	}
@@ -969,7 +2981,6 @@ func (ws *Workspace) VarsFromScript() ([]string, error) {
 		l.Errorf("error running var script: %v", err)
 		return nil, err
 	}
-	l.Debugf("var script output: %s", string(out))
 	// read the var file and parse out the env vars
 	vars := []string{}
 	fd, err := os.ReadFile(varFile.Name())
@@ -982,6 +2993,10 @@ func (ws *Workspace) VarsFromScript() ([]string, error) {
 			vars = append(vars, v)
 		}
 	}
+	if log.GetLevel() == log.DebugLevel {
+		sw := Workspace{EnvVars: append(ws.EnvVars, vars...)}
+		l.Debugf("var script output: %s", NewRedactor(sw.secrets()).Redact(string(out)))
+	}
 	l.Debugf("parsed %d variables", len(vars))
 	return vars, nil
 }
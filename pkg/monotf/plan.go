@@ -0,0 +1,322 @@
+package monotf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// PlanChanges counts the resource changes in a terraform plan, as in the
+// "Plan: 1 to import, 2 to add, 0 to change, 1 to destroy." summary
+type PlanChanges struct {
+	Add     int `json:"add"`
+	Change  int `json:"change"`
+	Destroy int `json:"destroy"`
+	Import  int `json:"import"`
+}
+
+// PlanAction is the change a plan makes to a resource
+type PlanAction string
+
+const (
+	PlanActionCreate  PlanAction = "create"
+	PlanActionUpdate  PlanAction = "update"
+	PlanActionReplace PlanAction = "replace"
+	PlanActionDelete  PlanAction = "delete"
+	PlanActionImport  PlanAction = "import"
+)
+
+var (
+	PlanActions = []PlanAction{
+		PlanActionCreate,
+		PlanActionUpdate,
+		PlanActionReplace,
+		PlanActionDelete,
+		PlanActionImport,
+	}
+)
+
+// PlanResource is a change to a single resource in the plan of a run
+type PlanResource struct {
+	ID    uint `json:"-" gorm:"primarykey"`
+	RunID uint `json:"run_id" gorm:"index"`
+	// Org and Name are the workspace of the run, and are only set when
+	// listing the pending changes of several workspaces
+	Org        string     `json:"org,omitempty" gorm:"->;-:migration"`
+	Name       string     `json:"name,omitempty" gorm:"->;-:migration"`
+	Address    string     `json:"address"`
+	Type       string     `json:"type"`
+	Action     PlanAction `json:"action" gorm:"index"`
+	Provider   string     `json:"provider"`
+	ModulePath string     `json:"module_path,omitempty"`
+}
+
+// planResourceChange is a change to a resource in the output of
+// terraform show -json
+type planResourceChange struct {
+	Address       string `json:"address"`
+	ModuleAddress string `json:"module_address"`
+	Type          string `json:"type"`
+	ProviderName  string `json:"provider_name"`
+	Change        struct {
+		Actions   []string        `json:"actions"`
+		Importing json.RawMessage `json:"importing"`
+	} `json:"change"`
+}
+
+// planJSON is the subset of the output of terraform show -json used by monotf
+type planJSON struct {
+	ResourceChanges []planResourceChange `json:"resource_changes"`
+	// ResourceDrift are the changes made to resources outside of
+	// terraform, as found by a refresh
+	ResourceDrift []planResourceChange `json:"resource_drift"`
+}
+
+// planAction returns the action of a resource change with the terraform
+// actions, or empty if it does not change the resource
+func planAction(actions []string, importing bool) PlanAction {
+	switch strings.Join(actions, ",") {
+	case "create":
+		return PlanActionCreate
+	case "update":
+		return PlanActionUpdate
+	case "delete":
+		return PlanActionDelete
+	case "delete,create", "create,delete":
+		return PlanActionReplace
+	}
+	if importing {
+		return PlanActionImport
+	}
+	return ""
+}
+
+// summarizeChanges returns the counts of the resource changes, and the
+// changes themselves. A replaced resource counts as both an add and a
+// destroy. Resources which are not changed, such as data sources which
+// are read, are omitted.
+func summarizeChanges(rcs []planResourceChange) (*PlanChanges, []PlanResource) {
+	c := &PlanChanges{}
+	var resources []PlanResource
+	for _, rc := range rcs {
+		importing := len(rc.Change.Importing) > 0 && string(rc.Change.Importing) != "null"
+		if importing {
+			c.Import++
+		}
+		for _, a := range rc.Change.Actions {
+			switch a {
+			case "create":
+				c.Add++
+			case "update":
+				c.Change++
+			case "delete":
+				c.Destroy++
+			}
+		}
+		action := planAction(rc.Change.Actions, importing)
+		if action == "" {
+			continue
+		}
+		resources = append(resources, PlanResource{
+			Address:    rc.Address,
+			Type:       rc.Type,
+			Action:     action,
+			Provider:   rc.ProviderName,
+			ModulePath: rc.ModuleAddress,
+		})
+	}
+	return c, resources
+}
+
+// ParsePlan returns the counts of the resource changes in the output of
+// terraform show -json for a plan file, and the changes themselves
+func ParsePlan(data []byte) (*PlanChanges, []PlanResource, error) {
+	var p planJSON
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, nil, err
+	}
+	c, resources := summarizeChanges(p.ResourceChanges)
+	return c, resources, nil
+}
+
+// ParsePlanDrift returns the counts of the resources which have drifted
+// from the state in the output of terraform show -json for a refresh-only
+// plan file, and the drifted resources themselves
+func ParsePlanDrift(data []byte) (*PlanChanges, []PlanResource, error) {
+	var p planJSON
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, nil, err
+	}
+	c, resources := summarizeChanges(p.ResourceDrift)
+	return c, resources, nil
+}
+
+// PlanResourceFilter selects the pending resource changes returned by
+// ListPendingChanges. Empty fields match everything.
+type PlanResourceFilter struct {
+	Org        string
+	Name       string
+	Action     PlanAction
+	Provider   string
+	ModulePath string
+}
+
+// pendingChanges returns a query of the resource changes in the latest
+// plans of pending workspaces and those awaiting approval, which are the
+// changes the next apply of each workspace will make
+func pendingChanges() *gorm.DB {
+	return db.DB.Table("plan_resources").
+		Joins("JOIN workspaces ON workspaces.latest_run_id = plan_resources.run_id").
+		Where("workspaces.status IN ? AND workspaces.deleted_at IS NULL",
+			[]WorkspaceStatus{WorkspaceStatusPending, WorkspaceStatusAwaitingApproval})
+}
+
+// ListPendingChanges returns the resource changes pending in workspaces
+// which match the filter
+func ListPendingChanges(f PlanResourceFilter) ([]PlanResource, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ListPendingChanges",
+		"org": f.Org,
+		"ws":  f.Name,
+	})
+	l.Debug("start")
+	q := pendingChanges().Select("plan_resources.*, workspaces.org, workspaces.name")
+	if f.Org != "" {
+		q = q.Where("workspaces.org = ?", f.Org)
+	}
+	if f.Name != "" {
+		q = q.Where("workspaces.name = ?", f.Name)
+	}
+	if f.Action != "" {
+		q = q.Where("plan_resources.action = ?", f.Action)
+	}
+	if f.Provider != "" {
+		q = q.Where("plan_resources.provider = ?", f.Provider)
+	}
+	if f.ModulePath != "" {
+		q = q.Where("plan_resources.module_path = ?", f.ModulePath)
+	}
+	var resources []PlanResource
+	if err := q.Order("workspaces.org, workspaces.name, plan_resources.address").
+		Scan(&resources).Error; err != nil {
+		l.WithError(err).Error("failed to list pending changes")
+		return nil, err
+	}
+	l.Debug("end")
+	return resources, nil
+}
+
+// pendingChangeCounts returns the number of pending resource changes in
+// the workspaces of the org, by action
+func pendingChangeCounts(org string) (map[PlanAction]int, error) {
+	type actionCount struct {
+		Action PlanAction
+		Count  int
+	}
+	var counts []actionCount
+	if err := pendingChanges().Select("plan_resources.action, count(*) AS count").
+		Where("workspaces.org = ?", org).
+		Group("plan_resources.action").Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	c := make(map[PlanAction]int)
+	for _, a := range PlanActions {
+		c[a] = 0
+	}
+	for _, v := range counts {
+		c[v.Action] = v.Count
+	}
+	return c, nil
+}
+
+// loadResources loads the resource changes of the run
+func (r *Run) loadResources() error {
+	return db.DB.Where("run_id = ?", r.ID).Order("address").Find(&r.Resources).Error
+}
+
+func HandleListPendingChanges(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleListPendingChanges",
+	})
+	l.Debug("start")
+	f := PlanResourceFilter{
+		Org:        r.FormValue("org"),
+		Name:       r.FormValue("name"),
+		Action:     PlanAction(r.FormValue("action")),
+		Provider:   r.FormValue("provider"),
+		ModulePath: r.FormValue("module"),
+	}
+	if org := mux.Vars(r)["org"]; org != "" {
+		f.Org = org
+	}
+	if f.Action != "" {
+		valid := false
+		for _, a := range PlanActions {
+			valid = valid || a == f.Action
+		}
+		if !valid {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid action %s", f.Action)
+			return
+		}
+	}
+	resources, err := ListPendingChanges(f)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if resources == nil {
+		resources = []PlanResource{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resources); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+// hasArg returns true if args contains arg
+func hasArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// isDriftCheck returns true if args are those of a drift check, a
+// refresh-only plan which reports whether there is drift in its exit code
+func isDriftCheck(args []string) bool {
+	return len(args) > 0 && args[0] == "plan" &&
+		hasArg(args, "-refresh-only") && hasArg(args, "-detailed-exitcode")
+}
+
+// statusFromExitCode returns the status of a terraform command with args
+// which exited with code, or empty if it cannot be told from the exit code
+// alone. With -detailed-exitcode, plan exits with 2 if there are changes,
+// or if there is drift when run with -refresh-only.
+func statusFromExitCode(args []string, code int) WorkspaceStatus {
+	detailed := hasArg(args, "-detailed-exitcode")
+	switch {
+	case code == 2 && isDriftCheck(args):
+		return WorkspaceStatusDrifted
+	case code == 2 && detailed:
+		return WorkspaceStatusPending
+	case code != 0:
+		return WorkspaceStatusFailed
+	case detailed:
+		return WorkspaceStatusApplied
+	}
+	return ""
+}
@@ -0,0 +1,288 @@
+package monotf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/robertlestak/monotf/internal/blob"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrNoPlan is returned for a run which has no stored plan
+	ErrNoPlan = errors.New("run has no stored plan")
+	// ErrStalePlan is returned for a stored plan of a workspace which has
+	// been applied since the plan was made
+	ErrStalePlan = errors.New("plan is stale, the workspace has been applied since it was made")
+	// ErrPlanNotFinished is returned for a stored plan whose run has not
+	// finished
+	ErrPlanNotFinished = errors.New("plan run has not finished")
+	// ErrNotPlan is returned when storing a plan for a run which is not a plan
+	ErrNotPlan = errors.New("run is not a plan")
+)
+
+const (
+	// DefaultPlanMaxBytes is the largest plan file stored if
+	// MONOTF_PLAN_MAX_BYTES is not set
+	DefaultPlanMaxBytes = 100 << 20
+	// DefaultPlanRetention is how long plan files are kept if
+	// MONOTF_PLAN_RETENTION is not set
+	DefaultPlanRetention = 7 * 24 * time.Hour
+)
+
+// applyCommands are the commands which change the state of a workspace,
+// and so make the stored plans of the workspace stale
+var applyCommands = []string{"apply", "destroy", "import"}
+
+func planMaxBytes() int {
+	if v := os.Getenv("MONOTF_PLAN_MAX_BYTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return DefaultPlanMaxBytes
+}
+
+func planRetention() time.Duration {
+	if v := os.Getenv("MONOTF_PLAN_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return DefaultPlanRetention
+}
+
+// planKey returns the blob key of the plan file of the run
+func (r *Run) planKey() string {
+	return fmt.Sprintf("plans/%s/%s/%d.tfplan", url.PathEscape(r.Org), url.PathEscape(r.Name), r.ID)
+}
+
+// StorePlan stores the plan file of a plan run in the blob store. The plan
+// must be stored by the holder of the lock of the run, before the run
+// finishes.
+func (r *Run) StorePlan(data []byte, lockId string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "Run.StorePlan",
+		"org": r.Org,
+		"ws":  r.Name,
+		"run": r.ID,
+	})
+	l.Debug("start")
+	// the run is checked before the plan is written, so that a rejected
+	// upload does not replace the plan of the run
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return r.lockForPlanUpload(tx, lockId)
+	}); err != nil {
+		l.WithError(err).Error("plan may not be stored")
+		return err
+	}
+	key := r.planKey()
+	if err := blob.Default.Put(key, data); err != nil {
+		l.WithError(err).Error("failed to store plan")
+		return err
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := r.lockForPlanUpload(tx, lockId); err != nil {
+			return err
+		}
+		return tx.Model(r).Updates(map[string]interface{}{
+			"plan_key":  key,
+			"plan_size": len(data),
+		}).Error
+	})
+	if err != nil {
+		if r.PlanKey == "" {
+			if derr := blob.Default.Delete(key); derr != nil {
+				l.WithError(derr).Warn("failed to delete unsaved plan")
+			}
+		}
+		l.WithError(err).Error("failed to save run")
+		return err
+	}
+	l.Debug("end")
+	return nil
+}
+
+// lockForPlanUpload loads and locks the run within tx, and checks that it
+// is an unfinished plan whose lock is lockId, and that lockId still holds
+// the workspace
+func (r *Run) lockForPlanUpload(tx *gorm.DB, lockId string) error {
+	w, err := getWorkspaceForUpdate(tx, r.Org, r.Name)
+	if err != nil {
+		return err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("org = ? AND name = ?", r.Org, r.Name).
+		First(r, r.ID).Error; err != nil {
+		return err
+	}
+	if r.FinishedAt != nil || r.Approval != "" {
+		return ErrRunFinished
+	}
+	if r.Command != "plan" || isDriftCheck(r.Args) {
+		return ErrNotPlan
+	}
+	if err := checkNotEvicted(tx, r.LockId); err != nil {
+		return err
+	}
+	if r.LockId == nil || *r.LockId != lockId {
+		return ErrLockNotHeld
+	}
+	return checkLockHeld(tx, &w, r.LockId)
+}
+
+// checkPlanCurrent returns an error unless the run is a finished plan with a
+// stored plan, and the workspace has not been applied since the plan was made
+func (r *Run) checkPlanCurrent(tx *gorm.DB) error {
+	if r.PlanKey == "" {
+		return ErrNoPlan
+	}
+	if r.FinishedAt == nil {
+		return ErrPlanNotFinished
+	}
+	var n int64
+	if err := tx.Model(&Run{}).
+		Where("org = ? AND name = ? AND id > ? AND command IN ? AND speculative = ?",
+			r.Org, r.Name, r.ID, applyCommands, false).
+		Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrStalePlan
+	}
+	return nil
+}
+
+// LoadPlan returns the stored plan file of the run, if it is still current
+func (r *Run) LoadPlan() ([]byte, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "Run.LoadPlan",
+		"org": r.Org,
+		"ws":  r.Name,
+		"run": r.ID,
+	})
+	l.Debug("start")
+	if err := db.DB.Where("org = ? AND name = ?", r.Org, r.Name).First(r, r.ID).Error; err != nil {
+		l.WithError(err).Error("failed to get run")
+		return nil, err
+	}
+	if err := r.checkPlanCurrent(db.DB); err != nil {
+		return nil, err
+	}
+	data, err := blob.Default.Get(r.PlanKey)
+	if errors.Is(err, blob.ErrNotFound) {
+		return nil, ErrNoPlan
+	} else if err != nil {
+		l.WithError(err).Error("failed to load plan")
+		return nil, err
+	}
+	l.Debug("end")
+	return data, nil
+}
+
+// prunePlans deletes the stored plans which are stale or past the plan
+// retention from the blob store
+func prunePlans(now time.Time) error {
+	var runs []Run
+	if err := db.DB.Where("plan_key <> '' AND (finished_at < ? OR EXISTS (SELECT 1 FROM runs AS a "+
+		"WHERE a.org = runs.org AND a.name = runs.name AND a.id > runs.id AND a.command IN ? AND a.speculative = ?))",
+		now.Add(-planRetention()), applyCommands, false).
+		Limit(1000).Find(&runs).Error; err != nil {
+		return err
+	}
+	for _, r := range runs {
+		if err := blob.Default.Delete(r.PlanKey); err != nil {
+			return err
+		}
+		if err := db.DB.Model(&Run{}).Where("id = ?", r.ID).Update("plan_key", "").Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func HandleUploadPlan(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleUploadPlan",
+	})
+	l.Debug("start")
+	run, err := runFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	defer r.Body.Close()
+	max := planMaxBytes()
+	bd, err := io.ReadAll(io.LimitReader(r.Body, int64(max)+1))
+	if err != nil {
+		l.WithError(err).Error("failed to read request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(bd) > max {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "plan exceeds %d bytes", max)
+		return
+	}
+	if err := run.StorePlan(bd, r.FormValue("lock_id")); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrRunFinished), errors.Is(err, ErrLockNotHeld), errors.Is(err, ErrLockEvicted):
+			w.WriteHeader(http.StatusConflict)
+		case errors.Is(err, ErrNotPlan):
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleDownloadPlan(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleDownloadPlan",
+	})
+	l.Debug("start")
+	run, err := runFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	data, err := run.LoadPlan()
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound), errors.Is(err, ErrNoPlan):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrStalePlan), errors.Is(err, ErrPlanNotFinished):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(data); err != nil {
+		l.WithError(err).Error("failed to write response body")
+		return
+	}
+	l.Debug("end")
+}
@@ -0,0 +1,386 @@
+package monotf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyEnforcement is what happens when a plan violates a policy rule
+type PolicyEnforcement string
+
+const (
+	// PolicyEnforcementWarn rules report violations without blocking the apply
+	PolicyEnforcementWarn PolicyEnforcement = "warn"
+	// PolicyEnforcementFail rules block the apply of plans which violate them
+	PolicyEnforcementFail PolicyEnforcement = "fail"
+	// PolicyEnforcementApproval rules block the apply of plans which violate
+	// them until the plan is approved
+	PolicyEnforcementApproval PolicyEnforcement = "approval"
+)
+
+// PolicyOutcome is the result of checking a plan against a policy rule
+type PolicyOutcome string
+
+const (
+	PolicyPass PolicyOutcome = "pass"
+	PolicyWarn PolicyOutcome = "warn"
+	PolicyFail PolicyOutcome = "fail"
+)
+
+var (
+	// ErrPolicyFailed is returned when applying a plan which failed a
+	// policy rule
+	ErrPolicyFailed = errors.New("plan failed policy checks")
+)
+
+// PolicyRule limits the resource changes a plan may make. The rule matches
+// the resource changes selected by all of its set fields, and is violated
+// if a plan has more than MaxChanges matching changes.
+type PolicyRule struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description" yaml:"description"`
+	// Workspaces are globs of the workspace paths the rule applies to,
+	// e.g. prod/*. If empty, the rule applies to all workspaces.
+	Workspaces []string `json:"workspaces" yaml:"workspaces"`
+	// Actions, ResourceTypes, and Addresses select the resource changes
+	// matched by the rule. Types and addresses are globs, e.g. aws_iam_*
+	Actions       []PlanAction `json:"actions" yaml:"actions"`
+	ResourceTypes []string     `json:"resource_types" yaml:"resource_types"`
+	Addresses     []string     `json:"addresses" yaml:"addresses"`
+	// MaxChanges is the number of matching changes allowed, by default none
+	MaxChanges int `json:"max_changes" yaml:"max_changes"`
+	// Enforcement is fail if not set
+	Enforcement PolicyEnforcement `json:"enforcement" yaml:"enforcement"`
+}
+
+// PolicyResult is the outcome of checking a plan against a policy rule
+type PolicyResult struct {
+	Policy  string        `json:"policy"`
+	Outcome PolicyOutcome `json:"outcome"`
+	// Approval is set on failures which an approval of the plan overrides
+	Approval bool   `json:"approval,omitempty"`
+	Message  string `json:"message,omitempty"`
+	// Resources are the addresses of the changes which violated the rule
+	Resources []string `json:"resources,omitempty"`
+}
+
+// PolicyResults are the outcomes of checking a plan against each policy
+// rule which applies to its workspace
+type PolicyResults []PolicyResult
+
+// Failed returns true if the plan failed a rule which blocks its apply
+func (p PolicyResults) Failed() bool {
+	for _, r := range p {
+		if r.Outcome == PolicyFail && !r.Approval {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsApproval returns true if the plan must be approved before it is
+// applied
+func (p PolicyResults) NeedsApproval() bool {
+	for _, r := range p {
+		if r.Outcome == PolicyFail && r.Approval {
+			return true
+		}
+	}
+	return false
+}
+
+// has returns true if the results include a failure of the named rule
+func (p PolicyResults) has(name string) bool {
+	for _, r := range p {
+		if r.Policy == name && r.Outcome == PolicyFail {
+			return true
+		}
+	}
+	return false
+}
+
+// failures returns the names of the rules the plan failed
+func (p PolicyResults) failures() []string {
+	var names []string
+	for _, r := range p {
+		if r.Outcome == PolicyFail {
+			names = append(names, r.Policy)
+		}
+	}
+	return names
+}
+
+// policyFile is the format of a separate policy file
+type policyFile struct {
+	Policies []PolicyRule `json:"policies" yaml:"policies"`
+}
+
+// loadPolicies adds the rules in the policy file, if any, to the policies
+// of the config, and validates them
+func (m *Monotf) loadPolicies() error {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "loadPolicies",
+	})
+	if m.PolicyFile != "" {
+		l.Debugf("loading policies from %s", m.PolicyFile)
+		fd, err := os.ReadFile(m.PolicyFile)
+		if err != nil {
+			l.Errorf("error reading policy file %s: %v", m.PolicyFile, err)
+			return err
+		}
+		var pf policyFile
+		if err := yaml.Unmarshal(fd, &pf); err != nil {
+			l.Errorf("error parsing policy file %s: %v", m.PolicyFile, err)
+			return err
+		}
+		m.Policies = append(m.Policies, pf.Policies...)
+	}
+	names := make(map[string]bool)
+	for i, p := range m.Policies {
+		if p.Name == "" {
+			return fmt.Errorf("policy %d has no name", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("policy %s is defined more than once", p.Name)
+		}
+		names[p.Name] = true
+		switch p.Enforcement {
+		case "":
+			m.Policies[i].Enforcement = PolicyEnforcementFail
+		case PolicyEnforcementWarn, PolicyEnforcementFail, PolicyEnforcementApproval:
+		default:
+			return fmt.Errorf("policy %s has invalid enforcement %s", p.Name, p.Enforcement)
+		}
+		for _, a := range p.Actions {
+			valid := false
+			for _, v := range PlanActions {
+				valid = valid || a == v
+			}
+			if !valid {
+				return fmt.Errorf("policy %s has invalid action %s", p.Name, a)
+			}
+		}
+		if p.MaxChanges < 0 {
+			return fmt.Errorf("policy %s has negative max_changes", p.Name)
+		}
+	}
+	return nil
+}
+
+// matchAny returns true if s matches any of the globs, or if there are none
+func matchAny(globs []string, s string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, g := range globs {
+		if ok, _ := path.Match(g, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesTo returns true if the rule applies to the workspace at the path
+// relative to the repo
+func (p PolicyRule) appliesTo(rel string) bool {
+	if len(p.Workspaces) == 0 {
+		return true
+	}
+	for _, g := range p.Workspaces {
+		if ok, _ := path.Match(strings.Trim(g, "/"), rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesToName returns true if the rule applies to the workspace with the
+// name known to the server, which is its path with each / replaced by -.
+// The globs are matched against the name in the same form.
+func (p PolicyRule) appliesToName(name string) bool {
+	if len(p.Workspaces) == 0 {
+		return true
+	}
+	for _, g := range p.Workspaces {
+		if ok, _ := path.Match(strings.ReplaceAll(strings.Trim(g, "/"), "/", "-"), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the rule selects the resource change
+func (p PolicyRule) matches(r PlanResource) bool {
+	if len(p.Actions) > 0 {
+		found := false
+		for _, a := range p.Actions {
+			// a replace deletes the resource, so rules on deletes
+			// also match replaces
+			found = found || a == r.Action || (a == PlanActionDelete && r.Action == PlanActionReplace)
+		}
+		if !found {
+			return false
+		}
+	}
+	return matchAny(p.ResourceTypes, r.Type) && matchAny(p.Addresses, r.Address)
+}
+
+// evaluate checks the resource changes of a plan against the rule. If the
+// changes could not be read, the rule is violated.
+func (p PolicyRule) evaluate(changes *PlanChanges, resources []PlanResource) PolicyResult {
+	res := PolicyResult{
+		Policy:  p.Name,
+		Outcome: PolicyPass,
+	}
+	if changes == nil {
+		res.Message = "the changes of the plan could not be read"
+	} else {
+		for _, r := range resources {
+			if p.matches(r) {
+				res.Resources = append(res.Resources, r.Address)
+			}
+		}
+		if len(res.Resources) <= p.MaxChanges {
+			res.Resources = nil
+			return res
+		}
+		res.Message = fmt.Sprintf("%d matching changes, at most %d allowed", len(res.Resources), p.MaxChanges)
+		if p.Description != "" {
+			res.Message = p.Description + ": " + res.Message
+		}
+	}
+	switch p.Enforcement {
+	case PolicyEnforcementWarn:
+		res.Outcome = PolicyWarn
+	case PolicyEnforcementApproval:
+		res.Outcome = PolicyFail
+		res.Approval = true
+	default:
+		res.Outcome = PolicyFail
+	}
+	return res
+}
+
+// EvaluatePolicies checks the resource changes of a plan of the workspace
+// against the policy rules which apply to it
+func (m *Monotf) EvaluatePolicies(w *Workspace, changes *PlanChanges, resources []PlanResource) PolicyResults {
+	var results PolicyResults
+	rel := w.relPath()
+	for _, p := range m.Policies {
+		if p.appliesTo(rel) {
+			results = append(results, p.evaluate(changes, resources))
+		}
+	}
+	return results
+}
+
+// serverPolicies are the policy rules the server checks plans against,
+// loaded from MONOTF_POLICY_FILE
+var serverPolicies []PolicyRule
+
+// loadServerPolicies loads the policy rules of the server from the policy
+// file in MONOTF_POLICY_FILE, if it is set
+func loadServerPolicies() error {
+	m := &Monotf{PolicyFile: os.Getenv("MONOTF_POLICY_FILE")}
+	if m.PolicyFile == "" {
+		return nil
+	}
+	if err := m.loadPolicies(); err != nil {
+		return err
+	}
+	serverPolicies = m.Policies
+	return nil
+}
+
+// evaluateServerPolicies checks the resource changes of a plan of the
+// named workspace against the policy rules of the server which apply to it
+func evaluateServerPolicies(name string, changes *PlanChanges, resources []PlanResource) PolicyResults {
+	var results PolicyResults
+	for _, p := range serverPolicies {
+		if p.appliesToName(name) {
+			results = append(results, p.evaluate(changes, resources))
+		}
+	}
+	return results
+}
+
+// merge returns the results with the results of the same rules replaced by
+// those in checked. The other results are kept, as a failure can only
+// block the apply of the plan.
+func (p PolicyResults) merge(checked PolicyResults) PolicyResults {
+	names := make(map[string]bool)
+	for _, r := range checked {
+		names[r.Policy] = true
+	}
+	var merged PolicyResults
+	for _, r := range p {
+		if !names[r.Policy] {
+			merged = append(merged, r)
+		}
+	}
+	return append(merged, checked...)
+}
+
+// logPolicyResults logs the outcome of each policy rule
+func (w *Workspace) logPolicyResults(results PolicyResults) {
+	l := log.WithFields(log.Fields{
+		"app": "monotf",
+		"fn":  "logPolicyResults",
+		"ws":  w.Name,
+	})
+	for _, r := range results {
+		switch {
+		case r.Outcome == PolicyPass:
+			l.Debugf("policy %s passed", r.Policy)
+		case r.Outcome == PolicyWarn:
+			l.Warnf("policy %s: %s", r.Policy, r.Message)
+		case r.Approval:
+			l.Warnf("policy %s requires approval: %s", r.Policy, r.Message)
+		default:
+			l.Errorf("policy %s failed: %s", r.Policy, r.Message)
+		}
+	}
+}
+
+// checkServerPolicies checks the plan of the run against the policy rules
+// of the server, rather than trusting the results reported by the client,
+// and sets the status of the run from the results. A plan which fails a
+// rule cannot be approved, and a stored plan which fails a rule requiring
+// approval awaits approval if the client waits for it.
+func (r *Run) checkServerPolicies(resources []PlanResource, planJSON bool, approvalTimeout time.Duration) {
+	if len(serverPolicies) == 0 || r.Command != "plan" || isDriftCheck(r.Args) {
+		return
+	}
+	// plans without changes are only checked if the client sent them
+	if !planJSON && r.Status != WorkspaceStatusPending && r.Status != WorkspaceStatusAwaitingApproval {
+		return
+	}
+	r.Policy = r.Policy.merge(evaluateServerPolicies(r.Name, r.Changes, resources))
+	switch {
+	case r.Policy.Failed() && r.Status == WorkspaceStatusAwaitingApproval:
+		r.Status = WorkspaceStatusPending
+	case r.Policy.NeedsApproval() && r.Status == WorkspaceStatusPending &&
+		!r.Speculative && r.PlanKey != "" && approvalTimeout > 0:
+		r.Status = WorkspaceStatusAwaitingApproval
+	}
+}
+
+// checkPolicy returns an error if the plan run failed a policy rule which
+// blocks its apply, or one which requires approval and it was not approved
+func (r *Run) checkPolicy() error {
+	if r.Policy.Failed() {
+		return fmt.Errorf("%w: %s", ErrPolicyFailed, strings.Join(r.Policy.failures(), ", "))
+	}
+	if r.Policy.NeedsApproval() && r.Approval != ApprovalApproved {
+		return fmt.Errorf("%w, it failed policy checks which require approval", ErrNotApproved)
+	}
+	return nil
+}
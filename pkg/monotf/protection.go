@@ -0,0 +1,376 @@
+package monotf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// protectionPolicy is the name of the policy result of the deletion
+	// threshold of protected workspaces
+	protectionPolicy = "protected-workspace"
+	// DefaultOverrideListLimit is the number of overrides returned if no
+	// limit is given
+	DefaultOverrideListLimit = 50
+)
+
+var (
+	// ErrProtected is returned for commands refused in protected workspaces
+	ErrProtected = errors.New("workspace is protected")
+)
+
+// ProtectionConfig marks the workspaces which are protected from being
+// destroyed. In protected workspaces, destroy, apply -destroy, state rm,
+// and plans which delete more than MaxDeletes resources are refused unless
+// they are overridden or approved.
+type ProtectionConfig struct {
+	// Workspaces are globs of workspace paths relative to the repo,
+	// e.g. prod/* or aws01/us-east-1
+	Workspaces []string `json:"workspaces" yaml:"workspaces"`
+	// MaxDeletes is the number of resources a plan may delete or replace,
+	// by default none
+	MaxDeletes int `json:"max_deletes" yaml:"max_deletes"`
+}
+
+// ProtectionOverride records a command run in a protected workspace which
+// would otherwise have been refused
+type ProtectionOverride struct {
+	ID     uint    `json:"id" gorm:"primarykey"`
+	Org    string  `json:"org" gorm:"index:idx_override_org_name"`
+	Name   string  `json:"name" gorm:"index:idx_override_org_name"`
+	LockId *string `json:"lock_id" gorm:"index"`
+	// Command describes what was overridden, e.g. "destroy"
+	Command string `json:"command"`
+	Reason  string `json:"reason"`
+	// By is the identity of the token which recorded the override. It is
+	// set by the server, not read from the request.
+	By        string    `json:"by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// isProtected returns true if the workspace is protected
+func (m *Monotf) isProtected(w *Workspace) bool {
+	if m.Protection == nil {
+		return false
+	}
+	rel := w.relPath()
+	for _, p := range m.Protection.Workspaces {
+		if ok, _ := filepath.Match(strings.Trim(p, "/"), rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// valueFlags are the flags of terraform apply which take their value as the
+// next arg, e.g. -var 'a=b', rather than as -var='a=b'
+var valueFlags = map[string]bool{
+	"backup":       true,
+	"lock-timeout": true,
+	"parallelism":  true,
+	"replace":      true,
+	"state":        true,
+	"state-out":    true,
+	"target":       true,
+	"var":          true,
+	"var-file":     true,
+}
+
+// terraformSubcommand returns the terraform subcommand of args, skipping
+// global flags such as -chdir=dir, and the args after it
+func terraformSubcommand(args []string) (string, []string) {
+	for i, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			return a, args[i+1:]
+		}
+	}
+	return "", nil
+}
+
+// parseFlag returns the name and value of a flag given as -name, --name,
+// -name=value, or --name=value, and false if arg is not a flag
+func parseFlag(arg string) (string, string, bool) {
+	if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" {
+		return "", "", false
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	if i := strings.Index(name, "="); i >= 0 {
+		return name[:i], name[i+1:], true
+	}
+	return name, "", true
+}
+
+// hasBoolFlag returns true if the boolean flag is set in args, as terraform
+// parses it: -name, --name, or -name=true
+func hasBoolFlag(args []string, flag string) bool {
+	set := false
+	for _, a := range args {
+		name, value, ok := parseFlag(a)
+		if !ok || name != flag {
+			continue
+		}
+		if value == "" {
+			set = true
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		// a flag terraform cannot parse is treated as set, so that it
+		// is refused rather than let through
+		set = b || err != nil
+	}
+	return set
+}
+
+// savedPlanArg returns the plan file applied by terraform apply with args,
+// or empty if apply would make a new plan
+func savedPlanArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	last := args[len(args)-1]
+	if strings.HasPrefix(last, "-") {
+		return ""
+	}
+	if len(args) > 1 {
+		if name, value, ok := parseFlag(args[len(args)-2]); ok && value == "" && valueFlags[name] {
+			return ""
+		}
+	}
+	return last
+}
+
+// protectedCommand returns the description of the terraform command with
+// args if it is refused in protected workspaces, or empty if it is not.
+// An apply which makes its own plan is refused, as its deletions are not
+// checked like those of a saved plan.
+func protectedCommand(args []string) string {
+	cmd, rest := terraformSubcommand(args)
+	switch cmd {
+	case "destroy":
+		return "destroy"
+	case "apply":
+		if hasBoolFlag(rest, "destroy") {
+			return "apply -destroy"
+		}
+		if savedPlanArg(rest) == "" {
+			return "apply without a saved plan"
+		}
+	case "state":
+		if sub, _ := terraformSubcommand(rest); sub == "rm" {
+			return "state rm"
+		}
+	}
+	return ""
+}
+
+// checkProtection returns ErrProtected if the terraform command with args
+// is refused in the workspace, unless it is overridden. The command to
+// record as overridden is returned.
+func (w *Workspace) checkProtection(args []string) (string, error) {
+	if !M.isProtected(w) {
+		return "", nil
+	}
+	command := protectedCommand(args)
+	if command == "" {
+		command = w.savedPlanDeletions(args)
+	}
+	if command == "" {
+		return "", nil
+	}
+	if M.Override == "" {
+		return "", fmt.Errorf("%w, refusing to run %s in %s without -override", ErrProtected, command, w.Name)
+	}
+	return command, nil
+}
+
+// savedPlanDeletions checks the deletions of the saved plan applied by the
+// terraform command with args, as those of plans made by monotf are
+// checked, and returns the reason it is refused, or empty if it is not an
+// apply of a saved plan or is allowed
+func (w *Workspace) savedPlanDeletions(args []string) string {
+	cmd, rest := terraformSubcommand(args)
+	if cmd != "apply" {
+		return ""
+	}
+	plan := savedPlanArg(rest)
+	if plan == "" {
+		return ""
+	}
+	// a plan which cannot be read is refused with the nil changes
+	changes, _, _ := w.TerraformShowPlan(plan, false)
+	if res, ok := M.protectionResult(w, changes); ok && res.Outcome == PolicyFail {
+		return fmt.Sprintf("apply of saved plan %s (%s)", plan, res.Message)
+	}
+	return ""
+}
+
+// protectionResult checks the deletions of a plan of a protected workspace,
+// and returns the result as a policy result which requires approval. It
+// returns false if the workspace is not protected.
+func (m *Monotf) protectionResult(w *Workspace, changes *PlanChanges) (PolicyResult, bool) {
+	if !m.isProtected(w) {
+		return PolicyResult{}, false
+	}
+	res := PolicyResult{
+		Policy:  protectionPolicy,
+		Outcome: PolicyPass,
+	}
+	switch {
+	case changes == nil:
+		res.Message = "the changes of the plan could not be read"
+	case changes.Destroy > m.Protection.MaxDeletes:
+		res.Message = fmt.Sprintf("plan deletes %d resources in a protected workspace, at most %d allowed",
+			changes.Destroy, m.Protection.MaxDeletes)
+	default:
+		return res, true
+	}
+	res.Outcome = PolicyFail
+	res.Approval = true
+	return res, true
+}
+
+// Record records an override of the protection of a workspace
+func (o *ProtectionOverride) Record() error {
+	l := log.WithFields(log.Fields{
+		"pkg":     "ws",
+		"fn":      "ProtectionOverride.Record",
+		"org":     o.Org,
+		"ws":      o.Name,
+		"command": o.Command,
+		"by":      o.By,
+	})
+	l.Debug("start")
+	if o.Org == "" || o.Name == "" {
+		l.Error("org or name is empty")
+		return fmt.Errorf("org or name is empty")
+	}
+	if o.Reason == "" || o.By == "" || o.Command == "" {
+		return fmt.Errorf("a command, reason, and by are required to override protection")
+	}
+	o.ID = 0
+	o.CreatedAt = time.Time{}
+	if err := db.DB.Create(o).Error; err != nil {
+		l.WithError(err).Error("failed to record override")
+		return err
+	}
+	l.WithField("reason", o.Reason).Warn("protection overridden")
+	l.Debug("end")
+	return nil
+}
+
+// hasOverride returns true if an override was recorded under lockId
+func hasOverride(tx *gorm.DB, lockId *string) (bool, error) {
+	if lockId == nil {
+		return false, nil
+	}
+	var n int64
+	if err := tx.Model(&ProtectionOverride{}).Where("lock_id = ?", *lockId).Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ListOverrides returns the protection overrides of the workspace, newest
+// first
+func ListOverrides(org, name string, limit int) ([]ProtectionOverride, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ListOverrides",
+		"org": org,
+		"ws":  name,
+	})
+	l.Debug("start")
+	if limit <= 0 {
+		limit = DefaultOverrideListLimit
+	}
+	var overrides []ProtectionOverride
+	if err := db.DB.Where("org = ? AND name = ?", org, name).
+		Order("id desc").Limit(limit).Find(&overrides).Error; err != nil {
+		l.WithError(err).Error("failed to list overrides")
+		return nil, err
+	}
+	l.Debug("end")
+	return overrides, nil
+}
+
+func HandleRecordOverride(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleRecordOverride",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to override protection")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var o ProtectionOverride
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	vars := mux.Vars(r)
+	o.Org = vars["org"]
+	o.Name = vars["name"]
+	o.By = requestActor(r)
+	if o.Reason == "" || o.Command == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "a command and reason are required to override protection")
+		return
+	}
+	if err := o.Record(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(o); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleListOverrides(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleListOverrides",
+	})
+	l.Debug("start")
+	vars := mux.Vars(r)
+	var limit int
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid limit %s", v)
+			return
+		}
+	}
+	overrides, err := ListOverrides(vars["org"], vars["name"], limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(overrides); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
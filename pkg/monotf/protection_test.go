@@ -0,0 +1,34 @@
+package monotf
+
+import "testing"
+
+func TestProtectedCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"plan"}, ""},
+		{[]string{"plan", "-destroy"}, ""},
+		{[]string{"destroy", "-auto-approve"}, "destroy"},
+		{[]string{"-chdir=infra", "destroy"}, "destroy"},
+		{[]string{"apply", "-destroy"}, "apply -destroy"},
+		{[]string{"apply", "--destroy"}, "apply -destroy"},
+		{[]string{"apply", "-destroy=true", "-auto-approve"}, "apply -destroy"},
+		{[]string{"apply", "-destroy=1", "tfplan"}, "apply -destroy"},
+		{[]string{"-chdir=infra", "apply", "--destroy=true"}, "apply -destroy"},
+		{[]string{"apply", "-destroy=false", "tfplan"}, ""},
+		{[]string{"apply", "-auto-approve"}, "apply without a saved plan"},
+		{[]string{"apply", "-var", "a=b"}, "apply without a saved plan"},
+		{[]string{"apply", "-var=a=b", "tfplan"}, ""},
+		{[]string{"apply", "-var", "a=b", "tfplan"}, ""},
+		{[]string{"apply", "tfplan"}, ""},
+		{[]string{"state", "rm", "aws_instance.a"}, "state rm"},
+		{[]string{"state", "list"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := protectedCommand(tt.args); got != tt.want {
+			t.Errorf("protectedCommand(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package monotf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	LockTicketWaiting   LockTicketStatus = "waiting"
+	LockTicketGranted   LockTicketStatus = "granted"
+	LockTicketReleased  LockTicketStatus = "released"
+	LockTicketExpired   LockTicketStatus = "expired"
+	LockTicketAbandoned LockTicketStatus = "abandoned"
+	LockTicketEvicted   LockTicketStatus = "evicted"
+
+	// QueueTicketTTL is how long a waiting ticket is kept in the queue
+	// without its client polling for the lock
+	QueueTicketTTL = 2 * time.Minute
+	// etaSampleSize is the number of past runs used to estimate run duration
+	etaSampleSize = 10
+)
+
+type LockTicketStatus string
+
+// LockTicket is a client's place in a workspace's lock queue. Tickets
+// are kept after release as the run duration history used for ETAs.
+type LockTicket struct {
+	gorm.Model
+	Org         string            `json:"org" gorm:"index:idx_ticket_org_name"`
+	Name        string            `json:"name" gorm:"index:idx_ticket_org_name"`
+	LockId      string            `json:"lock_id" gorm:"uniqueIndex"`
+	Status      LockTicketStatus  `json:"status" gorm:"index"`
+	Mode        LockMode          `json:"mode"`
+	PathVars    map[string]string `json:"path_vars" gorm:"serializer:json"`
+	Owner       *LockOwner        `json:"owner" gorm:"type:text"`
+	Priority    LockPriority      `json:"priority" gorm:"index"`
+	Preemptible bool              `json:"preemptible"`
+	// PreemptedAt is set when a higher priority run asks the holder to release the lock
+	PreemptedAt *time.Time `json:"preempted_at"`
+	LastSeenAt  time.Time  `json:"last_seen_at"`
+	GrantedAt   *time.Time `json:"granted_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	ReleasedAt  *time.Time `json:"released_at"`
+	// StuckReportedAt is set when the lock is reported as stuck
+	StuckReportedAt *time.Time `json:"stuck_reported_at,omitempty"`
+}
+
+// QueueStatus describes the lock queue of a workspace
+type QueueStatus struct {
+	Org     string       `json:"org"`
+	Name    string       `json:"name"`
+	Holders []LockTicket `json:"holders"`
+	Waiting []LockTicket `json:"waiting"`
+	// Position is the 1-indexed queue position of the requested lock id,
+	// 0 if it is not waiting
+	Position   int   `json:"position"`
+	Length     int   `json:"length"`
+	ETASeconds int64 `json:"eta_seconds"`
+	// BlockedBy describes the concurrency limit which is keeping the
+	// requested lock id from being granted, if any
+	BlockedBy string `json:"blocked_by,omitempty"`
+}
+
+// String formats the queue position for logging, e.g. "position 3 of 5, ETA ~4m"
+func (qs QueueStatus) String() string {
+	eta := "ETA unknown"
+	if qs.ETASeconds > 0 {
+		d := time.Duration(qs.ETASeconds) * time.Second
+		if d < time.Minute {
+			eta = "ETA <1m"
+		} else {
+			eta = fmt.Sprintf("ETA ~%dm", int(d.Round(time.Minute).Minutes()))
+		}
+	}
+	if qs.BlockedBy != "" {
+		return fmt.Sprintf("position %d of %d, %s, blocked by %s", qs.Position, qs.Length, eta, qs.BlockedBy)
+	}
+	return fmt.Sprintf("position %d of %d, %s", qs.Position, qs.Length, eta)
+}
+
+// enqueue returns the ticket for lockId, creating it at the back of the
+// workspace queue if it does not exist, and marks it as seen
+func enqueue(tx *gorm.DB, org, name string, req LockRequest, now time.Time) (*LockTicket, error) {
+	lockId := req.LockId
+	t := &LockTicket{}
+	err := tx.Where("lock_id = ?", lockId).First(t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		t = &LockTicket{
+			Org:         org,
+			Name:        name,
+			LockId:      lockId,
+			Status:      LockTicketWaiting,
+			Mode:        req.lockMode(),
+			PathVars:    req.PathVars,
+			Priority:    req.Priority,
+			Preemptible: req.Preemptible && req.lockMode() == LockModeShared,
+			LastSeenAt:  now,
+		}
+		return t, tx.Create(t).Error
+	} else if err != nil {
+		return nil, err
+	}
+	if t.Org != org || t.Name != name {
+		return nil, fmt.Errorf("lock id %s is queued for %s/%s", lockId, t.Org, t.Name)
+	}
+	switch t.Status {
+	case LockTicketAbandoned:
+		// the client stopped polling for long enough to lose its place,
+		// so it rejoins at the back of the queue
+		if err := tx.Unscoped().Delete(t).Error; err != nil {
+			return nil, err
+		}
+		return enqueue(tx, org, name, req, now)
+	case LockTicketReleased, LockTicketExpired, LockTicketEvicted:
+		return nil, fmt.Errorf("lock id %s is %s", lockId, t.Status)
+	}
+	t.LastSeenAt = now
+	return t, tx.Model(t).Update("last_seen_at", now).Error
+}
+
+// queueTicketTTL returns how long a waiting ticket is kept without polling.
+// It is at least twice the wait hold time so that long-polling clients
+// do not lose their place.
+func queueTicketTTL() time.Duration {
+	if ttl := 2 * waitMaxHold(); ttl > QueueTicketTTL {
+		return ttl
+	}
+	return QueueTicketTTL
+}
+
+// touchTicket marks the waiting ticket for lockId as seen, so that it
+// keeps its place in the queue while its client waits
+func touchTicket(lockId string) error {
+	return db.DB.Model(&LockTicket{}).
+		Where("lock_id = ? AND status = ?", lockId, LockTicketWaiting).
+		Update("last_seen_at", time.Now()).Error
+}
+
+// abandonStaleTickets drops waiting tickets whose clients have stopped polling
+func abandonStaleTickets(tx *gorm.DB, org, name string, now time.Time) error {
+	q := tx.Model(&LockTicket{}).Where("status = ? AND last_seen_at < ?", LockTicketWaiting, now.Add(-queueTicketTTL()))
+	if org != "" {
+		q = q.Where("org = ? AND name = ?", org, name)
+	}
+	return q.Update("status", LockTicketAbandoned).Error
+}
+
+// canGrant returns true if the waiting ticket t can be granted the lock of w.
+// Waiting tickets are ordered by priority, and then by the order they were queued.
+func canGrant(tx *gorm.DB, w *Workspace, t *LockTicket) (bool, error) {
+	if w.Running != nil && *w.Running {
+		return false, nil
+	}
+	ahead := tx.Model(&LockTicket{}).
+		Where("org = ? AND name = ? AND status = ?", w.Org, w.Name, LockTicketWaiting).
+		Where("(priority > ? OR (priority = ? AND id < ?))", t.Priority, t.Priority, t.ID)
+	if t.Mode == LockModeShared {
+		// readers may pass other waiting readers, but not a waiting writer
+		ahead = ahead.Where("mode = ?", LockModeExclusive)
+	} else if w.Readers > 0 {
+		return false, nil
+	}
+	var n int64
+	if err := ahead.Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n == 0, nil
+}
+
+// closeTicket marks the ticket for lockId as no longer holding the lock,
+// and abandons any runs the holder did not finish
+func closeTicket(tx *gorm.DB, lockId string, status LockTicketStatus, now time.Time) error {
+	if err := abandonRuns(tx, lockId, status, now); err != nil {
+		return err
+	}
+	if err := expireApprovals(tx, lockId, status, now); err != nil {
+		return err
+	}
+	return tx.Model(&LockTicket{}).Where("lock_id = ?", lockId).Updates(map[string]interface{}{
+		"status":      status,
+		"released_at": now,
+	}).Error
+}
+
+// averageRunDuration returns the mean lock hold time of the most recent
+// runs in the workspace, or 0 if there is no history
+func averageRunDuration(tx *gorm.DB, org, name string) (time.Duration, error) {
+	var tickets []LockTicket
+	if err := tx.Where("org = ? AND name = ? AND status = ? AND granted_at IS NOT NULL AND released_at IS NOT NULL",
+		org, name, LockTicketReleased).
+		Order("id desc").Limit(etaSampleSize).Find(&tickets).Error; err != nil {
+		return 0, err
+	}
+	if len(tickets) == 0 {
+		return 0, nil
+	}
+	var total time.Duration
+	for _, t := range tickets {
+		total += t.ReleasedAt.Sub(*t.GrantedAt)
+	}
+	return total / time.Duration(len(tickets)), nil
+}
+
+// queueStatus returns the queue of the workspace, with the position of lockId
+func queueStatus(tx *gorm.DB, org, name, lockId string) (QueueStatus, error) {
+	qs := QueueStatus{
+		Org:  org,
+		Name: name,
+	}
+	if err := tx.Where("org = ? AND name = ? AND status = ?", org, name, LockTicketGranted).
+		Order("id").Find(&qs.Holders).Error; err != nil {
+		return qs, err
+	}
+	if err := tx.Where("org = ? AND name = ? AND status = ?", org, name, LockTicketWaiting).
+		Order("priority desc, id").Find(&qs.Waiting).Error; err != nil {
+		return qs, err
+	}
+	qs.Length = len(qs.Waiting)
+	for i, t := range qs.Waiting {
+		if t.LockId == lockId {
+			qs.Position = i + 1
+			break
+		}
+	}
+	avg, err := averageRunDuration(tx, org, name)
+	if err != nil {
+		return qs, err
+	}
+	if avg > 0 {
+		var eta time.Duration
+		// the most recently granted holder determines when all current
+		// holders are expected to be done
+		var latest *time.Time
+		for _, h := range qs.Holders {
+			if h.GrantedAt != nil && (latest == nil || h.GrantedAt.After(*latest)) {
+				latest = h.GrantedAt
+			}
+		}
+		if latest != nil {
+			if remaining := avg - time.Since(*latest); remaining > 0 {
+				eta += remaining
+			}
+		}
+		ahead := qs.Length
+		if qs.Position > 0 {
+			ahead = qs.Position - 1
+		}
+		eta += time.Duration(ahead) * avg
+		qs.ETASeconds = int64(eta.Seconds())
+	}
+	return qs, nil
+}
+
+// GetQueueStatus returns the lock queue of the workspace. If lockId is
+// set, the position and ETA are computed for that ticket.
+func GetQueueStatus(org, name, lockId string) (QueueStatus, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "ws",
+		"fn":   "GetQueueStatus",
+		"org":  org,
+		"ws":   name,
+		"lock": lockId,
+	})
+	l.Debug("start")
+	qs, err := queueStatus(db.DB, org, name, lockId)
+	if err != nil {
+		l.WithError(err).Error("failed to get queue status")
+		return qs, err
+	}
+	l.Debug("end")
+	return qs, nil
+}
+
+func HandleGetQueueStatus(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleGetQueueStatus",
+	})
+	l.Debug("start")
+	vars := mux.Vars(r)
+	qs, err := GetQueueStatus(vars["org"], vars["name"], r.FormValue("lock_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(qs); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
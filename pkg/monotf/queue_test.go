@@ -0,0 +1,165 @@
+package monotf
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/monotf/internal/db"
+)
+
+func TestLockQueueOrder(t *testing.T) {
+	type request struct {
+		mode     LockMode
+		priority LockPriority
+	}
+	tests := []struct {
+		name     string
+		running  bool
+		readers  int
+		requests []request
+		// order are the indexes of the requests in queue order, and
+		// granted those which can be granted the lock
+		order   []int
+		granted []int
+	}{
+		{
+			name:     "exclusive requests are first in first out",
+			requests: []request{{LockModeExclusive, LockPriorityNormal}, {LockModeExclusive, LockPriorityNormal}},
+			order:    []int{0, 1},
+			granted:  []int{0},
+		},
+		{
+			name:     "high priority passes normal",
+			requests: []request{{LockModeExclusive, LockPriorityNormal}, {LockModeExclusive, LockPriorityHigh}},
+			order:    []int{1, 0},
+			granted:  []int{1},
+		},
+		{
+			name:     "low priority waits behind later normal",
+			requests: []request{{LockModeExclusive, LockPriorityLow}, {LockModeExclusive, LockPriorityNormal}, {LockModeExclusive, LockPriorityLow}},
+			order:    []int{1, 0, 2},
+			granted:  []int{1},
+		},
+		{
+			name:     "shared requests are granted together",
+			requests: []request{{LockModeShared, LockPriorityNormal}, {LockModeShared, LockPriorityNormal}},
+			order:    []int{0, 1},
+			granted:  []int{0, 1},
+		},
+		{
+			name:     "shared waits behind queued exclusive",
+			requests: []request{{LockModeExclusive, LockPriorityNormal}, {LockModeShared, LockPriorityNormal}},
+			order:    []int{0, 1},
+			granted:  []int{0},
+		},
+		{
+			name:     "shared passes lower priority exclusive",
+			requests: []request{{LockModeExclusive, LockPriorityLow}, {LockModeShared, LockPriorityNormal}},
+			order:    []int{1, 0},
+			granted:  []int{1},
+		},
+		{
+			name:     "shared passes queued shared but not exclusive",
+			requests: []request{{LockModeShared, LockPriorityNormal}, {LockModeExclusive, LockPriorityNormal}, {LockModeShared, LockPriorityNormal}},
+			order:    []int{0, 1, 2},
+			granted:  []int{0},
+		},
+		{
+			name:     "exclusive waits for readers",
+			readers:  1,
+			requests: []request{{LockModeExclusive, LockPriorityHigh}, {LockModeShared, LockPriorityNormal}},
+			order:    []int{0, 1},
+		},
+		{
+			name:     "shared joins readers",
+			readers:  2,
+			requests: []request{{LockModeShared, LockPriorityNormal}},
+			order:    []int{0},
+			granted:  []int{0},
+		},
+		{
+			name:     "nothing is granted while held",
+			running:  true,
+			requests: []request{{LockModeShared, LockPriorityHigh}, {LockModeExclusive, LockPriorityHigh}},
+			order:    []int{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initTestDB(t)
+			running := tt.running
+			w := &Workspace{Org: "org", Name: "ws", Running: &running, Readers: tt.readers}
+			now := time.Now()
+			tickets := make(map[string]int)
+			var granted []int
+			for i, r := range tt.requests {
+				req := LockRequest{LockId: fmt.Sprintf("lock-%d", i), Mode: r.mode, Priority: r.priority}
+				if _, err := enqueue(db.DB, w.Org, w.Name, req, now); err != nil {
+					t.Fatal(err)
+				}
+				tickets[req.LockId] = i
+			}
+			qs, err := queueStatus(db.DB, w.Org, w.Name, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var order []int
+			for _, ticket := range qs.Waiting {
+				order = append(order, tickets[ticket.LockId])
+				ok, err := canGrant(db.DB, w, &ticket)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok {
+					granted = append(granted, tickets[ticket.LockId])
+				}
+			}
+			if !reflect.DeepEqual(order, tt.order) {
+				t.Errorf("queue order = %v, want %v", order, tt.order)
+			}
+			if !reflect.DeepEqual(granted, tt.granted) {
+				t.Errorf("granted = %v, want %v", granted, tt.granted)
+			}
+		})
+	}
+}
+
+func TestReleaseLockLeavesQueue(t *testing.T) {
+	initTestDB(t)
+	w := &Workspace{Org: "org", Name: "ws"}
+	if _, err := w.AcquireLock(LockRequest{LockId: "holder", TTL: "5m"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"gave-up", "next"} {
+		if _, err := w.AcquireLock(LockRequest{LockId: id, TTL: "5m"}); !errors.Is(err, ErrLockHeld) {
+			t.Fatalf("lock %s: got %v, want %v", id, err, ErrLockHeld)
+		}
+	}
+	// a waiting request which gives up leaves the queue, rather than
+	// holding up the requests behind it
+	if err := w.ReleaseLock("gave-up"); err != nil {
+		t.Fatal(err)
+	}
+	qs, err := GetQueueStatus(w.Org, w.Name, "next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qs.Position != 1 || qs.Length != 1 {
+		t.Errorf("next is %s, want position 1 of 1", qs.String())
+	}
+	if err := w.ReleaseLock("holder"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.AcquireLock(LockRequest{LockId: "next", TTL: "5m"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if w.LockId == nil || *w.LockId != "next" {
+		t.Errorf("lock is held by %v, want next", w.LockId)
+	}
+}
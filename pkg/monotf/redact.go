@@ -0,0 +1,110 @@
+package monotf
+
+import (
+	"encoding/base64"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// RedactedValue replaces secrets in terraform output
+	RedactedValue = "***"
+	// minSecretLength is the length below which values are not redacted,
+	// since masking every occurrence of a short value such as "1" or
+	// "true" would mangle the output
+	minSecretLength = 4
+)
+
+// Redactor masks secret values, and their base64 encodings, in output
+type Redactor struct {
+	replacer *strings.Replacer
+}
+
+// base64Forms returns the base64 encodings of the secret, including the
+// forms it takes when embedded at any offset in a larger base64 string
+func base64Forms(secret string) []string {
+	var forms []string
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding} {
+		forms = append(forms, enc.EncodeToString([]byte(secret)))
+		raw := enc.WithPadding(base64.NoPadding)
+		for i := 0; i < 3; i++ {
+			// encode the secret after i bytes, and keep only the
+			// characters which are fully determined by the secret
+			e := raw.EncodeToString(append(make([]byte, i), secret...))
+			start := (i*8 + 5) / 6
+			end := (i + len(secret)) * 8 / 6
+			if end > start {
+				forms = append(forms, e[start:end])
+			}
+		}
+	}
+	return forms
+}
+
+// NewRedactor returns a redactor for the secrets. Multi-line secrets are
+// also matched line by line.
+func NewRedactor(secrets []string) *Redactor {
+	seen := make(map[string]bool)
+	var values []string
+	add := func(v string) {
+		if len(v) >= minSecretLength && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	for _, s := range secrets {
+		add(s)
+		for _, f := range base64Forms(s) {
+			add(f)
+		}
+		if strings.Contains(s, "\n") {
+			for _, line := range strings.Split(s, "\n") {
+				add(strings.TrimSpace(line))
+			}
+		}
+	}
+	// the replacer tries its patterns in order, so try the longest first
+	// to mask the whole of a secret which contains another
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	var pairs []string
+	for _, v := range values {
+		pairs = append(pairs, v, RedactedValue)
+	}
+	r := &Redactor{}
+	if len(pairs) > 0 {
+		r.replacer = strings.NewReplacer(pairs...)
+	}
+	return r
+}
+
+// Redact returns s with all secrets masked
+func (r *Redactor) Redact(s string) string {
+	if r == nil || r.replacer == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// secrets returns the values which must not appear in the output of the
+// workspace: those loaded from vault and the var script, the vault token,
+// and the values of the sensitive_env vars
+func (w *Workspace) secrets() []string {
+	var secrets []string
+	for _, ev := range w.EnvVars {
+		if _, v, ok := strings.Cut(ev, "="); ok {
+			secrets = append(secrets, v)
+		}
+	}
+	if M.VaultEnv != nil && M.VaultEnv.Token != "" {
+		secrets = append(secrets, M.VaultEnv.Token)
+	}
+	for _, k := range M.SensitiveEnv {
+		if v := os.Getenv(k); v != "" {
+			secrets = append(secrets, v)
+		}
+	}
+	return secrets
+}
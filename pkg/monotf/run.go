@@ -0,0 +1,1085 @@
+package monotf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/blob"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrRunFinished = errors.New("run is already finished")
+)
+
+const (
+	// DefaultRunListLimit is the number of runs returned by the list endpoint
+	DefaultRunListLimit = 50
+	// DefaultOutputMaxBytes is the largest run output stored if
+	// MONOTF_OUTPUT_MAX_BYTES is not set
+	DefaultOutputMaxBytes = 10 << 20
+	// runLogRetention is how long the streamed log chunks of a run are kept
+	// after it finishes, for followers to catch up. After that the output
+	// is only read from the blob store.
+	runLogRetention = 10 * time.Minute
+)
+
+// Run is a single invocation of terraform in a workspace
+type Run struct {
+	gorm.Model
+	Org     string   `json:"org" gorm:"index:idx_run_org_name"`
+	Name    string   `json:"name" gorm:"index:idx_run_org_name"`
+	LockId  *string  `json:"lock_id" gorm:"index"`
+	Command string   `json:"command"`
+	Args    []string `json:"args" gorm:"serializer:json"`
+	// Version is the terraform version of the run, and GitSha the commit
+	// of the repository it was run from
+	Version string `json:"version"`
+	GitSha  string `json:"git_sha"`
+	// Speculative runs do not change the status of the workspace
+	Speculative     bool       `json:"speculative"`
+	Owner           *LockOwner `json:"owner" gorm:"type:text"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	// ExitCode is nil until the run finishes, and stays nil if the client
+	// went away before reporting it
+	ExitCode *int            `json:"exit_code"`
+	Status   WorkspaceStatus `json:"status"`
+	// Changes are the resource changes of a plan, or of the plan applied
+	Changes *PlanChanges `json:"changes" gorm:"serializer:json"`
+	// PlanKey is the blob key of the plan file of a plan run, if it was
+	// stored, and PlanSize its size
+	PlanKey  string `json:"-"`
+	PlanSize int    `json:"plan_size"`
+	// PlanRunId is the plan run whose stored plan an apply run applies
+	PlanRunId *uint `json:"plan_run_id"`
+	// Policy are the results of the policy checks of a plan
+	Policy PolicyResults `json:"policy,omitempty" gorm:"serializer:json"`
+	// Approval is set on plans which must be approved before they are
+	// applied, along with who approved or rejected the plan and when
+	Approval          ApprovalStatus `json:"approval,omitempty"`
+	ApprovalExpiresAt *time.Time     `json:"approval_expires_at,omitempty"`
+	ApprovalBy        string         `json:"approval_by,omitempty"`
+	ApprovalAt        *time.Time     `json:"approval_at,omitempty"`
+	ApprovalComment   string         `json:"approval_comment,omitempty"`
+	// Resources are the resource changes of the plan of the run, and are
+	// only loaded when a single run is requested
+	Resources []PlanResource `json:"resources,omitempty" gorm:"-"`
+	// Output is stored compressed in the blob store under OutputKey, and
+	// is only loaded when a single run is requested
+	Output    string `json:"output,omitempty" gorm:"-"`
+	OutputKey string `json:"-"`
+	// OutputSize is the size of the output before it was truncated
+	OutputSize      int        `json:"output_size"`
+	OutputTruncated bool       `json:"output_truncated"`
+	OutputPrunedAt  *time.Time `json:"output_pruned_at"`
+}
+
+// RunResult is sent by clients when a run finishes
+type RunResult struct {
+	// LockId is the lock id of the run, which must still hold the lock of
+	// the workspace
+	LockId   string `json:"lock_id"`
+	ExitCode int    `json:"exit_code"`
+	// Output is the combined stdout and stderr, optionally base64 encoded
+	Output string `json:"output"`
+	// Status is taken from the exit code, or inferred from the output,
+	// if not set
+	Status    WorkspaceStatus `json:"status"`
+	Changes   *PlanChanges    `json:"changes"`
+	Resources []PlanResource  `json:"resources"`
+	// ApprovalTimeoutSeconds is how long a plan finished as
+	// awaiting_approval waits for approval
+	ApprovalTimeoutSeconds int `json:"approval_timeout_seconds,omitempty"`
+	// Policy are the results of the policy checks of a plan
+	Policy PolicyResults `json:"policy"`
+	// PlanJSON is the output of terraform show -json for the plan of a
+	// plan run, which the server checks against its own policies
+	PlanJSON json.RawMessage `json:"plan_json,omitempty"`
+}
+
+// decodeOutput decodes base64 encoded output, returning it as is if it is not encoded
+func decodeOutput(o string) string {
+	if o == "" {
+		return o
+	}
+	decoded, err := base64.StdEncoding.DecodeString(o)
+	if err != nil {
+		return o
+	}
+	return string(decoded)
+}
+
+// inProgressStatus returns the status of the workspace while the run is
+// running, or empty if the run does not change the status of the workspace
+func (r *Run) inProgressStatus() WorkspaceStatus {
+	if r.Speculative || isDriftCheck(r.Args) {
+		return ""
+	}
+	switch r.Command {
+	case "plan":
+		return WorkspaceStatusPlanning
+	case "apply", "destroy", "import":
+		return WorkspaceStatusApplying
+	}
+	return ""
+}
+
+// requiredRole returns the role needed to start the run. Plans, including
+// speculative plans and drift checks, need plan, and commands which may
+// change state need apply.
+func (r *Run) requiredRole() string {
+	if r.Speculative || isDriftCheck(r.Args) {
+		return RolePlan
+	}
+	switch r.Command {
+	case "plan", "show", "output", "validate", "providers", "graph", "version":
+		return RolePlan
+	}
+	return RoleApply
+}
+
+// Start records the start of the run in the workspace, and moves the
+// workspace to planning or applying if the run is a plan or an apply. The
+// run must hold the exclusive lock of the workspace, or a shared lock.
+func (r *Run) Start() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "Run.Start",
+		"org": r.Org,
+		"ws":  r.Name,
+	})
+	l.Debug("start")
+	if r.Org == "" || r.Name == "" {
+		l.Error("org or name is empty")
+		return fmt.Errorf("org or name is empty")
+	}
+	r.ID = 0
+	r.FinishedAt = nil
+	r.ExitCode = nil
+	r.DurationSeconds = 0
+	r.Status = ""
+	r.Output = ""
+	r.PlanKey = ""
+	r.PlanSize = 0
+	r.Approval = ""
+	r.ApprovalExpiresAt = nil
+	r.ApprovalBy = ""
+	r.ApprovalAt = nil
+	r.ApprovalComment = ""
+	r.Policy = nil
+	if r.StartedAt.IsZero() {
+		r.StartedAt = time.Now()
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		status := r.inProgressStatus()
+		w, err := getWorkspaceForUpdate(tx, r.Org, r.Name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrLockNotHeld
+		} else if err != nil {
+			return err
+		}
+		if err := checkNotEvicted(tx, r.LockId); err != nil {
+			return err
+		}
+		if err := checkLockHeld(tx, &w, r.LockId); err != nil {
+			return err
+		}
+		if r.PlanRunId != nil {
+			var plan Run
+			err := tx.Where("org = ? AND name = ?", r.Org, r.Name).First(&plan, *r.PlanRunId).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNoPlan
+			} else if err != nil {
+				return err
+			}
+			if err := plan.checkApproved(); err != nil {
+				return err
+			}
+			// a plan which failed policy checks which require approval
+			// may also be applied under a lock which overrode them
+			if err := plan.checkPolicy(); errors.Is(err, ErrNotApproved) {
+				overridden, oerr := hasOverride(tx, r.LockId)
+				if oerr != nil {
+					return oerr
+				}
+				if !overridden {
+					return err
+				}
+			} else if err != nil {
+				return err
+			}
+			if err := plan.checkPlanCurrent(tx); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(r).Error; err != nil {
+			return err
+		}
+		if s := r.inProgressStatus(); s != "" {
+			ev := r.event(EventRunStarted)
+			ev.Status = s
+			if err := emitEvent(tx, ev); err != nil {
+				return err
+			}
+		}
+		if status == "" {
+			return nil
+		}
+		return w.transition(tx, status, &r.ID)
+	})
+	if err != nil {
+		l.WithError(err).Error("failed to start run")
+		return err
+	}
+	l.WithField("run", r.ID).Debug("end")
+	return nil
+}
+
+// Finish records the result of the run. Unless the run is speculative or a
+// drift check, the run becomes the latest run of the workspace, and the
+// status of the workspace is updated if the run is a plan or an apply.
+func (r *Run) Finish(res RunResult) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "Run.Finish",
+		"org": r.Org,
+		"ws":  r.Name,
+		"run": r.ID,
+	})
+	l.Debug("start")
+	// the run is checked before its output is written, so that a rejected
+	// finish does not leave output in the blob store
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, _, err := r.lockForFinish(tx, res.LockId)
+		return err
+	})
+	if err != nil {
+		l.WithError(err).Error("run may not be finished")
+		return err
+	}
+	output := decodeOutput(res.Output)
+	stored, err := r.writeOutput(output)
+	if err != nil {
+		l.WithError(err).Error("failed to store run output")
+		return err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		w, hasWorkspace, err := r.lockForFinish(tx, res.LockId)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		exitCode := res.ExitCode
+		r.FinishedAt = &now
+		r.DurationSeconds = now.Sub(r.StartedAt).Seconds()
+		r.ExitCode = &exitCode
+		r.Status = res.Status
+		r.Changes = res.Changes
+		r.Policy = res.Policy
+		resources := res.Resources
+		if len(res.PlanJSON) > 0 && r.Command == "plan" && !isDriftCheck(r.Args) {
+			// the changes are taken from the plan rather than trusted
+			changes, rs, err := ParsePlan(res.PlanJSON)
+			if err != nil {
+				l.WithError(err).Warn("failed to parse plan json")
+			}
+			r.Changes, resources = changes, rs
+		}
+		if r.Status == "" {
+			r.Status = statusFromExitCode(r.Args, exitCode)
+		}
+		// fall back to inferring the status of commands run through
+		// the terraform passthrough from their output
+		if r.Status == "" {
+			r.Status = WorkspaceStatusUnknown
+			if output != "" {
+				sw := Workspace{Org: r.Org, Name: r.Name, Output: output}
+				if err := sw.InferStateFromOutput(); err != nil {
+					return err
+				}
+				r.Status = sw.Status
+			}
+		}
+		sw := Workspace{Status: r.Status}
+		if err := sw.EnsureValidStatus(); err != nil {
+			return err
+		}
+		timeout := time.Duration(res.ApprovalTimeoutSeconds) * time.Second
+		r.checkServerPolicies(resources, len(res.PlanJSON) > 0, timeout)
+		if r.Status == WorkspaceStatusAwaitingApproval {
+			if err := r.requestApproval(timeout, now); err != nil {
+				return err
+			}
+		}
+		r.setOutput(stored)
+		if err := tx.Save(r).Error; err != nil {
+			return err
+		}
+		for i := range resources {
+			resources[i].ID = 0
+			resources[i].RunID = r.ID
+		}
+		if len(resources) > 0 {
+			if err := tx.CreateInBatches(resources, 100).Error; err != nil {
+				return err
+			}
+		}
+		r.Resources = resources
+		if ev, ok := r.finishEvent(); ok {
+			if err := emitEvent(tx, ev); err != nil {
+				return err
+			}
+		}
+		if !hasWorkspace {
+			return nil
+		}
+		if isDriftCheck(r.Args) {
+			return r.finishDriftCheck(tx, &w)
+		}
+		if r.Speculative {
+			return nil
+		}
+		updates := map[string]interface{}{
+			"latest_run_id": r.ID,
+		}
+		// commands which neither plan nor apply, such as state rm, do
+		// not change the status of the workspace
+		if r.inProgressStatus() != "" {
+			if err := w.transitionUpdates(tx, r.Status, &r.ID, updates); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&w).Updates(updates).Error
+	})
+	if err != nil {
+		stored.discard()
+		l.WithError(err).Error("failed to finish run")
+		return err
+	}
+	notify(runLogKey(r.ID))
+	l.Debug("end")
+	return nil
+}
+
+// lockForFinish loads and locks the workspace and the run within tx, and
+// checks the run may be finished by the holder of lockId: the run must not
+// be finished, and lockId must be the lock of the run and still hold the
+// workspace. It returns the workspace, and whether it exists.
+func (r *Run) lockForFinish(tx *gorm.DB, lockId string) (Workspace, bool, error) {
+	// the workspace row is locked before the run, as in the lock
+	// endpoints which abandon runs
+	w, err := getWorkspaceForUpdate(tx, r.Org, r.Name)
+	hasWorkspace := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return w, false, err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("org = ? AND name = ?", r.Org, r.Name).
+		First(r, r.ID).Error; err != nil {
+		return w, hasWorkspace, err
+	}
+	if r.FinishedAt != nil {
+		return w, hasWorkspace, ErrRunFinished
+	}
+	if err := checkNotEvicted(tx, r.LockId); err != nil {
+		return w, hasWorkspace, err
+	}
+	if r.LockId == nil || *r.LockId != lockId {
+		return w, hasWorkspace, ErrLockNotHeld
+	}
+	if hasWorkspace {
+		if err := checkLockHeld(tx, &w, r.LockId); err != nil {
+			return w, hasWorkspace, err
+		}
+	}
+	return w, hasWorkspace, nil
+}
+
+// finishDriftCheck updates the workspace with the result of a drift check.
+// A workspace with drift is drifted, and a drifted workspace without drift
+// is applied again, but the check does not otherwise change the status of
+// the workspace or become its latest run, so that the output of the latest
+// apply is kept.
+func (r *Run) finishDriftCheck(tx *gorm.DB, w *Workspace) error {
+	if err := tx.Model(w).Update("latest_drift_run_id", r.ID).Error; err != nil {
+		return err
+	}
+	switch {
+	case r.Status == WorkspaceStatusDrifted && CanTransition(w.Status, r.Status):
+		return w.transition(tx, r.Status, &r.ID)
+	case r.Status == WorkspaceStatusApplied && w.Status == WorkspaceStatusDrifted:
+		return w.transition(tx, r.Status, &r.ID)
+	}
+	return nil
+}
+
+// checkNotEvicted returns ErrLockEvicted if lockId was force-unlocked
+func checkNotEvicted(tx *gorm.DB, lockId *string) error {
+	if lockId == nil {
+		return nil
+	}
+	var n int64
+	if err := tx.Model(&LockTicket{}).
+		Where("lock_id = ? AND status = ?", *lockId, LockTicketEvicted).
+		Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrLockEvicted
+	}
+	return nil
+}
+
+// checkLockHeld returns ErrLockNotHeld unless lockId holds the exclusive
+// lock of the workspace w, or a granted shared lock of it
+func checkLockHeld(tx *gorm.DB, w *Workspace, lockId *string) error {
+	if lockId == nil || *lockId == "" {
+		return ErrLockNotHeld
+	}
+	if w.LockId != nil && *w.LockId == *lockId {
+		return nil
+	}
+	var n int64
+	if err := tx.Model(&LockTicket{}).
+		Where("org = ? AND name = ? AND lock_id = ? AND status = ? AND mode = ?", w.Org, w.Name, *lockId, LockTicketGranted, LockModeShared).
+		Count(&n).Error; err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// abandonRuns marks the unfinished runs of lockId as finished, for when
+// their client has gone away without reporting a result. Runs whose lock
+// expired are errored, and those whose lock was released or force-unlocked
+// were cancelled. A workspace left planning or applying by the runs takes
+// the same status.
+func abandonRuns(tx *gorm.DB, lockId string, lockStatus LockTicketStatus, now time.Time) error {
+	var runs []Run
+	if err := tx.Where("lock_id = ? AND finished_at IS NULL", lockId).Find(&runs).Error; err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	status := abandonedStatus(lockStatus)
+	if err := tx.Model(&Run{}).
+		Where("lock_id = ? AND finished_at IS NULL", lockId).
+		Updates(map[string]interface{}{
+			"finished_at": now,
+			"status":      status,
+		}).Error; err != nil {
+		return err
+	}
+	for _, r := range runs {
+		r.Status = status
+		r.FinishedAt = &now
+		if ev, ok := r.finishEvent(); ok {
+			if err := emitEvent(tx, ev); err != nil {
+				return err
+			}
+		}
+		if r.inProgressStatus() == "" {
+			continue
+		}
+		w, err := getWorkspaceForUpdate(tx, r.Org, r.Name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !w.Status.InProgress() {
+			continue
+		}
+		if err := w.transition(tx, status, &r.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abandonedStatus returns the status of runs abandoned when their lock was
+// closed with lockStatus
+func abandonedStatus(lockStatus LockTicketStatus) WorkspaceStatus {
+	if lockStatus == LockTicketExpired {
+		return WorkspaceStatusErrored
+	}
+	return WorkspaceStatusCancelled
+}
+
+// GetRun returns the run of the workspace with the given id
+func GetRun(org, name string, id uint) (Run, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "GetRun",
+		"org": org,
+		"ws":  name,
+		"run": id,
+	})
+	l.Debug("start")
+	var r Run
+	if err := db.DB.Where("org = ? AND name = ?", org, name).First(&r, id).Error; err != nil {
+		l.WithError(err).Error("failed to get run")
+		return r, err
+	}
+	if err := r.loadOutput(); err != nil {
+		l.WithError(err).Error("failed to load run output")
+		return r, err
+	}
+	if err := r.loadResources(); err != nil {
+		l.WithError(err).Error("failed to load run resources")
+		return r, err
+	}
+	l.Debug("end")
+	return r, nil
+}
+
+// ListRuns returns the runs of the workspace, newest first, without their
+// output. If before is set, only runs older than it are returned.
+func ListRuns(org, name string, before uint, limit int) ([]Run, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ListRuns",
+		"org": org,
+		"ws":  name,
+	})
+	l.Debug("start")
+	var runs []Run
+	q := db.DB.Where("org = ? AND name = ?", org, name)
+	if before > 0 {
+		q = q.Where("id < ?", before)
+	}
+	if err := q.Order("id desc").Limit(limit).Find(&runs).Error; err != nil {
+		l.WithError(err).Error("failed to list runs")
+		return nil, err
+	}
+	l.Debug("end")
+	return runs, nil
+}
+
+// loadLatestOutput sets the output of the workspace to that of its latest run
+func (w *Workspace) loadLatestOutput() error {
+	if w.LatestRunId == nil {
+		return nil
+	}
+	var r Run
+	if err := db.DB.First(&r, *w.LatestRunId).Error; err != nil {
+		return err
+	}
+	if err := r.loadOutput(); err != nil {
+		return err
+	}
+	w.Output = r.Output
+	return nil
+}
+
+// outputMaxBytes returns the largest run output which is stored. Larger
+// output is truncated.
+func outputMaxBytes() int {
+	if v := os.Getenv("MONOTF_OUTPUT_MAX_BYTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return DefaultOutputMaxBytes
+}
+
+// truncateOutput returns the output cut down to at most max bytes, keeping
+// its head and tail, and whether it was truncated. The cuts are made on
+// rune boundaries, so that multi-byte characters are not split.
+func truncateOutput(o string, max int) (string, bool) {
+	if len(o) <= max {
+		return o, false
+	}
+	half := max / 2
+	head := half
+	for head > 0 && !utf8.RuneStart(o[head]) {
+		head--
+	}
+	if esc, end := openEscape(o, head); esc >= 0 && end > head {
+		head = esc
+	}
+	tail := len(o) - half
+	for tail < len(o) && !utf8.RuneStart(o[tail]) {
+		tail++
+	}
+	if esc, end := openEscape(o, tail); esc >= 0 && end > tail {
+		tail = end
+	}
+	marker := fmt.Sprintf("\n... [truncated %d bytes] ...\n", tail-head)
+	return o[:head] + marker + o[tail:], true
+}
+
+// openEscape returns the start and end of the last ANSI escape sequence,
+// such as a color, which starts before i, or -1 if there is none nearby
+func openEscape(o string, i int) (int, int) {
+	esc := strings.LastIndexByte(o[:i], 0x1b)
+	if esc < 0 || i-esc > 32 {
+		return -1, -1
+	}
+	// a CSI sequence is ESC [ followed by parameters and a final byte
+	// between @ and ~
+	for end := esc + 2; end < len(o) && end-esc <= 32; end++ {
+		if o[end] >= 0x40 && o[end] <= 0x7e {
+			return esc, end + 1
+		}
+	}
+	return -1, -1
+}
+
+// outputKey returns a new blob key for the output of the run. Each key is
+// unique, so that output written for a run which is then not saved cannot
+// replace the output of a saved run.
+func (r *Run) outputKey() string {
+	return fmt.Sprintf("runs/%s/%s/%s.log.gz", url.PathEscape(r.Org), url.PathEscape(r.Name), uuid.New().String())
+}
+
+// runOutput is the output of a run written to the blob store, which is set
+// on the run when it is saved
+type runOutput struct {
+	key       string
+	size      int
+	truncated bool
+	output    string
+}
+
+// writeOutput compresses the output of the run into the blob store. It is
+// written before the transaction which saves the run, so that rows are not
+// locked while the blob store is written, and is discarded if the
+// transaction fails.
+func (r *Run) writeOutput(output string) (runOutput, error) {
+	o := runOutput{size: len(output), output: output}
+	if output == "" {
+		return o, nil
+	}
+	o.output, o.truncated = truncateOutput(output, outputMaxBytes())
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(o.output)); err != nil {
+		return o, err
+	}
+	if err := zw.Close(); err != nil {
+		return o, err
+	}
+	key := r.outputKey()
+	if err := blob.Default.Put(key, buf.Bytes()); err != nil {
+		return o, err
+	}
+	o.key = key
+	return o, nil
+}
+
+// setOutput sets the output written by writeOutput on the run, which must
+// be saved afterwards
+func (r *Run) setOutput(o runOutput) {
+	r.OutputSize = o.size
+	r.OutputTruncated = o.truncated
+	r.OutputKey = o.key
+	r.Output = o.output
+}
+
+// discard deletes the output from the blob store, for when the run it was
+// written for was not saved
+func (o runOutput) discard() {
+	if o.key == "" {
+		return
+	}
+	if err := blob.Default.Delete(o.key); err != nil {
+		log.WithField("key", o.key).WithError(err).Warn("failed to delete unsaved run output")
+	}
+}
+
+// loadOutput reads the output of the run from the blob store
+func (r *Run) loadOutput() error {
+	if r.OutputKey == "" {
+		return nil
+	}
+	data, err := blob.Default.Get(r.OutputKey)
+	if errors.Is(err, blob.ErrNotFound) {
+		log.WithField("run", r.ID).Warn("run output is missing from the blob store")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+	r.Output = string(out)
+	return nil
+}
+
+// outputRetention returns how long run output is kept, and how many runs
+// of each workspace keep their output. Zero means no limit.
+func outputRetention() (time.Duration, int) {
+	var age time.Duration
+	var runs int
+	if v := os.Getenv("MONOTF_OUTPUT_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			age = d
+		}
+	}
+	if v := os.Getenv("MONOTF_OUTPUT_RETENTION_RUNS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			runs = n
+		}
+	}
+	return age, runs
+}
+
+// pruneOutput deletes the output of the runs from the blob store. The
+// runs are kept as history.
+func pruneOutput(runs []Run, now time.Time) error {
+	for _, r := range runs {
+		if err := blob.Default.Delete(r.OutputKey); err != nil {
+			return err
+		}
+		if err := db.DB.Model(&Run{}).Where("id = ?", r.ID).Updates(map[string]interface{}{
+			"output_key":       "",
+			"output_pruned_at": now,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneRunOutput deletes the streamed log chunks of finished runs, the
+// output of runs past the retention limits, and stale or expired plans. The
+// output of the latest run of each workspace is always kept.
+func PruneRunOutput() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "PruneRunOutput",
+	})
+	l.Debug("start")
+	now := time.Now()
+	if err := db.DB.Where("run_id IN (?)",
+		db.DB.Model(&Run{}).Select("id").Where("finished_at < ?", now.Add(-runLogRetention))).
+		Delete(&RunLog{}).Error; err != nil {
+		l.WithError(err).Error("failed to prune run logs")
+		return err
+	}
+	age, keep := outputRetention()
+	latest := db.DB.Model(&Workspace{}).Select("latest_run_id").Where("latest_run_id IS NOT NULL")
+	if age > 0 {
+		var runs []Run
+		if err := db.DB.Where("output_key <> '' AND finished_at < ? AND id NOT IN (?)", now.Add(-age), latest).
+			Find(&runs).Error; err != nil {
+			l.WithError(err).Error("failed to list expired run output")
+			return err
+		}
+		if err := pruneOutput(runs, now); err != nil {
+			l.WithError(err).Error("failed to prune expired run output")
+			return err
+		}
+	}
+	if keep > 0 {
+		var wss []Run
+		if err := db.DB.Model(&Run{}).Select("org, name").Where("output_key <> ''").
+			Group("org, name").Having("count(*) > ?", keep).Find(&wss).Error; err != nil {
+			l.WithError(err).Error("failed to list workspaces over run output retention")
+			return err
+		}
+		for _, ws := range wss {
+			var runs []Run
+			if err := db.DB.Where("org = ? AND name = ? AND output_key <> '' AND id NOT IN (?)", ws.Org, ws.Name, latest).
+				Order("id desc").Offset(keep).Limit(1000).Find(&runs).Error; err != nil {
+				l.WithError(err).Error("failed to list run output over retention")
+				return err
+			}
+			if err := pruneOutput(runs, now); err != nil {
+				l.WithError(err).Error("failed to prune run output over retention")
+				return err
+			}
+		}
+	}
+	if err := prunePlans(now); err != nil {
+		l.WithError(err).Error("failed to prune plans")
+		return err
+	}
+	l.Debug("end")
+	return nil
+}
+
+func pruneRunOutput() {
+	l := log.WithField("func", "pruneRunOutput")
+	l.Debug("pruning run output")
+	for {
+		time.Sleep(5 * time.Minute)
+		if err := PruneRunOutput(); err != nil {
+			l.WithError(err).Error("error pruning run output")
+		}
+	}
+}
+
+// migrateWorkspaceOutput moves the output stored on workspaces by older
+// versions of the server into runs in the blob store. The column is kept,
+// so that the output is not lost if the server is rolled back.
+func migrateWorkspaceOutput() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "migrateWorkspaceOutput",
+	})
+	if !db.DB.Migrator().HasColumn(&Workspace{}, "output") {
+		return nil
+	}
+	var legacy []struct {
+		ID        uint
+		Org       string
+		Name      string
+		Status    WorkspaceStatus
+		Output    string
+		UpdatedAt time.Time
+	}
+	if err := db.DB.Table("workspaces").Select("id, org, name, status, output, updated_at").
+		Where("output <> '' AND latest_run_id IS NULL AND deleted_at IS NULL").
+		Scan(&legacy).Error; err != nil {
+		l.WithError(err).Error("failed to list workspace output")
+		return err
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	l.Info("migrating workspace output to runs")
+	for _, w := range legacy {
+		finished := w.UpdatedAt
+		run := Run{
+			Org:        w.Org,
+			Name:       w.Name,
+			StartedAt:  finished,
+			FinishedAt: &finished,
+			Status:     w.Status,
+		}
+		stored, err := run.writeOutput(w.Output)
+		if err != nil {
+			l.WithError(err).WithField("ws", w.Name).Error("failed to store workspace output")
+			return err
+		}
+		run.setOutput(stored)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&run).Error; err != nil {
+				return err
+			}
+			return tx.Model(&Workspace{}).Where("id = ?", w.ID).Update("latest_run_id", run.ID).Error
+		})
+		if err != nil {
+			stored.discard()
+			l.WithError(err).WithField("ws", w.Name).Error("failed to migrate workspace output")
+			return err
+		}
+	}
+	l.Infof("migrated the output of %d workspaces to runs", len(legacy))
+	return nil
+}
+
+func HandleListRuns(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleListRuns",
+	})
+	l.Debug("start")
+	vars := mux.Vars(r)
+	limit := DefaultRunListLimit
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid limit %s", v)
+			return
+		}
+		limit = n
+	}
+	var before uint64
+	if v := r.FormValue("before"); v != "" {
+		var err error
+		before, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid before %s", v)
+			return
+		}
+	}
+	runs, err := ListRuns(vars["org"], vars["name"], uint(before), limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(runs); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+// runFromRequest returns the run identified by the request path
+func runFromRequest(r *http.Request) (Run, error) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		return Run{}, fmt.Errorf("invalid run id %s", vars["id"])
+	}
+	run := Run{
+		Org:  vars["org"],
+		Name: vars["name"],
+	}
+	run.ID = uint(id)
+	return run, nil
+}
+
+func HandleGetRun(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleGetRun",
+	})
+	l.Debug("start")
+	run, err := runFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	run, err = GetRun(run.Org, run.Name, run.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(run); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleStartRun(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleStartRun",
+	})
+	l.Debug("start")
+	var run Run
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&run); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	vars := mux.Vars(r)
+	run.Org = vars["org"]
+	run.Name = vars["name"]
+	if role := run.requiredRole(); !requestHasRole(r, role) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "the %s role is required to run terraform %s", role, run.Command)
+		return
+	}
+	if err := run.Start(); err != nil {
+		switch {
+		case errors.Is(err, ErrLockEvicted), errors.Is(err, ErrLockNotHeld), errors.Is(err, ErrInvalidTransition),
+			errors.Is(err, ErrStalePlan), errors.Is(err, ErrNoPlan), errors.Is(err, ErrPlanNotFinished),
+			errors.Is(err, ErrNotApproved), errors.Is(err, ErrPolicyFailed):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(run); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleFinishRun(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleFinishRun",
+	})
+	l.Debug("start")
+	run, err := runFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	var res RunResult
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// the run is finished with the role it was started with
+	var started Run
+	if err := db.DB.Where("org = ? AND name = ?", run.Org, run.Name).First(&started, run.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if role := started.requiredRole(); !requestHasRole(r, role) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "the %s role is required to run terraform %s", role, started.Command)
+		return
+	}
+	if err := run.Finish(res); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrLockEvicted), errors.Is(err, ErrLockNotHeld), errors.Is(err, ErrRunFinished), errors.Is(err, ErrInvalidTransition),
+			errors.Is(err, ErrNoPlan):
+			w.WriteHeader(http.StatusConflict)
+		case errors.Is(err, ErrNotPlan):
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(run); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
@@ -0,0 +1,29 @@
+package monotf
+
+import "testing"
+
+func TestTruncateOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		max       int
+		want      string
+		truncated bool
+	}{
+		{"fits", "hello", 5, "hello", false},
+		{"ascii", "abcdefghij", 4, "ab\n... [truncated 6 bytes] ...\nij", true},
+		{"multi-byte runes", "a€€b", 4, "a\n... [truncated 6 bytes] ...\nb", true},
+		{"multi-byte text", "日本語のテキスト", 10, "日\n... [truncated 18 bytes] ...\nト", true},
+		{"escape across head and tail", "ab\x1b[31mcdefghij\x1b[0mkl", 6, "ab\n... [truncated 17 bytes] ...\nkl", true},
+		{"escape across tail", "abcdefgh\x1b[31mijk", 8, "abcd\n... [truncated 9 bytes] ...\nijk", true},
+		{"escape closed before tail", "ab\x1b[1;32mcdefghijklmnopq\x1b[0mz", 12, "ab\n... [truncated 21 bytes] ...\nq\x1b[0mz", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := truncateOutput(tt.output, tt.max)
+			if got != tt.want || truncated != tt.truncated {
+				t.Errorf("truncateOutput(%q, %d) = %q, %v, want %q, %v", tt.output, tt.max, got, truncated, tt.want, tt.truncated)
+			}
+		})
+	}
+}
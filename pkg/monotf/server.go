@@ -1,18 +1,21 @@
 package monotf
 
 import (
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/robertlestak/monotf/internal/blob"
 	"github.com/robertlestak/monotf/internal/db"
 	"github.com/robertlestak/monotf/internal/metrics"
 	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
 func HandleSaveWorkspace(w http.ResponseWriter, r *http.Request) {
@@ -29,15 +32,7 @@ func HandleSaveWorkspace(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// if output is base64 encoded, decode
-	if ws.Output != "" {
-		decoded, err := base64.StdEncoding.DecodeString(ws.Output)
-		if err != nil {
-			l.WithError(err).Debug("failed to decode base64 output")
-			// assume it's not base64 encoded
-		} else {
-			ws.Output = string(decoded)
-		}
-	}
+	ws.Output = decodeOutput(ws.Output)
 	if ws.Status == "" && ws.Output != "" {
 		ws.Status = "unknown"
 		if err := ws.InferStateFromOutput(); err != nil {
@@ -49,7 +44,11 @@ func HandleSaveWorkspace(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := ws.Save(); err != nil {
 		l.WithError(err).Error("failed to save workspace")
-		w.WriteHeader(http.StatusInternalServerError)
+		if errors.Is(err, ErrLockEvicted) || errors.Is(err, ErrInvalidTransition) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		fmt.Fprintf(w, "%s", err.Error())
 		return
 	}
@@ -94,6 +93,20 @@ func HandleGetWorkspace(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if ws.Readers > 0 {
+		if err := ws.loadSharedLocks(); err != nil {
+			l.WithError(err).Error("failed to get shared locks")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+	}
+	if err := ws.loadLatestOutput(); err != nil {
+		l.WithError(err).Error("failed to get latest run output")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
 	if err := json.NewEncoder(w).Encode(ws); err != nil {
 		l.WithError(err).Error("failed to encode response body")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -341,6 +354,9 @@ func getMetrics() error {
 			for status, cv := range c.Counts {
 				metrics.OrgStatusSummary.WithLabelValues(c.Org, string(status)).Set(float64(cv))
 			}
+			for action, cv := range c.Changes {
+				metrics.OrgPendingChanges.WithLabelValues(c.Org, string(action)).Set(float64(cv))
+			}
 		}
 	}()
 	go func() {
@@ -350,13 +366,30 @@ func getMetrics() error {
 			return
 		}
 		for _, w := range ws {
-			metrics.WorkspaceStatus.WithLabelValues(w.Org, w.Name, w.Version, string(w.Status)).Set(1)
+			// set the other statuses to 0, so that only the current
+			// status of the workspace is reported
+			for _, status := range WorkspaceStatuses {
+				v := 0.0
+				if status == w.Status {
+					v = 1
+				}
+				metrics.WorkspaceStatus.WithLabelValues(w.Org, w.Name, w.Version, string(status)).Set(v)
+			}
+			if w.StatusChangedAt != nil {
+				metrics.WorkspaceStatusChangedAt.WithLabelValues(w.Org, w.Name).Set(float64(w.StatusChangedAt.Unix()))
+			}
 			metrics.WorkspaceLastRun.WithLabelValues(w.Org, w.Name).Set(float64(w.UpdatedAt.Unix()))
 			if w.Running != nil && *w.Running {
 				metrics.WorkspaceRunning.WithLabelValues(w.Org, w.Name).Set(1)
 			} else {
 				metrics.WorkspaceRunning.WithLabelValues(w.Org, w.Name).Set(0)
 			}
+			metrics.WorkspaceReaders.WithLabelValues(w.Org, w.Name).Set(float64(w.Readers))
+			if w.LockExpiresAt != nil {
+				metrics.WorkspaceLockExpiresAt.WithLabelValues(w.Org, w.Name).Set(float64(w.LockExpiresAt.Unix()))
+			} else {
+				metrics.WorkspaceLockExpiresAt.WithLabelValues(w.Org, w.Name).Set(0)
+			}
 		}
 	}()
 	return nil
@@ -374,9 +407,22 @@ func refreshMetrics() {
 	}
 }
 
-// authMiddleware will check if there is a MONOTF_TOKEN environment variable
-// if so, it will check if the request has a header with the same token in it
-// if not, it will return a 401
+// routeTemplate returns the route of the request, e.g. /ws/{org}/{name}, or
+// its path if it did not match a route
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if t, err := route.GetPathTemplate(); err == nil {
+			return t
+		}
+	}
+	return r.URL.Path
+}
+
+// authMiddleware requires requests to present MONOTF_TOKEN,
+// MONOTF_ADMIN_TOKEN, or an active API token, and checks API tokens may
+// call the endpoint. If MONOTF_TOKEN is not set and no API token has been
+// created, requests without a token are allowed. Invalid, expired, or
+// revoked tokens are always rejected with a 401.
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		l := log.WithFields(log.Fields{
@@ -384,26 +430,60 @@ func authMiddleware(next http.Handler) http.Handler {
 			"fn":  "authMiddleware",
 		})
 		l.Debug("start")
-		if os.Getenv("MONOTF_TOKEN") == "" {
-			next.ServeHTTP(w, r)
-			return
-		}
 		token := r.Header.Get("Authorization")
+		if token == "" && os.Getenv("MONOTF_TOKEN") == "" {
+			exist, err := tokensExist()
+			if err != nil {
+				l.WithError(err).Error("failed to check for tokens")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !exist {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
 		if token == "" {
 			l.Debug("no token provided")
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		if token != "token "+os.Getenv("MONOTF_TOKEN") && token != os.Getenv("MONOTF_TOKEN") {
+		// MONOTF_TOKEN and MONOTF_ADMIN_TOKEN are not limited by role or
+		// scope, so that they can be used to create the first API tokens
+		if hasEnvToken(r) || hasAdminToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t, err := lookupToken(strings.TrimPrefix(token, "token "))
+		if err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				l.WithError(err).Error("failed to look up token")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 			l.Debug("invalid token")
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		next.ServeHTTP(w, r)
+		endpoint := routeTemplate(r)
+		if err := authorizeToken(t, r, endpoint); err != nil {
+			l.WithField("token", t.Name).WithError(err).Debug("token not authorized")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+		next.ServeHTTP(w, withToken(r, t))
 		l.Debug("end")
 	})
 }
 
+// models are the tables of the server, which are migrated when it starts
+var models = []interface{}{
+	&Workspace{}, &LockTicket{}, &ConcurrencyLimit{}, &Run{}, &RunLog{}, &PlanResource{},
+	&WorkspaceStatusTransition{}, &ProtectionOverride{}, &Freeze{}, &Webhook{}, &WebhookDelivery{},
+	&AuditEntry{}, &AuditChainHead{}, &APIToken{},
+}
+
 func Server(port int) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "ws",
@@ -413,24 +493,84 @@ func Server(port int) error {
 	if err := db.Init(); err != nil {
 		l.Fatal(err)
 	}
-	db.DB.AutoMigrate(&Workspace{})
+	if err := blob.Init(); err != nil {
+		l.Fatal(err)
+	}
+	db.DB.AutoMigrate(models...)
+	if err := migrateWorkspaceOutput(); err != nil {
+		l.Fatal(err)
+	}
+	if err := initAuditChain(); err != nil {
+		l.Fatal(err)
+	}
+	if err := loadServerPolicies(); err != nil {
+		l.Fatal(err)
+	}
 	metrics.Init()
 	go refreshMetrics()
+	go reapExpiredLocks()
+	go pruneRunOutput()
+	go deliverWebhooks()
 	r := mux.NewRouter()
 	ar := r.NewRoute().Subrouter()
 	r.Handle("/metrics", promhttp.Handler())
 	ar.Use(authMiddleware)
+	ar.Use(auditMiddleware)
 	ar.HandleFunc("/orgs", HandleListOrgs).Methods("GET")
 	ar.HandleFunc("/orgs/status-count", HandleAllStatusCount).Methods("GET")
+	ar.HandleFunc("/changes", HandleListPendingChanges).Methods("GET")
 	ar.HandleFunc("/ws", HandleSaveWorkspace).Methods("PUT", "POST")
 	ar.HandleFunc("/ws/org/like", HandleListOrgWorkspacesLike).Methods("GET")
 	ar.HandleFunc("/ws/all", HandleListAllWorkspaces).Methods("GET")
 	ar.HandleFunc("/ws/all/like", HandleListAllWorkspacesLike).Methods("GET")
 	ar.HandleFunc("/ws/{org}/status-count", HandleOrgStatusCount).Methods("GET")
+	ar.HandleFunc("/ws/{org}/changes", HandleListPendingChanges).Methods("GET")
 	ar.HandleFunc("/ws/status/{status}", HandleListAllWorkspacesByStatus).Methods("GET")
 	ar.HandleFunc("/ws/org/{org}", HandleListOrgWorkspaces).Methods("GET")
 	ar.HandleFunc("/ws/{org}/{name}", HandleDeleteWorkspace).Methods("DELETE")
 	ar.HandleFunc("/ws/{org}/{name}", HandleGetWorkspace).Methods("GET")
+	ar.HandleFunc("/ws/{org}/{name}/lock", HandleAcquireLock).Methods("POST")
+	ar.HandleFunc("/ws/{org}/{name}/lock", HandleReleaseLock).Methods("DELETE")
+	ar.HandleFunc("/ws/{org}/{name}/lock/heartbeat", HandleRenewLock).Methods("POST")
+	ar.HandleFunc("/ws/{org}/{name}/unlock", HandleForceUnlock).Methods("POST")
+	ar.HandleFunc("/ws/{org}/{name}/queue", HandleGetQueueStatus).Methods("GET")
+	ar.HandleFunc("/ws/{org}/{name}/wait", HandleWaitLock).Methods("GET")
+	ar.HandleFunc("/ws/{org}/{name}/events", HandleLockEvents).Methods("GET")
+	ar.HandleFunc("/ws/{org}/{name}/status-history", HandleListStatusTransitions).Methods("GET")
+	ar.HandleFunc("/ws/{org}/{name}/overrides", HandleListOverrides).Methods("GET")
+	ar.HandleFunc("/ws/{org}/{name}/overrides", HandleRecordOverride).Methods("POST")
+	ar.HandleFunc("/ws/{org}/{name}/runs", HandleListRuns).Methods("GET")
+	ar.HandleFunc("/ws/{org}/{name}/runs", HandleStartRun).Methods("POST")
+	ar.HandleFunc("/ws/{org}/{name}/runs/{id}", HandleGetRun).Methods("GET")
+	ar.HandleFunc("/ws/{org}/{name}/runs/{id}", HandleFinishRun).Methods("PUT")
+	ar.HandleFunc("/ws/{org}/{name}/runs/{id}/approve", HandleApproveRun).Methods("POST")
+	ar.HandleFunc("/ws/{org}/{name}/runs/{id}/reject", HandleRejectRun).Methods("POST")
+	ar.HandleFunc("/ws/{org}/{name}/runs/{id}/plan", HandleDownloadPlan).Methods("GET")
+	ar.HandleFunc("/ws/{org}/{name}/runs/{id}/plan", HandleUploadPlan).Methods("PUT")
+	ar.HandleFunc("/ws/{org}/{name}/runs/{id}/logs", HandleRunLogs).Methods("GET")
+	ar.HandleFunc("/ws/{org}/{name}/runs/{id}/logs", HandleAppendRunLog).Methods("POST")
+	ar.HandleFunc("/locks", HandleAcquireLockSet).Methods("POST")
+	ar.HandleFunc("/locks/release", HandleReleaseLockSet).Methods("POST")
+	ar.HandleFunc("/limits", HandleListConcurrencyLimits).Methods("GET")
+	ar.HandleFunc("/limits", HandleSaveConcurrencyLimit).Methods("PUT", "POST")
+	ar.HandleFunc("/limits/{id}", HandleDeleteConcurrencyLimit).Methods("DELETE")
+	ar.HandleFunc("/freezes", HandleListFreezes).Methods("GET")
+	ar.HandleFunc("/freezes", HandleSaveFreeze).Methods("POST")
+	ar.HandleFunc("/freezes/{id}", HandleGetFreeze).Methods("GET")
+	ar.HandleFunc("/freezes/{id}", HandleSaveFreeze).Methods("PUT")
+	ar.HandleFunc("/freezes/{id}", HandleDeleteFreeze).Methods("DELETE")
+	ar.HandleFunc("/webhooks", HandleListWebhooks).Methods("GET")
+	ar.HandleFunc("/webhooks", HandleSaveWebhook).Methods("POST")
+	ar.HandleFunc("/webhooks/{id}", HandleGetWebhook).Methods("GET")
+	ar.HandleFunc("/webhooks/{id}", HandleSaveWebhook).Methods("PUT")
+	ar.HandleFunc("/webhooks/{id}", HandleDeleteWebhook).Methods("DELETE")
+	ar.HandleFunc("/webhooks/{id}/deliveries", HandleListDeliveries).Methods("GET")
+	ar.HandleFunc("/audit", HandleListAuditEntries).Methods("GET")
+	ar.HandleFunc("/audit/export", HandleExportAuditEntries).Methods("GET")
+	ar.HandleFunc("/audit/verify", HandleVerifyAuditChain).Methods("GET")
+	ar.HandleFunc("/tokens", HandleListTokens).Methods("GET")
+	ar.HandleFunc("/tokens", HandleCreateToken).Methods("POST")
+	ar.HandleFunc("/tokens/{id}", HandleRevokeToken).Methods("DELETE")
 	ar.HandleFunc("/ws/{org}/status/{status}", HandleListOrgWorkspacesByStatus).Methods("GET")
 	ar.HandleFunc("/meta/statuses", HandleListValidStatuses).Methods("GET")
 	l.WithField("port", port).Info("starting server")
@@ -0,0 +1,212 @@
+package monotf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// DefaultStatusHistoryLimit is the number of status transitions returned
+	// if no limit is given
+	DefaultStatusHistoryLimit = 50
+)
+
+var (
+	// ErrInvalidTransition is returned when a workspace cannot move from its
+	// current status to the requested one
+	ErrInvalidTransition = errors.New("invalid status transition")
+)
+
+// restingStatuses are the statuses of a workspace which is not running,
+// which are the outcomes of runs. A resting workspace may start a run, but
+// only moves to another resting status with the result of a drift check.
+var restingStatuses = []WorkspaceStatus{
+	WorkspaceStatusApplied,
+	WorkspaceStatusFailed,
+	WorkspaceStatusPending,
+	WorkspaceStatusUnknown,
+	WorkspaceStatusDrifted,
+	WorkspaceStatusCancelled,
+	WorkspaceStatusErrored,
+}
+
+// statusTransitions are the statuses a workspace may move to from each
+// status other than the resting statuses. A plan moves the workspace to
+// applied only if it has no changes.
+var statusTransitions = map[WorkspaceStatus][]WorkspaceStatus{
+	WorkspaceStatusPlanning: {
+		WorkspaceStatusApplied,
+		WorkspaceStatusFailed,
+		WorkspaceStatusPending,
+		WorkspaceStatusUnknown,
+		WorkspaceStatusAwaitingApproval,
+		WorkspaceStatusCancelled,
+		WorkspaceStatusErrored,
+	},
+	WorkspaceStatusApplying: {
+		WorkspaceStatusApplied,
+		WorkspaceStatusFailed,
+		WorkspaceStatusPending,
+		WorkspaceStatusUnknown,
+		WorkspaceStatusCancelled,
+		WorkspaceStatusErrored,
+	},
+	WorkspaceStatusAwaitingApproval: {
+		WorkspaceStatusPlanning,
+		WorkspaceStatusApplying,
+		WorkspaceStatusCancelled,
+		WorkspaceStatusErrored,
+	},
+}
+
+// WorkspaceStatusTransition records a change of the status of a workspace
+type WorkspaceStatusTransition struct {
+	ID        uint            `json:"id" gorm:"primarykey"`
+	Org       string          `json:"org" gorm:"index:idx_status_transition_org_name"`
+	Name      string          `json:"name" gorm:"index:idx_status_transition_org_name"`
+	From      WorkspaceStatus `json:"from"`
+	To        WorkspaceStatus `json:"to"`
+	RunID     *uint           `json:"run_id"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func statusIn(s WorkspaceStatus, statuses []WorkspaceStatus) bool {
+	for _, v := range statuses {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// InProgress returns true if the status is that of a running plan or apply
+func (s WorkspaceStatus) InProgress() bool {
+	return s == WorkspaceStatusPlanning || s == WorkspaceStatusApplying
+}
+
+// CanTransition returns true if a workspace may move from one status to
+// another. A workspace may always stay in its current status.
+func CanTransition(from, to WorkspaceStatus) bool {
+	if from == to || from == "" {
+		return true
+	}
+	if statusIn(from, restingStatuses) {
+		// a drift check finds a resting workspace drifted, or a drifted
+		// workspace in sync again
+		return to.InProgress() || to == WorkspaceStatusDrifted ||
+			(from == WorkspaceStatusDrifted && to == WorkspaceStatusApplied)
+	}
+	return statusIn(to, statusTransitions[from])
+}
+
+// getWorkspaceForUpdate returns the workspace, locking its row for the
+// rest of tx
+func getWorkspaceForUpdate(tx *gorm.DB, org, name string) (Workspace, error) {
+	var w Workspace
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("org = ? AND name = ?", org, name).
+		First(&w).Error
+	return w, err
+}
+
+// transitionUpdates checks that the workspace may move to status, and if
+// the status changes, records the transition within tx and adds it to
+// updates. The workspace row must be locked by tx.
+func (w *Workspace) transitionUpdates(tx *gorm.DB, status WorkspaceStatus, runId *uint, updates map[string]interface{}) error {
+	if w.Status == status {
+		return nil
+	}
+	if !CanTransition(w.Status, status) {
+		return fmt.Errorf("%w from %s to %s", ErrInvalidTransition, w.Status, status)
+	}
+	t := WorkspaceStatusTransition{
+		Org:   w.Org,
+		Name:  w.Name,
+		From:  w.Status,
+		To:    status,
+		RunID: runId,
+	}
+	if err := tx.Create(&t).Error; err != nil {
+		return err
+	}
+	updates["status"] = status
+	updates["status_changed_at"] = t.CreatedAt
+	return nil
+}
+
+// transition moves the workspace to status within tx, recording the
+// transition. The workspace row must be locked by tx.
+func (w *Workspace) transition(tx *gorm.DB, status WorkspaceStatus, runId *uint) error {
+	updates := make(map[string]interface{})
+	if err := w.transitionUpdates(tx, status, runId, updates); err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return tx.Model(w).Updates(updates).Error
+}
+
+// ListStatusTransitions returns the status transitions of the workspace,
+// newest first
+func ListStatusTransitions(org, name string, limit int) ([]WorkspaceStatusTransition, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ListStatusTransitions",
+		"org": org,
+		"ws":  name,
+	})
+	l.Debug("start")
+	if limit <= 0 {
+		limit = DefaultStatusHistoryLimit
+	}
+	var ts []WorkspaceStatusTransition
+	if err := db.DB.Where("org = ? AND name = ?", org, name).
+		Order("id desc").Limit(limit).Find(&ts).Error; err != nil {
+		l.WithError(err).Error("failed to list status transitions")
+		return nil, err
+	}
+	l.Debug("end")
+	return ts, nil
+}
+
+func HandleListStatusTransitions(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleListStatusTransitions",
+	})
+	l.Debug("start")
+	vars := mux.Vars(r)
+	var limit int
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid limit %s", v)
+			return
+		}
+	}
+	ts, err := ListStatusTransitions(vars["org"], vars["name"], limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ts); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
@@ -0,0 +1,512 @@
+package monotf
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// RoleRead may read workspaces, runs, and locks
+	RoleRead = "read"
+	// RolePlan may also take locks and record plans, speculative plans,
+	// and drift checks
+	RolePlan = "plan"
+	// RoleApply may also run commands which change state, such as apply
+	RoleApply = "apply"
+	// RoleAdmin is the role of requests which may perform admin operations,
+	// and which hold every other role
+	RoleAdmin = "admin"
+
+	// tokenPrefix starts each token, so that leaked tokens can be found
+	// by secret scanners
+	tokenPrefix = "mtf_"
+	// tokenTouchInterval is how often the last use of a token is recorded
+	tokenTouchInterval = time.Minute
+)
+
+var (
+	// Roles are the roles of API tokens, each of which holds the roles
+	// before it
+	Roles = []string{RoleRead, RolePlan, RoleApply, RoleAdmin}
+
+	ErrTokenExists = errors.New("an active token with this name exists")
+)
+
+// tokensCreated records that an API token has been created, so that
+// authMiddleware need not count tokens once one exists. Tokens are never
+// deleted, only revoked.
+var tokensCreated atomic.Bool
+
+// tokenContextKey is the request context key of the API token of the request
+type tokenContextKey struct{}
+
+// APIToken is a named token which authorizes requests to the server with
+// its roles, in the orgs and workspaces in its scope. Only the hash of the
+// token is stored, and the token itself is returned once when it is
+// created.
+type APIToken struct {
+	gorm.Model
+	Name string `json:"name" gorm:"index"`
+	// Prefix is the start of the token, to tell tokens apart
+	Prefix string `json:"prefix"`
+	Hash   string `json:"-" gorm:"uniqueIndex"`
+	// Secret is the token, only set in the response to its creation
+	Secret string `json:"secret,omitempty" gorm:"-"`
+	// Orgs limits the token to the workspaces of the orgs. If empty, the
+	// token may access all orgs.
+	Orgs []string `json:"orgs" gorm:"serializer:json"`
+	// Workspaces are globs of workspace names, e.g. prod-*. If set, the
+	// token may only access the matching workspaces, and not endpoints
+	// which list the workspaces of an org.
+	Workspaces []string `json:"workspaces" gorm:"serializer:json"`
+	Roles      []string `json:"roles" gorm:"serializer:json"`
+	// ExpiresAt is when the token stops being accepted, if set
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedBy  string     `json:"created_by"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// roleRank returns the position of role in Roles, or -1 if it is not one
+// of them
+func roleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// rolesInclude returns true if roles hold role. admin holds every role,
+// and each of Roles holds those before it.
+func rolesInclude(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+		if rank := roleRank(role); rank >= 0 && roleRank(r) >= rank {
+			return true
+		}
+	}
+	return false
+}
+
+// hashToken returns the stored hash of the token
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Validate checks the token has a name, valid roles, and valid globs
+func (t *APIToken) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("a name is required")
+	}
+	if len(t.Roles) == 0 {
+		return fmt.Errorf("at least one role is required")
+	}
+	for _, r := range t.Roles {
+		if roleRank(r) < 0 {
+			return fmt.Errorf("invalid role %s, must be one of %s", r, strings.Join(Roles, ", "))
+		}
+	}
+	for _, g := range t.Workspaces {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("invalid workspace glob %s", g)
+		}
+	}
+	return nil
+}
+
+// active returns true if the token has not been revoked or expired at now
+func (t *APIToken) active(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
+
+// scoped returns true if the token is limited to some orgs or workspaces
+func (t *APIToken) scoped() bool {
+	return len(t.Orgs) > 0 || len(t.Workspaces) > 0
+}
+
+// canAccessOrg returns true if the token may access every workspace of
+// the org
+func (t *APIToken) canAccessOrg(org string) bool {
+	if len(t.Workspaces) > 0 {
+		return false
+	}
+	if len(t.Orgs) == 0 {
+		return true
+	}
+	for _, o := range t.Orgs {
+		if o == org {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccess returns true if the workspace is in the scope of the token
+func (t *APIToken) canAccess(org, name string) bool {
+	if len(t.Orgs) > 0 {
+		found := false
+		for _, o := range t.Orgs {
+			found = found || o == org
+		}
+		if !found {
+			return false
+		}
+	}
+	return matchAny(t.Workspaces, name)
+}
+
+// lookupToken returns the active token with the given secret, and records
+// its use
+func lookupToken(secret string) (*APIToken, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	t := &APIToken{}
+	if err := db.DB.Where("hash = ?", hashToken(secret)).First(t).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !t.active(now) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > tokenTouchInterval {
+		if err := db.DB.Model(t).UpdateColumn("last_used_at", now).Error; err != nil {
+			log.WithFields(log.Fields{
+				"pkg":   "ws",
+				"fn":    "lookupToken",
+				"token": t.Name,
+			}).WithError(err).Warn("failed to record token use")
+		}
+	}
+	return t, nil
+}
+
+// tokensExist returns true if any API token has been created, including
+// tokens which have since been revoked or expired
+func tokensExist() (bool, error) {
+	if tokensCreated.Load() {
+		return true, nil
+	}
+	var n int64
+	if err := db.DB.Model(&APIToken{}).Unscoped().Limit(1).Count(&n).Error; err != nil {
+		return false, err
+	}
+	if n > 0 {
+		tokensCreated.Store(true)
+	}
+	return n > 0, nil
+}
+
+// requestToken returns the API token the request was authorized with, or
+// nil if it presented MONOTF_TOKEN or MONOTF_ADMIN_TOKEN
+func requestToken(r *http.Request) *APIToken {
+	t, _ := r.Context().Value(tokenContextKey{}).(*APIToken)
+	return t
+}
+
+// hasEnvToken returns true if the request presented MONOTF_TOKEN
+func hasEnvToken(r *http.Request) bool {
+	env := os.Getenv("MONOTF_TOKEN")
+	if env == "" {
+		return false
+	}
+	token := r.Header.Get("Authorization")
+	return token == "token "+env || token == env
+}
+
+// requestHasRole returns true if the request holds role. Requests which
+// did not present an API token hold the roles they held before API tokens.
+func requestHasRole(r *http.Request, role string) bool {
+	if t := requestToken(r); t != nil {
+		return rolesInclude(t.Roles, role)
+	}
+	if role == RoleAdmin {
+		return adminAuthorized(r)
+	}
+	return true
+}
+
+// requiredRole returns the role an API token needs to call the endpoint.
+// Endpoints which require admin check it in their handlers.
+func requiredRole(r *http.Request, endpoint string) string {
+	switch {
+	case r.Method == "GET" && endpoint == "/ws/{org}/{name}/runs/{id}/plan":
+		// plan files hold the values of the plan, including secrets, in
+		// plaintext
+		return RoleApply
+	case r.Method == "GET" || r.Method == "HEAD":
+		return RoleRead
+	case endpoint == "/ws":
+		// the workspace endpoint sets the status of the workspace directly
+		return RoleApply
+	case r.Method == "DELETE" && endpoint == "/ws/{org}/{name}":
+		return RoleAdmin
+	}
+	return RolePlan
+}
+
+// unscopedEndpoints are the endpoints which do not name a workspace and
+// which tokens limited to some orgs or workspaces may call
+var unscopedEndpoints = map[string]bool{
+	"/meta/statuses": true,
+	"/freezes":       true,
+	"/freezes/{id}":  true,
+}
+
+// authorizeToken returns an error if the API token may not call the
+// endpoint, for its role or for the workspaces it would access
+func authorizeToken(t *APIToken, r *http.Request, endpoint string) error {
+	if role := requiredRole(r, endpoint); !rolesInclude(t.Roles, role) {
+		return fmt.Errorf("token %s does not have the %s role", t.Name, role)
+	}
+	if !t.scoped() {
+		return nil
+	}
+	refs := requestWorkspaces(r, endpoint)
+	for _, ref := range refs {
+		if !t.canAccess(ref.Org, ref.Name) {
+			return fmt.Errorf("token %s may not access %s/%s", t.Name, ref.Org, ref.Name)
+		}
+	}
+	if len(refs) > 0 {
+		return nil
+	}
+	if org := mux.Vars(r)["org"]; org != "" {
+		if !t.canAccessOrg(org) {
+			return fmt.Errorf("token %s may not access all workspaces of %s", t.Name, org)
+		}
+		return nil
+	}
+	if !unscopedEndpoints[endpoint] {
+		return fmt.Errorf("token %s is limited to some orgs or workspaces, and may not call %s", t.Name, endpoint)
+	}
+	return nil
+}
+
+// newTokenSecret returns a random token
+func newTokenSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + hex.EncodeToString(b), nil
+}
+
+// Create creates the token, and sets its secret
+func (t *APIToken) Create() error {
+	l := log.WithFields(log.Fields{
+		"pkg":   "ws",
+		"fn":    "APIToken.Create",
+		"token": t.Name,
+	})
+	l.Debug("start")
+	if err := t.Validate(); err != nil {
+		l.WithError(err).Error("invalid token")
+		return err
+	}
+	secret, err := newTokenSecret()
+	if err != nil {
+		l.WithError(err).Error("failed to generate token")
+		return err
+	}
+	t.Model = gorm.Model{}
+	t.Hash = hashToken(secret)
+	t.Prefix = secret[:len(tokenPrefix)+8]
+	t.LastUsedAt = nil
+	t.RevokedAt = nil
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var existing []APIToken
+		if err := tx.Where("name = ? AND revoked_at IS NULL", t.Name).Find(&existing).Error; err != nil {
+			return err
+		}
+		for i := range existing {
+			if existing[i].active(time.Now()) {
+				return ErrTokenExists
+			}
+		}
+		return tx.Create(t).Error
+	})
+	if err != nil {
+		l.WithError(err).Error("failed to create token")
+		return err
+	}
+	tokensCreated.Store(true)
+	t.Secret = secret
+	l.WithField("roles", t.Roles).Info("token created")
+	l.Debug("end")
+	return nil
+}
+
+// ListTokens returns all tokens, including those which were revoked or
+// expired
+func ListTokens() ([]APIToken, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ListTokens",
+	})
+	l.Debug("start")
+	var tokens []APIToken
+	if err := db.DB.Order("id").Find(&tokens).Error; err != nil {
+		l.WithError(err).Error("failed to list tokens")
+		return nil, err
+	}
+	l.Debug("end")
+	return tokens, nil
+}
+
+// RevokeToken revokes the active token with the given id or name. Revoked
+// tokens are kept, so that the audit log can still be attributed to them.
+func RevokeToken(idOrName string) (*APIToken, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":   "ws",
+		"fn":    "RevokeToken",
+		"token": idOrName,
+	})
+	l.Debug("start")
+	t := &APIToken{}
+	q := db.DB.Where("revoked_at IS NULL")
+	if id, err := strconv.ParseUint(idOrName, 10, 64); err == nil {
+		q = q.Where("id = ? OR name = ?", id, idOrName)
+	} else {
+		q = q.Where("name = ?", idOrName)
+	}
+	if err := q.Order("id desc").First(t).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := db.DB.Model(t).Update("revoked_at", now).Error; err != nil {
+		l.WithError(err).Error("failed to revoke token")
+		return nil, err
+	}
+	t.RevokedAt = &now
+	l.Info("token revoked")
+	l.Debug("end")
+	return t, nil
+}
+
+// tokenAdminAuthorized returns true if the request may manage API tokens,
+// which MONOTF_TOKEN may always do so that the first tokens can be created
+func tokenAdminAuthorized(r *http.Request) bool {
+	return adminAuthorized(r) || (requestToken(r) == nil && hasEnvToken(r))
+}
+
+func HandleListTokens(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleListTokens",
+	})
+	l.Debug("start")
+	if !tokenAdminAuthorized(r) {
+		l.Debug("not authorized to manage tokens")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	tokens, err := ListTokens()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleCreateToken(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleCreateToken",
+	})
+	l.Debug("start")
+	if !tokenAdminAuthorized(r) {
+		l.Debug("not authorized to manage tokens")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var t APIToken
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := t.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if err := t.Create(); err != nil {
+		if errors.Is(err, ErrTokenExists) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleRevokeToken",
+	})
+	l.Debug("start")
+	if !tokenAdminAuthorized(r) {
+		l.Debug("not authorized to manage tokens")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	t, err := RevokeToken(mux.Vars(r)["id"])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+// withToken returns the request with its API token in its context
+func withToken(r *http.Request, t *APIToken) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, t))
+}
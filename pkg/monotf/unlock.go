@@ -0,0 +1,204 @@
+package monotf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ForceUnlockRequest is sent by an operator to release a stuck workspace lock
+type ForceUnlockRequest struct {
+	// Reason is required, and is recorded on the workspace
+	Reason string `json:"reason"`
+	// By is the identity of the token which made the request, which the
+	// server records as the operator. It is not read from the request.
+	By string `json:"-"`
+	// LockId optionally limits the unlock to the lock held by this id.
+	// If empty, the exclusive lock and all shared locks are released.
+	LockId string `json:"lock_id"`
+}
+
+// loadSharedLocks populates the granted shared locks of the workspace
+func (w *Workspace) loadSharedLocks() error {
+	return db.DB.Where("org = ? AND name = ? AND status = ? AND mode = ?",
+		w.Org, w.Name, LockTicketGranted, LockModeShared).
+		Order("id").Find(&w.SharedLocks).Error
+}
+
+// ForceUnlock releases the workspace lock regardless of its holder, and
+// records the reason. The evicted holders' lock ids are marked as evicted,
+// so any further writes or heartbeats from them are rejected. It returns
+// ErrLockNotHeld if there was nothing to unlock.
+func (w *Workspace) ForceUnlock(req ForceUnlockRequest) error {
+	l := log.WithFields(log.Fields{
+		"pkg":    "ws",
+		"fn":     "ForceUnlock",
+		"org":    w.Org,
+		"ws":     w.Name,
+		"by":     req.By,
+		"reason": req.Reason,
+	})
+	l.Debug("start")
+	if w.Org == "" || w.Name == "" {
+		l.Error("org or name is empty")
+		return fmt.Errorf("org or name is empty")
+	}
+	if req.Reason == "" {
+		l.Error("reason is empty")
+		return fmt.Errorf("a reason is required to force-unlock")
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("org = ? AND name = ?", w.Org, w.Name).
+			First(w).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		var evicted []string
+		held := w.Running != nil && *w.Running && w.LockId != nil
+		if held && (req.LockId == "" || req.LockId == *w.LockId) {
+			l.WithField("lock", *w.LockId).Warnf("force-unlocking lock held by %s", w.LockOwner)
+			evicted = append(evicted, *w.LockId)
+			w.EvictedLockId = w.LockId
+			running := false
+			w.Running = &running
+			w.LockId = nil
+			w.LockExpiresAt = nil
+			w.LockOwner = nil
+		}
+		var shared []LockTicket
+		q := tx.Where("org = ? AND name = ? AND status = ? AND mode = ?", w.Org, w.Name, LockTicketGranted, LockModeShared)
+		if req.LockId != "" {
+			q = q.Where("lock_id = ?", req.LockId)
+		}
+		if err := q.Find(&shared).Error; err != nil {
+			return err
+		}
+		for _, t := range shared {
+			l.WithField("lock", t.LockId).Warnf("force-unlocking shared lock held by %s", t.Owner)
+			evicted = append(evicted, t.LockId)
+		}
+		if len(evicted) == 0 {
+			return ErrLockNotHeld
+		}
+		for _, id := range evicted {
+			if err := closeTicket(tx, id, LockTicketEvicted, now); err != nil {
+				return err
+			}
+		}
+		if len(shared) > 0 {
+			if err := syncReaders(tx, w); err != nil {
+				return err
+			}
+		}
+		w.ForceUnlockedAt = &now
+		w.ForceUnlockedBy = req.By
+		w.ForceUnlockReason = req.Reason
+		return tx.Model(&Workspace{}).Where("id = ?", w.ID).Updates(map[string]interface{}{
+			"running":             w.Running,
+			"lock_id":             w.LockId,
+			"lock_expires_at":     w.LockExpiresAt,
+			"lock_owner":          w.LockOwner,
+			"evicted_lock_id":     w.EvictedLockId,
+			"force_unlocked_at":   now,
+			"force_unlocked_by":   req.By,
+			"force_unlock_reason": req.Reason,
+		}).Error
+	})
+	if err != nil {
+		l.WithError(err).Error("failed to force-unlock")
+		return err
+	}
+	notifyLockChange(w.Org, w.Name)
+	l.Debug("end")
+	return nil
+}
+
+// hasAdminToken returns true if MONOTF_ADMIN_TOKEN is set and the request presents it
+func hasAdminToken(r *http.Request) bool {
+	admin := os.Getenv("MONOTF_ADMIN_TOKEN")
+	if admin == "" {
+		return false
+	}
+	token := r.Header.Get("Authorization")
+	return token == "token "+admin || token == admin
+}
+
+// adminAuthorized returns true if the request may perform admin operations,
+// such as a force-unlock. Requests with an API token must have the admin
+// role. Otherwise, if MONOTF_ADMIN_TOKEN is set, the request must present
+// it, and if not, any request which passed authMiddleware is allowed.
+func adminAuthorized(r *http.Request) bool {
+	if t := requestToken(r); t != nil {
+		return rolesInclude(t.Roles, RoleAdmin)
+	}
+	return os.Getenv("MONOTF_ADMIN_TOKEN") == "" || hasAdminToken(r)
+}
+
+// requestRoles returns the roles of the request, which are those of its
+// API token if it has one
+func requestRoles(r *http.Request) []string {
+	if t := requestToken(r); t != nil {
+		return t.Roles
+	}
+	if adminAuthorized(r) {
+		return []string{RoleAdmin}
+	}
+	return nil
+}
+
+func HandleForceUnlock(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleForceUnlock",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to force-unlock")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var req ForceUnlockRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "a reason is required to force-unlock")
+		return
+	}
+	req.By = requestActor(r)
+	var ws Workspace
+	vars := mux.Vars(r)
+	ws.Org = vars["org"]
+	ws.Name = vars["name"]
+	if err := ws.ForceUnlock(req); err != nil {
+		if errors.Is(err, ErrLockNotHeld) {
+			w.WriteHeader(http.StatusConflict)
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ws); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
@@ -0,0 +1,279 @@
+package monotf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultWaitMaxHold = 60 * time.Second
+	// waitRecheckInterval is how often a waiting request re-reads the lock
+	// state from the database, to pick up changes made by other replicas
+	waitRecheckInterval = 5 * time.Second
+)
+
+var (
+	watchersMu sync.Mutex
+	watchers   = make(map[string]map[chan struct{}]struct{})
+)
+
+// LockState is the lock state of a workspace, as returned by the wait
+// and events endpoints
+type LockState struct {
+	Org           string     `json:"org"`
+	Name          string     `json:"name"`
+	Running       bool       `json:"running"`
+	LockId        *string    `json:"lock_id"`
+	LockExpiresAt *time.Time `json:"lock_expires_at"`
+	Readers       int        `json:"readers"`
+}
+
+func (w *Workspace) lockState() LockState {
+	return LockState{
+		Org:           w.Org,
+		Name:          w.Name,
+		Running:       w.Running != nil && *w.Running,
+		LockId:        w.LockId,
+		LockExpiresAt: w.LockExpiresAt,
+		Readers:       w.Readers,
+	}
+}
+
+// holder returns the lock id holding the lock exclusively, or empty if there is none
+func (s LockState) holder() string {
+	if !s.Running || s.LockId == nil {
+		return ""
+	}
+	return *s.LockId
+}
+
+// matches returns true if the lock is held exclusively by holder, or by
+// no one if holder is empty, and has the given number of shared holders
+func (s LockState) matches(holder string, readers int) bool {
+	return s.holder() == holder && s.Readers == readers
+}
+
+// waitMaxHold returns the maximum time the server holds a wait request open
+func waitMaxHold() time.Duration {
+	if v := os.Getenv("MONOTF_WAIT_MAX_HOLD"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return DefaultWaitMaxHold
+}
+
+func watchKey(org, name string) string {
+	return org + "/" + name
+}
+
+// watch subscribes to changes of the key. The returned func must be
+// called to unsubscribe.
+func watch(k string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	watchersMu.Lock()
+	if watchers[k] == nil {
+		watchers[k] = make(map[chan struct{}]struct{})
+	}
+	watchers[k][ch] = struct{}{}
+	watchersMu.Unlock()
+	return ch, func() {
+		watchersMu.Lock()
+		delete(watchers[k], ch)
+		if len(watchers[k]) == 0 {
+			delete(watchers, k)
+		}
+		watchersMu.Unlock()
+	}
+}
+
+// notify wakes all watchers of the key
+func notify(k string) {
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	for ch := range watchers[k] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watchLock subscribes to lock changes of the workspace. The returned
+// func must be called to unsubscribe.
+func watchLock(org, name string) (<-chan struct{}, func()) {
+	return watch(watchKey(org, name))
+}
+
+// notifyLockChange wakes all requests waiting on the workspace lock
+func notifyLockChange(org, name string) {
+	notify(watchKey(org, name))
+}
+
+// getLockState reads the current lock state of the workspace
+func getLockState(org, name string) (LockState, error) {
+	ws := Workspace{Org: org, Name: name}
+	if err := ws.Get(); errors.Is(err, gorm.ErrRecordNotFound) {
+		// a workspace which does not exist yet is unlocked
+		return LockState{Org: org, Name: name}, nil
+	} else if err != nil {
+		return LockState{Org: org, Name: name}, err
+	}
+	return ws.lockState(), nil
+}
+
+// WaitForLockChange blocks until the lock of the workspace no longer matches
+// holder and readers, or until timeout elapses, and returns the current state.
+// If lockId is set, its queue ticket is kept alive while waiting. It returns
+// the error of ctx if ctx is done first, such as when the client disconnects.
+func WaitForLockChange(ctx context.Context, org, name, holder string, readers int, lockId string, timeout time.Duration) (LockState, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":    "ws",
+		"fn":     "WaitForLockChange",
+		"org":    org,
+		"ws":     name,
+		"holder": holder,
+	})
+	l.Debug("start")
+	ch, unwatch := watchLock(org, name)
+	defer unwatch()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	recheck := time.NewTicker(waitRecheckInterval)
+	defer recheck.Stop()
+	for {
+		if lockId != "" {
+			if err := touchTicket(lockId); err != nil {
+				l.WithError(err).Error("failed to touch queue ticket")
+				return LockState{Org: org, Name: name}, err
+			}
+		}
+		s, err := getLockState(org, name)
+		if err != nil {
+			l.WithError(err).Error("failed to get lock state")
+			return s, err
+		}
+		if !s.matches(holder, readers) {
+			l.Debug("end")
+			return s, nil
+		}
+		select {
+		case <-ch:
+		case <-recheck.C:
+		case <-deadline.C:
+			l.Debug("timeout")
+			return s, nil
+		case <-ctx.Done():
+			l.Debug("cancelled")
+			return s, ctx.Err()
+		}
+	}
+}
+
+// requestHold returns the hold time requested with the timeout
+// query param, capped to the server maximum
+func requestHold(r *http.Request) time.Duration {
+	hold := waitMaxHold()
+	if v := r.FormValue("timeout"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 && d < hold {
+			hold = d
+		}
+	}
+	return hold
+}
+
+// HandleWaitLock long-polls until the workspace lock no longer matches the
+// holder (empty for unlocked) and readers query params, up to the requested timeout.
+// Waiting clients pass their own lock_id to keep their place in the queue.
+func HandleWaitLock(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleWaitLock",
+	})
+	l.Debug("start")
+	vars := mux.Vars(r)
+	readers, _ := strconv.Atoi(r.FormValue("readers"))
+	s, err := WaitForLockChange(r.Context(), vars["org"], vars["name"], r.FormValue("holder"), readers, r.FormValue("lock_id"), requestHold(r))
+	if r.Context().Err() != nil {
+		l.Debug("client disconnected")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+// HandleLockEvents streams the workspace lock state as server-sent events,
+// sending the current state and then every change, until the server
+// maximum hold time elapses or the client disconnects
+func HandleLockEvents(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleLockEvents",
+	})
+	l.Debug("start")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		l.Error("streaming unsupported")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	vars := mux.Vars(r)
+	org, name := vars["org"], vars["name"]
+	ch, unwatch := watchLock(org, name)
+	defer unwatch()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	deadline := time.NewTimer(requestHold(r))
+	defer deadline.Stop()
+	recheck := time.NewTicker(waitRecheckInterval)
+	defer recheck.Stop()
+	var last *LockState
+	for {
+		s, err := getLockState(org, name)
+		if err != nil {
+			l.WithError(err).Error("failed to get lock state")
+			return
+		}
+		if last == nil || !last.matches(s.holder(), s.Readers) {
+			bd, err := json.Marshal(s)
+			if err != nil {
+				l.WithError(err).Error("failed to encode event")
+				return
+			}
+			fmt.Fprintf(w, "event: lock\ndata: %s\n\n", bd)
+			flusher.Flush()
+			last = &s
+		}
+		select {
+		case <-ch:
+		case <-recheck.C:
+		case <-deadline.C:
+			l.Debug("end")
+			return
+		case <-r.Context().Done():
+			l.Debug("client disconnected")
+			return
+		}
+	}
+}
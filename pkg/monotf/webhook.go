@@ -0,0 +1,838 @@
+package monotf
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/monotf/internal/db"
+	"github.com/robertlestak/monotf/internal/metrics"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	EventRunStarted        EventType = "run.started"
+	EventRunFinished       EventType = "run.finished"
+	EventRunFailed         EventType = "run.failed"
+	EventDriftDetected     EventType = "drift.detected"
+	EventLockStuck         EventType = "lock.stuck"
+	EventApprovalRequested EventType = "approval.requested"
+
+	// WebhookFormatJSON posts the event as json, WebhookFormatSlack as a
+	// Slack message, and WebhookFormatTeams as a Microsoft Teams message card
+	WebhookFormatJSON  WebhookFormat = "json"
+	WebhookFormatSlack WebhookFormat = "slack"
+	WebhookFormatTeams WebhookFormat = "teams"
+
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryFailed deliveries were not accepted after the maximum number
+	// of attempts, and are not retried
+	DeliveryFailed DeliveryStatus = "failed"
+
+	// DefaultDeliveryListLimit is the number of deliveries returned if no
+	// limit is given
+	DefaultDeliveryListLimit = 50
+	// DefaultWebhookMaxAttempts is the number of times a delivery is tried
+	// if MONOTF_WEBHOOK_MAX_ATTEMPTS is not set
+	DefaultWebhookMaxAttempts = 10
+	// DefaultLockStuckAfter is how long an exclusive lock is held before it
+	// is reported as stuck if MONOTF_LOCK_STUCK_AFTER is not set
+	DefaultLockStuckAfter = time.Hour
+
+	// webhookBackoff is the delay before the first retry of a delivery,
+	// which doubles with each attempt up to webhookMaxBackoff
+	webhookBackoff    = 10 * time.Second
+	webhookMaxBackoff = time.Hour
+	// webhookTimeout is how long a webhook has to respond, and a delivery
+	// being sent is not picked up by another server for webhookClaimTimeout
+	webhookTimeout      = 10 * time.Second
+	webhookClaimTimeout = time.Minute
+	// webhookPollInterval is how often pending deliveries are sent
+	webhookPollInterval = 5 * time.Second
+)
+
+// EventType is the kind of event sent to webhooks
+type EventType string
+
+type WebhookFormat string
+
+type DeliveryStatus string
+
+var (
+	EventTypes = []EventType{
+		EventRunStarted,
+		EventRunFinished,
+		EventRunFailed,
+		EventDriftDetected,
+		EventLockStuck,
+		EventApprovalRequested,
+	}
+)
+
+// Event is something which happened in a workspace, sent to the webhooks
+// which subscribe to its type
+type Event struct {
+	Type   EventType       `json:"type"`
+	Org    string          `json:"org"`
+	Name   string          `json:"name"`
+	Status WorkspaceStatus `json:"status,omitempty"`
+	RunID  *uint           `json:"run_id,omitempty"`
+	// Command, ExitCode, and Changes describe the run of the event
+	Command  string       `json:"command,omitempty"`
+	ExitCode *int         `json:"exit_code,omitempty"`
+	Changes  *PlanChanges `json:"changes,omitempty"`
+	LockId   *string      `json:"lock_id,omitempty"`
+	Owner    *LockOwner   `json:"owner,omitempty"`
+	// Message describes the event in a sentence
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Webhook is an HTTP endpoint which events are posted to. Events are
+// delivered at least once, so receivers should deduplicate them by the
+// X-Monotf-Delivery header.
+type Webhook struct {
+	gorm.Model
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret signs the body of each delivery with HMAC-SHA256, sent as
+	// X-Monotf-Signature: sha256=<hex>. It is never returned, and is kept
+	// if a webhook is updated without one.
+	Secret    string `json:"secret,omitempty"`
+	HasSecret bool   `json:"has_secret" gorm:"-"`
+	// Events are the event types sent to the webhook, or all if empty
+	Events []EventType `json:"events" gorm:"serializer:json"`
+	// Org limits the webhook to the events of an org
+	Org string `json:"org"`
+	// Format is the payload format, json if not set
+	Format WebhookFormat `json:"format"`
+	// Template is a Go text/template executed with the event. For slack
+	// and teams it is the text of the message, which is the message of
+	// the event if not set. For json it replaces the whole body.
+	Template string `json:"template"`
+}
+
+// WebhookDelivery is an event queued for a webhook in the outbox, along
+// with the outcome of its latest attempt
+type WebhookDelivery struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	WebhookID uint      `json:"webhook_id" gorm:"index"`
+	Event     EventType `json:"event"`
+	Org       string    `json:"org"`
+	Name      string    `json:"name"`
+	// Payload is the body which is posted, rendered when the event occurred
+	Payload       string         `json:"payload"`
+	Status        DeliveryStatus `json:"status" gorm:"index"`
+	Attempts      int            `json:"attempts"`
+	NextAttemptAt *time.Time     `json:"next_attempt_at" gorm:"index"`
+	ResponseCode  int            `json:"response_code"`
+	LastError     string         `json:"last_error"`
+	DeliveredAt   *time.Time     `json:"delivered_at"`
+	CreatedAt     time.Time      `json:"created_at"`
+}
+
+// describe returns the default message of the event, e.g.
+// "testing/aws01-us-east-1: run 12 failed (exit 1)"
+func (e Event) describe() string {
+	s := e.Org + "/" + e.Name + ": "
+	run := "run"
+	if e.RunID != nil {
+		run = fmt.Sprintf("run %d", *e.RunID)
+	}
+	switch e.Type {
+	case EventRunStarted:
+		s += run + " started"
+		if e.Command != "" {
+			s += ": terraform " + e.Command
+		}
+		if e.Owner != nil {
+			s += " by " + e.Owner.User + "@" + e.Owner.Hostname
+		}
+	case EventRunFinished:
+		s += fmt.Sprintf("%s finished as %s", run, e.Status)
+	case EventRunFailed:
+		s += fmt.Sprintf("%s %s", run, e.Status)
+	case EventDriftDetected:
+		s += "drift detected by " + run
+	case EventApprovalRequested:
+		s += "plan " + run + " is awaiting approval"
+	case EventLockStuck:
+		s += "lock is stuck, held by " + e.Owner.String()
+	default:
+		s += string(e.Type)
+	}
+	if e.ExitCode != nil && e.Type != EventRunStarted {
+		s += fmt.Sprintf(" (exit %d)", *e.ExitCode)
+	}
+	if e.Changes != nil && (e.Type == EventDriftDetected || e.Type == EventApprovalRequested) {
+		s += fmt.Sprintf(", %d to add, %d to change, %d to destroy",
+			e.Changes.Add, e.Changes.Change, e.Changes.Destroy)
+	}
+	return s
+}
+
+// statusEventType returns the event of a workspace moving to status
+func statusEventType(status WorkspaceStatus) EventType {
+	switch {
+	case status.InProgress():
+		return EventRunStarted
+	case status == WorkspaceStatusFailed, status == WorkspaceStatusErrored:
+		return EventRunFailed
+	case status == WorkspaceStatusDrifted:
+		return EventDriftDetected
+	case status == WorkspaceStatusAwaitingApproval:
+		return EventApprovalRequested
+	}
+	return EventRunFinished
+}
+
+// event returns the event of type t of the run
+func (r *Run) event(t EventType) Event {
+	id := r.ID
+	return Event{
+		Type:     t,
+		Org:      r.Org,
+		Name:     r.Name,
+		Status:   r.Status,
+		RunID:    &id,
+		Command:  r.Command,
+		ExitCode: r.ExitCode,
+		Changes:  r.Changes,
+		LockId:   r.LockId,
+		Owner:    r.Owner,
+	}
+}
+
+// finishEvent returns the event of the run finishing with its status, or
+// false if there is none. Speculative plans and drift checks do not change
+// the workspace, so they only send drift.detected.
+func (r *Run) finishEvent() (Event, bool) {
+	if isDriftCheck(r.Args) {
+		return r.event(EventDriftDetected), r.Status == WorkspaceStatusDrifted
+	}
+	if r.Speculative {
+		return Event{}, false
+	}
+	return r.event(statusEventType(r.Status)), true
+}
+
+// Validate checks the webhook has a url, and a valid format, template,
+// and events
+func (wh *Webhook) Validate() error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %s", wh.URL)
+	}
+	switch wh.Format {
+	case "", WebhookFormatJSON, WebhookFormatSlack, WebhookFormatTeams:
+	default:
+		return fmt.Errorf("invalid format %s, must be one of json, slack, teams", wh.Format)
+	}
+	if wh.Template != "" {
+		if _, err := template.New("webhook").Parse(wh.Template); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+	for _, e := range wh.Events {
+		valid := false
+		for _, v := range EventTypes {
+			valid = valid || e == v
+		}
+		if !valid {
+			return fmt.Errorf("invalid event %s", e)
+		}
+	}
+	return nil
+}
+
+// redact hides the secret of the webhook before it is returned
+func (wh *Webhook) redact() {
+	wh.HasSecret = wh.Secret != ""
+	wh.Secret = ""
+}
+
+// subscribes returns true if the event is sent to the webhook
+func (wh *Webhook) subscribes(ev Event) bool {
+	if wh.Org != "" && wh.Org != ev.Org {
+		return false
+	}
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == ev.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// payload renders the body posted to the webhook for the event
+func (wh *Webhook) payload(ev Event) ([]byte, error) {
+	text := ev.Message
+	if wh.Template != "" {
+		t, err := template.New("webhook").Parse(wh.Template)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, ev); err != nil {
+			return nil, err
+		}
+		text = buf.String()
+	}
+	switch wh.Format {
+	case WebhookFormatSlack:
+		return json.Marshal(map[string]string{"text": text})
+	case WebhookFormatTeams:
+		return json.Marshal(map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  ev.Message,
+			"text":     text,
+		})
+	}
+	if wh.Template != "" {
+		return []byte(text), nil
+	}
+	return json.Marshal(ev)
+}
+
+// sign returns the signature of the body with the secret of the webhook
+func (wh *Webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(wh.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// emitEvent queues the event for delivery to each webhook subscribed to it
+// within tx, so that the event is only sent if the change it describes is
+// committed
+func emitEvent(tx *gorm.DB, ev Event) error {
+	if ev.Message == "" {
+		ev.Message = ev.describe()
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	var hooks []Webhook
+	if err := tx.Where("org = ? OR org = ?", ev.Org, "").Order("id").Find(&hooks).Error; err != nil {
+		return err
+	}
+	for i := range hooks {
+		wh := &hooks[i]
+		if !wh.subscribes(ev) {
+			continue
+		}
+		body, err := wh.payload(ev)
+		if err != nil {
+			// a broken template must not block the change, so the event
+			// is sent as json instead
+			log.WithFields(log.Fields{
+				"pkg":     "ws",
+				"fn":      "emitEvent",
+				"webhook": wh.ID,
+				"event":   ev.Type,
+			}).WithError(err).Warn("failed to render webhook payload")
+			if body, err = json.Marshal(ev); err != nil {
+				return err
+			}
+		}
+		d := WebhookDelivery{
+			WebhookID:     wh.ID,
+			Event:         ev.Type,
+			Org:           ev.Org,
+			Name:          ev.Name,
+			Payload:       string(body),
+			Status:        DeliveryPending,
+			NextAttemptAt: &ev.Time,
+		}
+		if err := tx.Create(&d).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookMaxAttempts returns the number of times a delivery is tried
+func webhookMaxAttempts() int {
+	if v := os.Getenv("MONOTF_WEBHOOK_MAX_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return DefaultWebhookMaxAttempts
+}
+
+// webhookRetryDelay returns the delay before retrying a delivery which
+// failed its attempts-th attempt
+func webhookRetryDelay(attempts int) time.Duration {
+	d := webhookBackoff
+	for i := 1; i < attempts && d < webhookMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > webhookMaxBackoff {
+		d = webhookMaxBackoff
+	}
+	return d
+}
+
+// send posts the delivery to the webhook, and returns the response code
+func (d *WebhookDelivery) send(wh *Webhook) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "monotf")
+	req.Header.Set("X-Monotf-Event", string(d.Event))
+	req.Header.Set("X-Monotf-Delivery", strconv.FormatUint(uint64(d.ID), 10))
+	if wh.Secret != "" {
+		req.Header.Set("X-Monotf-Signature", wh.sign(body))
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bd, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(bd)))
+	}
+	return resp.StatusCode, nil
+}
+
+// deliver claims the delivery, so that no other server sends it at the
+// same time, and sends it. A delivery which fails is retried with
+// exponential backoff until it has been tried the maximum number of times.
+func (d *WebhookDelivery) deliver() error {
+	l := log.WithFields(log.Fields{
+		"pkg":      "ws",
+		"fn":       "WebhookDelivery.deliver",
+		"webhook":  d.WebhookID,
+		"delivery": d.ID,
+		"event":    d.Event,
+	})
+	now := time.Now()
+	claim := now.Add(webhookClaimTimeout)
+	res := db.DB.Model(&WebhookDelivery{}).
+		Where("id = ? AND status = ? AND attempts = ?", d.ID, DeliveryPending, d.Attempts).
+		Updates(map[string]interface{}{
+			"attempts":        d.Attempts + 1,
+			"next_attempt_at": claim,
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// claimed by another server
+		return nil
+	}
+	d.Attempts++
+	var wh Webhook
+	updates := map[string]interface{}{}
+	if err := db.DB.First(&wh, d.WebhookID).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		updates["status"] = DeliveryFailed
+		updates["last_error"] = "webhook was deleted"
+		updates["next_attempt_at"] = nil
+		return db.DB.Model(d).Updates(updates).Error
+	} else if err != nil {
+		return err
+	}
+	code, err := d.send(&wh)
+	updates["response_code"] = code
+	switch {
+	case err == nil:
+		l.Debug("delivered")
+		delivered := time.Now()
+		updates["status"] = DeliveryDelivered
+		updates["delivered_at"] = delivered
+		updates["last_error"] = ""
+		updates["next_attempt_at"] = nil
+		metrics.WebhookDeliveries.WithLabelValues(string(DeliveryDelivered)).Inc()
+	case d.Attempts >= webhookMaxAttempts():
+		l.WithError(err).Errorf("delivery failed after %d attempts", d.Attempts)
+		updates["status"] = DeliveryFailed
+		updates["last_error"] = err.Error()
+		updates["next_attempt_at"] = nil
+		metrics.WebhookDeliveries.WithLabelValues(string(DeliveryFailed)).Inc()
+	default:
+		next := time.Now().Add(webhookRetryDelay(d.Attempts))
+		l.WithError(err).Warnf("delivery attempt %d failed, retrying at %s", d.Attempts, next.Format(time.RFC3339))
+		updates["last_error"] = err.Error()
+		updates["next_attempt_at"] = next
+		metrics.WebhookDeliveries.WithLabelValues("retried").Inc()
+	}
+	return db.DB.Model(d).Updates(updates).Error
+}
+
+// DeliverWebhooks sends the deliveries in the outbox which are due
+func DeliverWebhooks() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "DeliverWebhooks",
+	})
+	l.Debug("start")
+	var ds []WebhookDelivery
+	if err := db.DB.Where("status = ? AND next_attempt_at <= ?", DeliveryPending, time.Now()).
+		Order("id").Limit(100).Find(&ds).Error; err != nil {
+		l.WithError(err).Error("failed to list pending deliveries")
+		return err
+	}
+	for i := range ds {
+		if err := ds[i].deliver(); err != nil {
+			l.WithError(err).WithField("delivery", ds[i].ID).Error("failed to deliver webhook")
+		}
+	}
+	l.Debug("end")
+	return nil
+}
+
+func deliverWebhooks() {
+	l := log.WithField("func", "deliverWebhooks")
+	l.Debug("delivering webhooks")
+	for {
+		time.Sleep(webhookPollInterval)
+		if err := DeliverWebhooks(); err != nil {
+			l.WithError(err).Error("error delivering webhooks")
+		}
+	}
+}
+
+// lockStuckAfter returns how long an exclusive lock is held before it is
+// reported as stuck
+func lockStuckAfter() time.Duration {
+	if v := os.Getenv("MONOTF_LOCK_STUCK_AFTER"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return DefaultLockStuckAfter
+}
+
+// ReportStuckLocks sends lock.stuck for each exclusive lock which has been
+// held for longer than MONOTF_LOCK_STUCK_AFTER, once per lock. A lock which
+// is still renewed is not released by the server, so a run which hangs
+// would otherwise hold the workspace indefinitely.
+func ReportStuckLocks() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ReportStuckLocks",
+	})
+	l.Debug("start")
+	now := time.Now()
+	var tickets []LockTicket
+	if err := db.DB.Where("status = ? AND mode = ? AND granted_at < ? AND stuck_reported_at IS NULL",
+		LockTicketGranted, LockModeExclusive, now.Add(-lockStuckAfter())).
+		Find(&tickets).Error; err != nil {
+		l.WithError(err).Error("failed to list stuck locks")
+		return err
+	}
+	for _, t := range tickets {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			res := tx.Model(&LockTicket{}).
+				Where("id = ? AND status = ? AND stuck_reported_at IS NULL", t.ID, LockTicketGranted).
+				Update("stuck_reported_at", now)
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			lockId := t.LockId
+			ev := Event{
+				Type:   EventLockStuck,
+				Org:    t.Org,
+				Name:   t.Name,
+				LockId: &lockId,
+				Owner:  t.Owner,
+			}
+			ev.Message = fmt.Sprintf("%s/%s: lock is stuck, held for %s by %s",
+				t.Org, t.Name, now.Sub(*t.GrantedAt).Round(time.Second), t.Owner)
+			return emitEvent(tx, ev)
+		})
+		if err != nil {
+			l.WithError(err).WithField("lock", t.LockId).Error("failed to report stuck lock")
+		}
+	}
+	l.Debug("end")
+	return nil
+}
+
+// ListWebhooks returns all webhooks, without their secrets
+func ListWebhooks() ([]Webhook, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "ListWebhooks",
+	})
+	l.Debug("start")
+	var hooks []Webhook
+	if err := db.DB.Order("id").Find(&hooks).Error; err != nil {
+		l.WithError(err).Error("failed to list webhooks")
+		return nil, err
+	}
+	for i := range hooks {
+		hooks[i].redact()
+	}
+	l.Debug("end")
+	return hooks, nil
+}
+
+// GetWebhook returns the webhook with the given id, without its secret
+func GetWebhook(id string) (*Webhook, error) {
+	wh := &Webhook{}
+	if err := db.DB.Where("id = ?", id).First(wh).Error; err != nil {
+		return nil, err
+	}
+	wh.redact()
+	return wh, nil
+}
+
+// Save creates the webhook, or updates it if it has an id. The secret of
+// an existing webhook is kept if none is given.
+func (wh *Webhook) Save() error {
+	l := log.WithFields(log.Fields{
+		"pkg":     "ws",
+		"fn":      "Webhook.Save",
+		"webhook": wh.ID,
+		"name":    wh.Name,
+	})
+	l.Debug("start")
+	if err := wh.Validate(); err != nil {
+		l.WithError(err).Error("invalid webhook")
+		return err
+	}
+	if wh.Format == "" {
+		wh.Format = WebhookFormatJSON
+	}
+	var err error
+	if wh.ID == 0 {
+		err = db.DB.Create(wh).Error
+	} else {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var ewh Webhook
+			if err := tx.First(&ewh, wh.ID).Error; err != nil {
+				return err
+			}
+			wh.CreatedAt = ewh.CreatedAt
+			if wh.Secret == "" {
+				wh.Secret = ewh.Secret
+			}
+			return tx.Save(wh).Error
+		})
+	}
+	if err != nil {
+		l.WithError(err).Error("failed to save webhook")
+		return err
+	}
+	wh.redact()
+	l.Debug("end")
+	return nil
+}
+
+// DeleteWebhook removes the webhook with the given id. Its pending
+// deliveries fail when they are next tried.
+func DeleteWebhook(id string) error {
+	l := log.WithFields(log.Fields{
+		"pkg":     "ws",
+		"fn":      "DeleteWebhook",
+		"webhook": id,
+	})
+	l.Debug("start")
+	res := db.DB.Unscoped().Where("id = ?", id).Delete(&Webhook{})
+	if res.Error != nil {
+		l.WithError(res.Error).Error("failed to delete webhook")
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	l.Debug("end")
+	return nil
+}
+
+// ListDeliveries returns the deliveries of the webhook, newest first. If
+// status is set, only deliveries with that status are returned.
+func ListDeliveries(webhookId string, status DeliveryStatus, limit int) ([]WebhookDelivery, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":     "ws",
+		"fn":      "ListDeliveries",
+		"webhook": webhookId,
+	})
+	l.Debug("start")
+	if limit <= 0 {
+		limit = DefaultDeliveryListLimit
+	}
+	q := db.DB.Where("webhook_id = ?", webhookId)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	var ds []WebhookDelivery
+	if err := q.Order("id desc").Limit(limit).Find(&ds).Error; err != nil {
+		l.WithError(err).Error("failed to list deliveries")
+		return nil, err
+	}
+	l.Debug("end")
+	return ds, nil
+}
+
+func HandleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleListWebhooks",
+	})
+	l.Debug("start")
+	hooks, err := ListWebhooks()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hooks); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleGetWebhook",
+	})
+	l.Debug("start")
+	wh, err := GetWebhook(mux.Vars(r)["id"])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(wh); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleSaveWebhook(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleSaveWebhook",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to manage webhooks")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var wh Webhook
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		l.WithError(err).Error("failed to decode request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	wh.ID = 0
+	if v, ok := mux.Vars(r)["id"]; ok {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid webhook id %s", v)
+			return
+		}
+		wh.ID = uint(id)
+	}
+	if err := wh.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if err := wh.Save(); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(wh); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleDeleteWebhook",
+	})
+	l.Debug("start")
+	if !adminAuthorized(r) {
+		l.Debug("not authorized to manage webhooks")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := DeleteWebhook(mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	l.Debug("end")
+}
+
+func HandleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "ws",
+		"fn":  "HandleListDeliveries",
+	})
+	l.Debug("start")
+	var limit int
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid limit %s", v)
+			return
+		}
+	}
+	ds, err := ListDeliveries(mux.Vars(r)["id"], DeliveryStatus(r.FormValue("status")), limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ds); err != nil {
+		l.WithError(err).Error("failed to encode response body")
+		return
+	}
+	l.Debug("end")
+}
@@ -1,13 +1,13 @@
 package monotf
 
 import (
-	"database/sql"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/robertlestak/monotf/internal/db"
 	log "github.com/sirupsen/logrus"
-	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
 )
 
 const (
@@ -16,6 +16,20 @@ const (
 	WorkspaceStatusPending WorkspaceStatus = "pending"
 	WorkspaceStatusUnknown WorkspaceStatus = "unknown"
 	WorkspaceStatusDrifted WorkspaceStatus = "drifted"
+	// WorkspaceStatusPlanning and WorkspaceStatusApplying are the statuses
+	// of a workspace while a plan or apply is running
+	WorkspaceStatusPlanning WorkspaceStatus = "planning"
+	WorkspaceStatusApplying WorkspaceStatus = "applying"
+	// WorkspaceStatusAwaitingApproval is the status of a workspace with a
+	// plan which must be approved before it is applied
+	WorkspaceStatusAwaitingApproval WorkspaceStatus = "awaiting_approval"
+	// WorkspaceStatusCancelled is the status of a workspace whose run was
+	// stopped before it finished
+	WorkspaceStatusCancelled WorkspaceStatus = "cancelled"
+	// WorkspaceStatusErrored is the status of a workspace whose run could
+	// not be completed, such as when its client went away, as opposed to
+	// one which terraform reported as failed
+	WorkspaceStatusErrored WorkspaceStatus = "errored"
 )
 
 var (
@@ -25,6 +39,11 @@ var (
 		WorkspaceStatusPending,
 		WorkspaceStatusUnknown,
 		WorkspaceStatusDrifted,
+		WorkspaceStatusPlanning,
+		WorkspaceStatusApplying,
+		WorkspaceStatusAwaitingApproval,
+		WorkspaceStatusCancelled,
+		WorkspaceStatusErrored,
 	}
 )
 
@@ -33,6 +52,9 @@ type WorkspaceStatus string
 type OrgStatusCounts struct {
 	Org    string                  `json:"org"`
 	Counts map[WorkspaceStatus]int `json:"counts"`
+	// Changes counts the resource changes pending in the workspaces of
+	// the org, by action
+	Changes map[PlanAction]int `json:"changes"`
 }
 
 func (w *Workspace) EnsureValidStatus() error {
@@ -76,39 +98,84 @@ func (w *Workspace) Save() error {
 		l.WithError(err).Error("invalid status")
 		return err
 	}
-	// if w.Running is nil, then use the value from the db
-	if w.Running == nil {
-		var isRunning bool
-		if err := db.DB.Model(&Workspace{}).Where("org = ? AND name = ?", w.Org, w.Name).Pluck("running", &isRunning).Error; err != nil {
-			l.WithError(err).Error("failed to get running")
-			return err
-		}
-		w.Running = &isRunning
-	}
-	// get current lock id from db
-	var existingLockID sql.NullString
-	if err := db.DB.Model(&Workspace{}).Where("org = ? AND name = ?", w.Org, w.Name).Pluck("lock_id", &existingLockID).Error; err != nil {
-		l.WithError(err).Error("failed to get lock id")
+	// output sent by older clients is stored before the row is locked
+	stored, err := (&Run{Org: w.Org, Name: w.Name}).writeOutput(w.Output)
+	if err != nil {
+		l.WithError(err).Error("failed to store workspace output")
 		return err
 	}
-	// if lock id is different, throw error unless force is set
-	if w.LockId != nil && existingLockID.Valid && *w.LockId != existingLockID.String {
-		l.Errorf("lock id mismatch. existing: %s, new: %s", existingLockID.String, *w.LockId)
-		return fmt.Errorf("lock id mismatch. existing: %s, new: %s", existingLockID.String, *w.LockId)
-	}
-	if err := db.DB.Clauses(clause.OnConflict{
-		// update all
-		Columns: []clause.Column{{Name: "org"}, {Name: "name"}},
-		DoUpdates: clause.AssignmentColumns([]string{
-			"status",
-			"output",
-			"running",
-			"version",
-			"path",
-			"lock_id",
-			"workspace_name",
-		}),
-	}).Save(w).Error; err != nil {
+	// the row is locked for the duration of the update so that the
+	// lock id check and the write are atomic. running and lock_id are
+	// owned by the lock endpoints, see lock.go
+	err = db.Transaction(func(tx *gorm.DB) error {
+		ew := Workspace{
+			Org:           w.Org,
+			Name:          w.Name,
+			WorkspaceName: w.WorkspaceName,
+			Version:       w.Version,
+		}
+		if err := lockWorkspaceRow(tx, &ew); err != nil {
+			return err
+		}
+		// if lock id is different, throw error
+		if w.LockId != nil && ew.LockId != nil && *w.LockId != *ew.LockId {
+			return fmt.Errorf("lock id mismatch. existing: %s, new: %s", *ew.LockId, *w.LockId)
+		}
+		// a holder which was force-unlocked may not write its results
+		if err := checkNotEvicted(tx, w.LockId); err != nil {
+			return err
+		}
+		updates := map[string]interface{}{
+			"version":        w.Version,
+			"workspace_name": w.WorkspaceName,
+		}
+		// clients which predate the runs endpoints send their output with
+		// the workspace, so record it as a completed run
+		if w.Output != "" {
+			now := time.Now()
+			run := Run{
+				Org:        w.Org,
+				Name:       w.Name,
+				LockId:     w.LockId,
+				StartedAt:  now,
+				FinishedAt: &now,
+				Status:     w.Status,
+			}
+			run.setOutput(stored)
+			if err := tx.Create(&run).Error; err != nil {
+				return err
+			}
+			updates["latest_run_id"] = run.ID
+			w.LatestRunId = &run.ID
+		}
+		if err := ew.transitionUpdates(tx, w.Status, w.LatestRunId, updates); err != nil {
+			return err
+		}
+		// a run recorded by an older client, or a status set directly, is
+		// sent to webhooks as the event of the status
+		if _, changed := updates["status"]; changed || w.Output != "" {
+			ev := Event{
+				Type:   statusEventType(w.Status),
+				Org:    w.Org,
+				Name:   w.Name,
+				Status: w.Status,
+				RunID:  w.LatestRunId,
+				LockId: w.LockId,
+			}
+			if err := emitEvent(tx, ev); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&ew).Updates(updates).Error; err != nil {
+			return err
+		}
+		w.Model = ew.Model
+		w.Running = ew.Running
+		w.LockId = ew.LockId
+		return nil
+	})
+	if err != nil {
+		stored.discard()
 		l.WithError(err).Error("failed to save workspace")
 		return err
 	}
@@ -345,7 +412,7 @@ func GetOrgStatusCount(org string) (OrgStatusCounts, error) {
 		Count  int
 	}
 	var counts []wsCount
-	if err := db.DB.Table("workspaces").Select("status, count(*)").Where("org = ?", org).Group("status").Scan(&counts).Error; err != nil {
+	if err := db.DB.Table("workspaces").Select("status, count(*) AS count").Where("org = ?", org).Group("status").Scan(&counts).Error; err != nil {
 		l.WithError(err).Error("failed to get org status count")
 		return OrgStatusCounts{}, err
 	}
@@ -359,6 +426,12 @@ func GetOrgStatusCount(org string) (OrgStatusCounts, error) {
 			c.Counts[s] = 0
 		}
 	}
+	changes, err := pendingChangeCounts(org)
+	if err != nil {
+		l.WithError(err).Error("failed to get org pending change count")
+		return OrgStatusCounts{}, err
+	}
+	c.Changes = changes
 	return c, nil
 }
 